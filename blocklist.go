@@ -0,0 +1,749 @@
+package coverbee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// CounterWidth is the width in bits of a single counter in the cover-map.
+type CounterWidth int
+
+const (
+	// Counter8Bit counters wrap around (or saturate) after 255 executions of a block.
+	Counter8Bit CounterWidth = 8
+	// Counter16Bit counters wrap around (or saturate) after 65535 executions of a block. This is the default.
+	Counter16Bit CounterWidth = 16
+	// Counter32Bit counters wrap around (or saturate) after 2^32-1 executions of a block.
+	Counter32Bit CounterWidth = 32
+	// Counter64Bit counters wrap around (or saturate) after 2^64-1 executions of a block.
+	Counter64Bit CounterWidth = 64
+)
+
+// Bytes returns the size of a counter in bytes.
+func (cw CounterWidth) Bytes() int {
+	return int(cw) / 8
+}
+
+// Max returns the maximum value a counter of this width can hold.
+func (cw CounterWidth) Max() uint64 {
+	if cw == Counter64Bit {
+		return math.MaxUint64
+	}
+
+	return 1<<uint(cw) - 1
+}
+
+func (cw CounterWidth) validate() error {
+	switch cw {
+	case Counter8Bit, Counter16Bit, Counter32Bit, Counter64Bit:
+		return nil
+	default:
+		return fmt.Errorf("invalid counter width '%d', pick from 8, 16, 32 or 64", cw)
+	}
+}
+
+func (cw CounterWidth) asmSize() asm.Size {
+	switch cw {
+	case Counter8Bit:
+		return asm.Byte
+	case Counter32Bit:
+		return asm.Word
+	case Counter64Bit:
+		return asm.DWord
+	default:
+		return asm.Half
+	}
+}
+
+// jumpIfMax returns an instruction which skips `skip` instructions if the counter in `reg` has reached the max value.
+func (cw CounterWidth) jumpIfMax(reg asm.Register, skip int16) asm.Instruction {
+	class := asm.JumpClass
+	constant := int64(cw.Max())
+	// Immediate values are sign extended to 64-bit, so the max value of 32 and 64-bit counters is encoded as -1. For
+	// 32-bit counters we compare only the lower 32-bits of the register so the value is not extended.
+	switch cw {
+	case Counter32Bit:
+		class = asm.Jump32Class
+		constant = -1
+	case Counter64Bit:
+		constant = -1
+	}
+
+	return asm.Instruction{
+		OpCode:   asm.OpCode(class).SetJumpOp(asm.JEq).SetSource(asm.ImmSource),
+		Dst:      reg,
+		Offset:   skip,
+		Constant: constant,
+	}
+}
+
+// decode reads a single counter of this width from the start of `b`.
+func (cw CounterWidth) decode(b []byte) uint64 {
+	switch cw {
+	case Counter8Bit:
+		return uint64(b[0])
+	case Counter32Bit:
+		return uint64(nativeEndianess().Uint32(b))
+	case Counter64Bit:
+		return nativeEndianess().Uint64(b)
+	default:
+		return uint64(nativeEndianess().Uint16(b))
+	}
+}
+
+// CounterStrategy determines how the instrumentation code increments counters.
+type CounterStrategy string
+
+const (
+	// CounterStrategyAuto picks the best strategy supported by the kernel and the counter width. In order of
+	// preference: per-CPU, atomic, shared. Instrumenting offline, with verifier logs or static analysis and without
+	// loading the collection, always picks shared.
+	CounterStrategyAuto CounterStrategy = "auto"
+	// CounterStrategyShared increments counters with a plain load, add and store on a single shared map value.
+	// Concurrent executions on different CPUs can lose increments.
+	CounterStrategyShared CounterStrategy = "shared"
+	// CounterStrategyAtomic increments counters with an atomic add on a single shared map value. Only works with
+	// 32 and 64-bit counters which are not saturating.
+	CounterStrategyAtomic CounterStrategy = "atomic"
+	// CounterStrategyPerCPU uses a per-CPU cover-map so each CPU increments its own counters. The values of all CPUs
+	// are summed when reading the cover-map.
+	CounterStrategyPerCPU CounterStrategy = "percpu"
+)
+
+func (cs CounterStrategy) validate() error {
+	switch cs {
+	case CounterStrategyAuto, CounterStrategyShared, CounterStrategyAtomic, CounterStrategyPerCPU:
+		return nil
+	default:
+		return fmt.Errorf("invalid counter strategy '%s', pick from auto, shared, atomic or percpu", cs)
+	}
+}
+
+// CounterStorage determines how the instrumentation code gets a pointer to the counters in the cover-map.
+type CounterStorage string
+
+const (
+	// CounterStorageLookup looks up the cover-map entry at the start of every program and function and keeps the
+	// pointer to the value in the stack frame of the function. This is the default.
+	CounterStorageLookup CounterStorage = "lookup"
+	// CounterStorageGlobal stores all counters in a single cover-map value which is accessed directly, like global
+	// data. There is no lookup at the start of functions, but it requires a kernel with direct map value access (5.2)
+	// and doesn't work with per-CPU counters.
+	CounterStorageGlobal CounterStorage = "global"
+)
+
+func (cs CounterStorage) validate() error {
+	switch cs {
+	case CounterStorageLookup, CounterStorageGlobal:
+		return nil
+	default:
+		return fmt.Errorf("invalid counter storage '%s', pick from lookup or global", cs)
+	}
+}
+
+// CoverMapLayout describes how the counters are stored in the cover-map. The instrumentation code and the code reading
+// the cover-map must agree on the layout, which is why it is recorded in the block-list.
+type CoverMapLayout struct {
+	// The width of each counter, defaults to `Counter16Bit`.
+	CounterWidth CounterWidth
+	// If true, counters stop at their max value instead of wrapping around to 0.
+	Saturating bool
+	// The way counters are incremented, defaults to `CounterStrategyAuto`.
+	Strategy CounterStrategy
+	// The way the instrumentation code accesses the counters, defaults to `CounterStorageLookup`.
+	Storage CounterStorage
+	// The number of counters in each entry of the cover-map, counter N is stored in entry N / CountersPerEntry.
+	// 0 means all counters are stored in the first entry.
+	CountersPerEntry int
+	// The number of counters the cover-map has room for. 0 means the cover-map is just large enough for the counters
+	// of the instrumented collection. A cover-map shared by multiple collections needs room for the counters of all
+	// of them, since a map can't be resized once it is created.
+	Capacity int
+}
+
+func (l CoverMapLayout) withDefaults() CoverMapLayout {
+	if l.CounterWidth == 0 {
+		l.CounterWidth = Counter16Bit
+	}
+
+	if l.Strategy == "" {
+		l.Strategy = CounterStrategyAuto
+	}
+
+	if l.Storage == "" {
+		l.Storage = CounterStorageLookup
+	}
+
+	return l
+}
+
+func (l CoverMapLayout) validate() error {
+	if err := l.CounterWidth.validate(); err != nil {
+		return err
+	}
+
+	if err := l.Strategy.validate(); err != nil {
+		return err
+	}
+
+	if l.Strategy == CounterStrategyAtomic {
+		if l.CounterWidth != Counter32Bit && l.CounterWidth != Counter64Bit {
+			return fmt.Errorf("atomic counters must be 32 or 64 bits, not %d", l.CounterWidth)
+		}
+
+		if l.Saturating {
+			return fmt.Errorf("atomic counters can't be saturating")
+		}
+	}
+
+	if err := l.Storage.validate(); err != nil {
+		return err
+	}
+
+	if l.Storage == CounterStorageGlobal && l.Strategy == CounterStrategyPerCPU {
+		return fmt.Errorf("global counters can't be per-CPU")
+	}
+
+	if l.CountersPerEntry < 0 {
+		return fmt.Errorf("invalid number of counters per entry '%d'", l.CountersPerEntry)
+	}
+
+	if l.Capacity < 0 {
+		return fmt.Errorf("invalid cover-map capacity '%d'", l.Capacity)
+	}
+
+	return nil
+}
+
+// mapType returns the type of cover-map needed for the strategy of the layout.
+func (l CoverMapLayout) mapType() ebpf.MapType {
+	if l.Strategy == CounterStrategyPerCPU {
+		return ebpf.PerCPUArray
+	}
+
+	return ebpf.Array
+}
+
+// maxValueSize returns the max size of a single cover-map entry. Global counters are addressed with a 32-bit offset
+// in the instruction which loads the address of the counter, so their size is only limited by the kernel.
+func (l CoverMapLayout) maxValueSize() int {
+	if l.Storage == CounterStorageGlobal {
+		return math.MaxInt32
+	}
+
+	return maxCoverMapValueSize
+}
+
+// BlockList is a block-list together with the layout of the cover-map it was made for. This is the format in which
+// block-lists are stored between instrumentation and reading of the cover-map.
+type BlockList struct {
+	Layout CoverMapLayout
+	Blocks [][]CoverBlock
+	// The counter of each block, indexed by block ID. If nil, the counter of a block has the same index as the block.
+	// -1 for blocks of which the count is derived.
+	BlockCounters []int
+	// How the counts of blocks without counter are derived from the counters of other blocks.
+	DerivedCounts []DerivedCount
+	// The programs and functions of which the entry block is instrumented.
+	Functions []FunctionCoverage
+	// The content-based identity of each block, indexed by block ID. Used to match blocks of different loads.
+	Identities []BlockIdentity
+	// Only set if the programs were instrumented with branch coverage.
+	Branches []BranchCoverage
+	// The policy for failed cover-map lookups of each program, indexed by program name.
+	LookupFailures map[string]LookupFailure
+	// How each program was instrumented, indexed by program name.
+	Programs map[string]ProgramInstrumentation
+}
+
+// BranchCoverage describes a conditional jump of which both outcomes are counted.
+type BranchCoverage struct {
+	// The block ID of the block which ends with the conditional jump.
+	BlockID int
+	// The source location of the conditional jump, empty if the block has no line info.
+	Filename string
+	Line     int
+	// The indices of the counters for the taken and not-taken outcomes.
+	TakenCounter    int
+	NotTakenCounter int
+	// The number of times the jump was taken or not taken, set by `BlockList.ApplyCoverMap`.
+	Taken    int
+	NotTaken int
+}
+
+// BlockIdentity identifies a block by its contents instead of its block ID. The identity of a block is the same for
+// every load of the same programs, so counts of different loads can be merged.
+type BlockIdentity struct {
+	// The name of the program which contains the block.
+	Program string
+	// The offset of the first instruction of the block in the original program, in raw instructions.
+	Offset int
+	// The source location of the first instruction of the block with line info, empty if the block has no line info.
+	Filename string
+	Line     int
+}
+
+func (bi BlockIdentity) String() string {
+	if bi.Filename == "" {
+		return fmt.Sprintf("%s+%d", bi.Program, bi.Offset)
+	}
+
+	return fmt.Sprintf("%s+%d (%s:%d)", bi.Program, bi.Offset, bi.Filename, bi.Line)
+}
+
+// ReadBlockList reads a JSON encoded block-list. Both the `BlockList` format and the older format which only contains
+// the blocks are accepted, for the older format the default layout is assumed.
+func ReadBlockList(r io.Reader) (*BlockList, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var blockList BlockList
+	if bytes.HasPrefix(bytes.TrimSpace(contents), []byte("[")) {
+		if err = json.Unmarshal(contents, &blockList.Blocks); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	} else {
+		if err = json.Unmarshal(contents, &blockList); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+
+	// Block-lists without a strategy were made before other strategies existed.
+	if blockList.Layout.Strategy == "" {
+		blockList.Layout.Strategy = CounterStrategyShared
+	}
+	blockList.Layout = blockList.Layout.withDefaults()
+	if err = blockList.Layout.validate(); err != nil {
+		return nil, fmt.Errorf("cover-map layout: %w", err)
+	}
+
+	return &blockList, nil
+}
+
+// ApplyCoverMap reads from the coverage map and applies the counts inside the map to the blocks and branches,
+// decoding the counters according to the layout of the block-list.
+func (bl *BlockList) ApplyCoverMap(coverMap *ebpf.Map) error {
+	counters, err := readCounters(coverMap, bl.Layout.withDefaults(), bl.numCounters())
+	if err != nil {
+		return err
+	}
+
+	return bl.applyCounters(counters)
+}
+
+// applyCounters sets the counts of the blocks, functions and branches from the values of the counters of every CPU,
+// as returned by `readCounters`.
+func (bl *BlockList) applyCounters(cpuCounters [][]uint64) error {
+	if bl.BlockCounters != nil && len(bl.BlockCounters) != len(bl.Blocks) {
+		return fmt.Errorf(
+			"block-list has %d blocks but %d block counters", len(bl.Blocks), len(bl.BlockCounters),
+		)
+	}
+
+	counts, err := blockCounts(
+		cpuCounters, bl.Layout.withDefaults().CounterWidth, bl.BlockCounters, bl.DerivedCounts, len(bl.Blocks),
+	)
+	if err != nil {
+		return err
+	}
+	applyCounts(counts, bl.Blocks)
+
+	counters := sumCounters(cpuCounters)
+
+	for i := range bl.Functions {
+		if bl.Functions[i].BlockID < 0 || bl.Functions[i].BlockID >= len(counts) {
+			return fmt.Errorf("function '%s' has unknown block %d", bl.Functions[i].Name, bl.Functions[i].BlockID)
+		}
+		bl.Functions[i].Calls = counts[bl.Functions[i].BlockID]
+	}
+
+	for i := range bl.Branches {
+		bl.Branches[i].Taken = counterToCount(counters[bl.Branches[i].TakenCounter])
+		bl.Branches[i].NotTaken = counterToCount(counters[bl.Branches[i].NotTakenCounter])
+	}
+
+	return nil
+}
+
+// numCounters returns the number of counters used by the blocks and branches, which is one more than the highest
+// counter.
+func (bl *BlockList) numCounters() int {
+	numCounters := 0
+	if bl.BlockCounters == nil {
+		numCounters = len(bl.Blocks)
+	}
+	for _, counter := range bl.BlockCounters {
+		if counter >= numCounters {
+			numCounters = counter + 1
+		}
+	}
+	for _, branch := range bl.Branches {
+		for _, counter := range []int{branch.TakenCounter, branch.NotTakenCounter} {
+			if counter >= numCounters {
+				numCounters = counter + 1
+			}
+		}
+	}
+
+	return numCounters
+}
+
+// Append adds the blocks and branches of `other` to this block-list. `other` must be the block-list of a collection
+// which was instrumented into the same cover-map as the collections of this block-list, see
+// `InstrumentOptions.SharedCoverMap`. The block IDs of `other` are placed after the blocks of this block-list.
+func (bl *BlockList) Append(other *BlockList) error {
+	if bl.Layout.Capacity == 0 {
+		return fmt.Errorf("block-list was made without a cover-map capacity, its cover-map can't be shared")
+	}
+
+	if bl.Layout != other.Layout {
+		return fmt.Errorf("block-lists have different cover-map layouts, %+v and %+v", bl.Layout, other.Layout)
+	}
+
+	if bl.BlockCounters == nil || other.BlockCounters == nil {
+		return fmt.Errorf("block-lists without block counters can't be appended")
+	}
+
+	// Every counter of `other`, of its blocks, branches and derived counts, is checked before anything is appended.
+	counters := append([]int(nil), other.BlockCounters...)
+	for _, branch := range other.Branches {
+		counters = append(counters, branch.TakenCounter, branch.NotTakenCounter)
+	}
+	for _, derived := range other.DerivedCounts {
+		for _, term := range derived.Terms {
+			counters = append(counters, term.Counter)
+		}
+	}
+
+	used := bl.numCounters()
+	for _, counter := range counters {
+		if counter >= 0 && counter < used {
+			return fmt.Errorf("counter %d of the appended block-list is already in use", counter)
+		}
+	}
+
+	// Identities are only useful if every block has one.
+	if len(bl.Identities) == len(bl.Blocks) && len(other.Identities) == len(other.Blocks) {
+		bl.Identities = append(bl.Identities, other.Identities...)
+	} else {
+		bl.Identities = nil
+	}
+
+	firstBlockID := len(bl.Blocks)
+	bl.Blocks = append(bl.Blocks, other.Blocks...)
+	bl.BlockCounters = append(bl.BlockCounters, other.BlockCounters...)
+	for _, branch := range other.Branches {
+		branch.BlockID += firstBlockID
+		bl.Branches = append(bl.Branches, branch)
+	}
+	for _, derived := range other.DerivedCounts {
+		derived.BlockID += firstBlockID
+		bl.DerivedCounts = append(bl.DerivedCounts, derived)
+	}
+	for _, fn := range other.Functions {
+		fn.BlockID += firstBlockID
+		bl.Functions = append(bl.Functions, fn)
+	}
+
+	if len(other.LookupFailures) > 0 && bl.LookupFailures == nil {
+		bl.LookupFailures = make(map[string]LookupFailure, len(other.LookupFailures))
+	}
+	for name, lookupFailure := range other.LookupFailures {
+		bl.LookupFailures[name] = lookupFailure
+	}
+
+	if len(other.Programs) > 0 && bl.Programs == nil {
+		bl.Programs = make(map[string]ProgramInstrumentation, len(other.Programs))
+	}
+	for name, program := range other.Programs {
+		bl.Programs[name] = program
+	}
+
+	return nil
+}
+
+// Merge adds the counts of the blocks and branches of `other` to the blocks and branches of this block-list. Blocks
+// are matched by their identity instead of their block ID, so block-lists of different loads of the same programs can
+// be merged. Both block-lists must contain the identities of their blocks, and every block of `other` must exist in
+// this block-list.
+func (bl *BlockList) Merge(other *BlockList) error {
+	if len(bl.Identities) != len(bl.Blocks) || len(other.Identities) != len(other.Blocks) {
+		return fmt.Errorf("block-lists without block identities can't be merged")
+	}
+
+	blockIDs := make(map[BlockIdentity]int, len(bl.Identities))
+	for blockID, identity := range bl.Identities {
+		blockIDs[identity] = blockID
+	}
+
+	// Translate the block IDs of `other` to block IDs of this block-list.
+	translated := make([]int, len(other.Blocks))
+	for otherID, identity := range other.Identities {
+		blockID, found := blockIDs[identity]
+		if !found {
+			return fmt.Errorf("block %s doesn't exist in block-list", identity)
+		}
+
+		if len(bl.Blocks[blockID]) != len(other.Blocks[otherID]) {
+			return fmt.Errorf("block %s has different lines in both block-lists", identity)
+		}
+
+		translated[otherID] = blockID
+	}
+
+	branches := make(map[int]int, len(bl.Branches))
+	for i, branch := range bl.Branches {
+		branches[branch.BlockID] = i
+	}
+
+	for _, branch := range other.Branches {
+		if branch.BlockID >= len(translated) {
+			return fmt.Errorf("branch of unknown block %d", branch.BlockID)
+		}
+
+		if _, found := branches[translated[branch.BlockID]]; !found {
+			return fmt.Errorf("branch of block %s doesn't exist in block-list", other.Identities[branch.BlockID])
+		}
+	}
+
+	for otherID, lines := range other.Blocks {
+		blockID := translated[otherID]
+		for i, line := range lines {
+			bl.Blocks[blockID][i].ProfileBlock.Count = addCounts(bl.Blocks[blockID][i].ProfileBlock.Count,
+				line.ProfileBlock.Count)
+		}
+	}
+
+	for _, otherBranch := range other.Branches {
+		branch := &bl.Branches[branches[translated[otherBranch.BlockID]]]
+		branch.Taken = addCounts(branch.Taken, otherBranch.Taken)
+		branch.NotTaken = addCounts(branch.NotTaken, otherBranch.NotTaken)
+	}
+
+	// Functions are counted by their entry block, so they exist in both block-lists if their entry block does.
+	functions := make(map[int]int, len(bl.Functions))
+	for i, fn := range bl.Functions {
+		functions[fn.BlockID] = i
+	}
+	for _, otherFn := range other.Functions {
+		if otherFn.BlockID < 0 || otherFn.BlockID >= len(translated) {
+			continue
+		}
+		if i, found := functions[translated[otherFn.BlockID]]; found {
+			bl.Functions[i].Calls = addCounts(bl.Functions[i].Calls, otherFn.Calls)
+		}
+	}
+
+	return nil
+}
+
+// addCounts adds two counts, clamping the result if it doesn't fit.
+func addCounts(a, b int) int {
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+
+	return a + b
+}
+
+func applyCoverMap(coverMap *ebpf.Map, layout CoverMapLayout, blockList [][]CoverBlock) error {
+	cpuCounters, err := readCounters(coverMap, layout, len(blockList))
+	if err != nil {
+		return err
+	}
+
+	counts, err := blockCounts(cpuCounters, layout.CounterWidth, nil, nil, len(blockList))
+	if err != nil {
+		return err
+	}
+	applyCounts(counts, blockList)
+
+	return nil
+}
+
+// blockCounts returns the count of every block from the counters of every CPU. If `blockCounters` is nil, the counter
+// of a block has the same index as the block ID. The counts of blocks without counter are derived from counters of
+// the given width.
+func blockCounts(
+	cpuCounters [][]uint64, width CounterWidth, blockCounters []int, derivedCounts []DerivedCount, numBlocks int,
+) ([]int, error) {
+	counters := sumCounters(cpuCounters)
+	counts := make([]int, numBlocks)
+	for blockID := range counts {
+		counter := blockID
+		if blockCounters != nil {
+			counter = blockCounters[blockID]
+		}
+		if counter >= 0 {
+			counts[blockID] = counterToCount(counters[counter])
+		}
+	}
+
+	for _, derived := range derivedCounts {
+		if derived.BlockID < 0 || derived.BlockID >= numBlocks {
+			return nil, fmt.Errorf("derived count of unknown block %d", derived.BlockID)
+		}
+
+		for _, term := range derived.Terms {
+			if term.Counter < 0 || term.Counter >= len(counters) {
+				return nil, fmt.Errorf("derived count of block %d uses unknown counter %d", derived.BlockID, term.Counter)
+			}
+		}
+
+		// The counters wrap around, so the sum is taken modulo the range of a counter. This gives the count of the
+		// block even if the counters of the terms wrapped around, just like a counter of its own would. Every CPU
+		// has counters of its own which wrap around separately, so the count is derived for each CPU and then summed.
+		var count uint64
+		for _, counters := range cpuCounters {
+			var cpuCount uint64
+			for _, term := range derived.Terms {
+				cpuCount += uint64(term.Factor) * counters[term.Counter]
+			}
+			count = addCounters(count, cpuCount&width.Max())
+		}
+		counts[derived.BlockID] = counterToCount(count)
+	}
+
+	return counts, nil
+}
+
+// applyCounts sets the count of every line of each block to the count of the block.
+func applyCounts(counts []int, blockList [][]CoverBlock) {
+	for blockID, lines := range blockList {
+		for i := range lines {
+			blockList[blockID][i].ProfileBlock.Count = counts[blockID]
+		}
+	}
+}
+
+// counterToCount converts a counter value to a count, clamping values which don't fit.
+func counterToCount(counter uint64) int {
+	if counter > math.MaxInt {
+		return math.MaxInt
+	}
+
+	return int(counter)
+}
+
+// readCounters reads the first `n` counters from the cover-map, for every CPU if the cover-map is per-CPU and once
+// otherwise. Counters are read from as many entries as needed according to the layout.
+func readCounters(coverMap *ebpf.Map, layout CoverMapLayout, n int) ([][]uint64, error) {
+	perEntry := layout.CountersPerEntry
+	if perEntry == 0 {
+		perEntry = n
+	}
+
+	width := layout.CounterWidth.Bytes()
+	if perEntry*width > int(coverMap.ValueSize()) {
+		return nil, fmt.Errorf(
+			"cover-map value of %d bytes is too small for %d counters of %d bits, block-list doesn't match cover-map",
+			coverMap.ValueSize(), perEntry, layout.CounterWidth,
+		)
+	}
+
+	numEntries := 1
+	if perEntry > 0 {
+		numEntries = (n + perEntry - 1) / perEntry
+	}
+	if numEntries > int(coverMap.MaxEntries()) {
+		return nil, fmt.Errorf(
+			"cover-map has %d entries but %d are needed for %d counters, block-list doesn't match cover-map",
+			coverMap.MaxEntries(), numEntries, n,
+		)
+	}
+
+	var cpuCounters [][]uint64
+	for entry := 0; entry < numEntries; entry++ {
+		key := uint32(entry)
+		var values [][]byte
+
+		// The map type tells us if the map is per-CPU, even if the block-list doesn't record the strategy.
+		if coverMap.Type() == ebpf.PerCPUArray {
+			if err := coverMap.Lookup(&key, &values); err != nil {
+				return nil, fmt.Errorf("error looking up coverage output: %w", err)
+			}
+		} else {
+			value := make([]byte, coverMap.ValueSize())
+			if err := coverMap.Lookup(&key, &value); err != nil {
+				return nil, fmt.Errorf("error looking up coverage output: %w", err)
+			}
+			values = append(values, value)
+		}
+
+		first := entry * perEntry
+		last := first + perEntry
+		if last > n {
+			last = n
+		}
+
+		for cpu, value := range values {
+			if cpu == len(cpuCounters) {
+				cpuCounters = append(cpuCounters, make([]uint64, n))
+			}
+			for i := first; i < last; i++ {
+				off := (i - first) * width
+				cpuCounters[cpu][i] = layout.CounterWidth.decode(value[off : off+width])
+			}
+		}
+	}
+
+	return cpuCounters, nil
+}
+
+// sumCounters returns the sum of the counters of every CPU.
+func sumCounters(cpuCounters [][]uint64) []uint64 {
+	if len(cpuCounters) == 0 {
+		return nil
+	}
+
+	counters := make([]uint64, len(cpuCounters[0]))
+	for _, cpu := range cpuCounters {
+		for i, counter := range cpu {
+			counters[i] = addCounters(counters[i], counter)
+		}
+	}
+
+	return counters
+}
+
+// addCounters adds two counter values, saturating instead of overflowing.
+func addCounters(a, b uint64) uint64 {
+	if a+b < a {
+		return math.MaxUint64
+	}
+
+	return a + b
+}
+
+// zeroCounters sets all counters of the cover-map to 0, in every entry and for every CPU.
+func zeroCounters(coverMap *ebpf.Map) error {
+	var value interface{} = make([]byte, coverMap.ValueSize())
+	if coverMap.Type() == ebpf.PerCPUArray {
+		cpus, err := ebpf.PossibleCPU()
+		if err != nil {
+			return fmt.Errorf("possible CPUs: %w", err)
+		}
+
+		values := make([][]byte, cpus)
+		for i := range values {
+			values[i] = make([]byte, coverMap.ValueSize())
+		}
+		value = values
+	}
+
+	for entry := uint32(0); entry < coverMap.MaxEntries(); entry++ {
+		if err := coverMap.Put(&entry, value); err != nil {
+			return fmt.Errorf("error zeroing cover-map entry %d: %w", entry, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,448 @@
+package coverbee
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/tools/cover"
+)
+
+func TestReadBlockList(t *testing.T) {
+	blocks := [][]CoverBlock{
+		{
+			{
+				Filename: "/tmp/prog.c",
+				ProfileBlock: cover.ProfileBlock{
+					StartLine: 10,
+					StartCol:  2,
+					EndLine:   10,
+					EndCol:    2000,
+					NumStmt:   1,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name string
+		json string
+		want *BlockList
+	}{
+		{
+			name: "Legacy format",
+			json: `[[{"Filename":"/tmp/prog.c","ProfileBlock":{"StartLine":10,"StartCol":2,"EndLine":10,` +
+				`"EndCol":2000,"NumStmt":1,"Count":0}}]]`,
+			want: &BlockList{
+				Layout: CoverMapLayout{
+					CounterWidth: Counter16Bit,
+					Strategy:     CounterStrategyShared,
+					Storage:      CounterStorageLookup,
+				},
+				Blocks: blocks,
+			},
+		},
+		{
+			name: "With layout",
+			json: `{"Layout":{"CounterWidth":64,"Saturating":true,"Strategy":"percpu"},"Blocks":[[{` +
+				`"Filename":"/tmp/prog.c","ProfileBlock":{"StartLine":10,"StartCol":2,"EndLine":10,"EndCol":2000,` +
+				`"NumStmt":1,"Count":0}}]]}`,
+			want: &BlockList{
+				Layout: CoverMapLayout{
+					CounterWidth: Counter64Bit,
+					Saturating:   true,
+					Strategy:     CounterStrategyPerCPU,
+					Storage:      CounterStorageLookup,
+				},
+				Blocks: blocks,
+			},
+		},
+		{
+			name: "Global storage",
+			json: `{"Layout":{"CounterWidth":32,"Strategy":"atomic","Storage":"global"},"Blocks":[[{` +
+				`"Filename":"/tmp/prog.c","ProfileBlock":{"StartLine":10,"StartCol":2,"EndLine":10,"EndCol":2000,` +
+				`"NumStmt":1,"Count":0}}]]}`,
+			want: &BlockList{
+				Layout: CoverMapLayout{
+					CounterWidth: Counter32Bit,
+					Strategy:     CounterStrategyAtomic,
+					Storage:      CounterStorageGlobal,
+				},
+				Blocks: blocks,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadBlockList(strings.NewReader(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadBlockList() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterWidthDecode(t *testing.T) {
+	value := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for _, cw := range []CounterWidth{Counter8Bit, Counter16Bit, Counter32Bit, Counter64Bit} {
+		if got := cw.decode(value); got != cw.Max() {
+			t.Errorf("%d bit decode = %d, want %d", cw, got, cw.Max())
+		}
+	}
+}
+
+func TestBlockListMerge(t *testing.T) {
+	block := func(line, count int) []CoverBlock {
+		return []CoverBlock{{
+			Filename:     "/tmp/prog.c",
+			ProfileBlock: cover.ProfileBlock{StartLine: line, EndLine: line, Count: count},
+		}}
+	}
+
+	bl := &BlockList{
+		Blocks: [][]CoverBlock{block(10, 1), block(20, 2)},
+		Identities: []BlockIdentity{
+			{Program: "a", Offset: 0, Filename: "/tmp/prog.c", Line: 10},
+			{Program: "b", Offset: 0, Filename: "/tmp/prog.c", Line: 20},
+		},
+		Branches: []BranchCoverage{{BlockID: 1, Taken: 1, NotTaken: 2}},
+	}
+
+	// The same blocks, numbered in a different order.
+	other := &BlockList{
+		Blocks: [][]CoverBlock{block(20, 5), block(10, 3)},
+		Identities: []BlockIdentity{
+			{Program: "b", Offset: 0, Filename: "/tmp/prog.c", Line: 20},
+			{Program: "a", Offset: 0, Filename: "/tmp/prog.c", Line: 10},
+		},
+		Branches: []BranchCoverage{{BlockID: 0, Taken: 3, NotTaken: 4}},
+	}
+
+	if err := bl.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bl.Blocks[0][0].ProfileBlock.Count; got != 4 {
+		t.Errorf("block 0 count = %d, want 4", got)
+	}
+	if got := bl.Blocks[1][0].ProfileBlock.Count; got != 7 {
+		t.Errorf("block 1 count = %d, want 7", got)
+	}
+	if bl.Branches[0].Taken != 4 || bl.Branches[0].NotTaken != 6 {
+		t.Errorf("branch = %d/%d, want 4/6", bl.Branches[0].Taken, bl.Branches[0].NotTaken)
+	}
+
+	other.Identities[0].Offset = 8
+	if err := bl.Merge(other); err == nil {
+		t.Error("merging block-list with unknown block should fail")
+	}
+}
+
+func TestBlockListAppend(t *testing.T) {
+	newBlockList := func() *BlockList {
+		return &BlockList{
+			Layout:        CoverMapLayout{Capacity: 10},
+			Blocks:        [][]CoverBlock{nil, nil},
+			BlockCounters: []int{0, -1},
+			Branches:      []BranchCoverage{{BlockID: 0, TakenCounter: 1, NotTakenCounter: 2}},
+			DerivedCounts: []DerivedCount{{BlockID: 1, Terms: []CounterTerm{{Counter: 0, Factor: 1}}}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(other *BlockList)
+	}{
+		{
+			name:   "Block counter in use",
+			modify: func(other *BlockList) { other.BlockCounters[0] = 2 },
+		},
+		{
+			name:   "Branch counter in use",
+			modify: func(other *BlockList) { other.Branches[0].NotTakenCounter = 1 },
+		},
+		{
+			name:   "Derived count term in use",
+			modify: func(other *BlockList) { other.DerivedCounts[0].Terms[0].Counter = 0 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bl := newBlockList()
+			other := &BlockList{
+				Layout:        bl.Layout,
+				Blocks:        [][]CoverBlock{nil, nil},
+				BlockCounters: []int{3, -1},
+				Branches:      []BranchCoverage{{BlockID: 0, TakenCounter: 4, NotTakenCounter: 5}},
+				DerivedCounts: []DerivedCount{{BlockID: 1, Terms: []CounterTerm{{Counter: 3, Factor: 1}}}},
+			}
+			tt.modify(other)
+
+			if err := bl.Append(other); err == nil {
+				t.Fatal("appending counters which are in use should fail")
+			}
+			if !reflect.DeepEqual(bl, newBlockList()) {
+				t.Errorf("block-list was modified by the failed append: %+v", bl)
+			}
+		})
+	}
+}
+
+func TestBlockCounts(t *testing.T) {
+	counters := [][]uint64{{5, 3}}
+	blockCounters := []int{0, -1, 1}
+	derived := []DerivedCount{
+		{BlockID: 1, Terms: []CounterTerm{{Counter: 0, Factor: 1}, {Counter: 1, Factor: -1}}},
+	}
+
+	counts, err := blockCounts(counters, Counter16Bit, blockCounters, derived, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, []int{5, 2, 3}) {
+		t.Errorf("counts = %v, want [5 2 3]", counts)
+	}
+
+	// Counter 0 wrapped around after 65537 executions, block 1 ran 65537-3 times.
+	counters[0][0] = 1
+	counts, err = blockCounts(counters, Counter16Bit, blockCounters, derived, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[1] != 65534 {
+		t.Errorf("block 1 count = %d, want 65534", counts[1])
+	}
+
+	// Per-CPU counters wrap around separately, together the CPUs ran block 0 70000 times and block 1 69900 times.
+	counters = [][]uint64{{60000, 100}, {10000, 0}}
+	counts, err = blockCounts(counters, Counter16Bit, blockCounters, derived, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, []int{70000, 69900, 100}) {
+		t.Errorf("per-CPU counts = %v, want [70000 69900 100]", counts)
+	}
+
+	derived[0].Terms[0].Counter = 2
+	if _, err = blockCounts(counters, Counter16Bit, blockCounters, derived, 3); err == nil {
+		t.Error("expected an error for an unknown counter")
+	}
+}
+
+// newTestCoverMap returns a cover-map with the given number of entries, the test is skipped if the map can't be
+// created.
+func newTestCoverMap(t *testing.T, mapType ebpf.MapType, valueSize, entries int) *ebpf.Map {
+	t.Helper()
+
+	coverMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       mapType,
+		KeySize:    4,
+		ValueSize:  uint32(valueSize),
+		MaxEntries: uint32(entries),
+	})
+	if err != nil {
+		t.Skipf("can't create cover-map: %v", err)
+	}
+	t.Cleanup(func() { coverMap.Close() })
+
+	return coverMap
+}
+
+// encode16 encodes 16-bit counters as a cover-map value.
+func encode16(counters ...uint16) []byte {
+	value := make([]byte, len(counters)*2)
+	for i, counter := range counters {
+		nativeEndianess().PutUint16(value[i*2:], counter)
+	}
+	return value
+}
+
+func TestApplyCoverMapBranches(t *testing.T) {
+	// Block 0 ends with a conditional jump, its taken and not-taken outcomes have counters 2 and 3.
+	coverMap := newTestCoverMap(t, ebpf.Array, 8, 1)
+	if err := coverMap.Put(uint32(0), encode16(7, 4, 4, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	bl := &BlockList{
+		Layout:        CoverMapLayout{}.withDefaults(),
+		Blocks:        [][]CoverBlock{{{Filename: "/tmp/prog.c"}}, {{Filename: "/tmp/prog.c"}}},
+		BlockCounters: []int{0, 1},
+		Branches: []BranchCoverage{
+			{BlockID: 0, Filename: "/tmp/prog.c", Line: 3, TakenCounter: 2, NotTakenCounter: 3},
+		},
+	}
+	if err := bl.ApplyCoverMap(coverMap); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bl.Branches[0]; got.Taken != 4 || got.NotTaken != 3 {
+		t.Errorf("branch taken %d and not taken %d times, want 4 and 3", got.Taken, got.NotTaken)
+	}
+	if got := bl.Blocks[1][0].ProfileBlock.Count; got != 4 {
+		t.Errorf("block 1 count = %d, want 4", got)
+	}
+}
+
+// TestApplyCoverMapPerCPU checks that counts are derived from a per-CPU cover-map of which the summed counters are
+// above the max value of a counter.
+func TestApplyCoverMapPerCPU(t *testing.T) {
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpus < 2 {
+		t.Skip("per-CPU counters can only add up to more than the max value of a counter with multiple CPUs")
+	}
+
+	coverMap := newTestCoverMap(t, ebpf.PerCPUArray, 4, 1)
+	values := [][]byte{encode16(60000, 100)}
+	for cpu := 1; cpu < cpus; cpu++ {
+		values = append(values, encode16(10000, 0))
+	}
+	if err = coverMap.Put(uint32(0), values); err != nil {
+		t.Fatal(err)
+	}
+
+	bl := &BlockList{
+		Layout:        CoverMapLayout{Strategy: CounterStrategyPerCPU}.withDefaults(),
+		Blocks:        [][]CoverBlock{{{}}, {{}}, {{}}},
+		BlockCounters: []int{0, -1, 1},
+		DerivedCounts: []DerivedCount{
+			{BlockID: 1, Terms: []CounterTerm{{Counter: 0, Factor: 1}, {Counter: 1, Factor: -1}}},
+		},
+	}
+	if err = bl.ApplyCoverMap(coverMap); err != nil {
+		t.Fatal(err)
+	}
+
+	others := 10000 * (cpus - 1)
+	for blockID, want := range []int{60000 + others, 59900 + others, 100} {
+		if got := bl.Blocks[blockID][0].ProfileBlock.Count; got != want {
+			t.Errorf("block %d count = %d, want %d", blockID, got, want)
+		}
+	}
+}
+
+func TestReadCounters(t *testing.T) {
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// perCPU returns the value for every CPU, with the counters of all but the first CPU doubled.
+	perCPU := func(counters ...uint16) [][]byte {
+		values := make([][]byte, cpus)
+		values[0] = encode16(counters...)
+		doubled := make([]uint16, len(counters))
+		for i, counter := range counters {
+			doubled[i] = 2 * counter
+		}
+		for cpu := 1; cpu < cpus; cpu++ {
+			values[cpu] = encode16(doubled...)
+		}
+		return values
+	}
+	// cpuCounters returns the counters of every CPU, as encoded by `perCPU`.
+	cpuCounters := func(counters ...uint64) [][]uint64 {
+		all := [][]uint64{counters}
+		for cpu := 1; cpu < cpus; cpu++ {
+			doubled := make([]uint64, len(counters))
+			for i, counter := range counters {
+				doubled[i] = 2 * counter
+			}
+			all = append(all, doubled)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name      string
+		mapType   ebpf.MapType
+		valueSize int
+		values    []interface{}
+		layout    CoverMapLayout
+		n         int
+		want      [][]uint64
+		wantErr   bool
+	}{
+		{
+			name:      "Single entry",
+			mapType:   ebpf.Array,
+			valueSize: 6,
+			values:    []interface{}{encode16(1, 2, 3)},
+			layout:    CoverMapLayout{CounterWidth: Counter16Bit},
+			n:         3,
+			want:      [][]uint64{{1, 2, 3}},
+		},
+		{
+			// The last entry is only partially used.
+			name:      "Multiple entries",
+			mapType:   ebpf.Array,
+			valueSize: 4,
+			values:    []interface{}{encode16(1, 2), encode16(3, 4), encode16(5, 0)},
+			layout:    CoverMapLayout{CounterWidth: Counter16Bit, CountersPerEntry: 2},
+			n:         5,
+			want:      [][]uint64{{1, 2, 3, 4, 5}},
+		},
+		{
+			name:      "Per-CPU multiple entries",
+			mapType:   ebpf.PerCPUArray,
+			valueSize: 4,
+			values:    []interface{}{perCPU(1, 2), perCPU(3, 0)},
+			layout:    CoverMapLayout{CounterWidth: Counter16Bit, CountersPerEntry: 2},
+			n:         3,
+			want:      cpuCounters(1, 2, 3),
+		},
+		{
+			name:      "No counters",
+			mapType:   ebpf.Array,
+			valueSize: 4,
+			values:    []interface{}{encode16(1, 2)},
+			layout:    CoverMapLayout{CounterWidth: Counter16Bit},
+			n:         0,
+			want:      [][]uint64{{}},
+		},
+		{
+			name:      "Value too small",
+			mapType:   ebpf.Array,
+			valueSize: 4,
+			values:    []interface{}{encode16(1, 2)},
+			layout:    CoverMapLayout{CounterWidth: Counter16Bit},
+			n:         3,
+			wantErr:   true,
+		},
+		{
+			name:      "Too few entries",
+			mapType:   ebpf.Array,
+			valueSize: 4,
+			values:    []interface{}{encode16(1, 2)},
+			layout:    CoverMapLayout{CounterWidth: Counter16Bit, CountersPerEntry: 2},
+			n:         3,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coverMap := newTestCoverMap(t, tt.mapType, tt.valueSize, len(tt.values))
+			for entry, value := range tt.values {
+				if err := coverMap.Put(uint32(entry), value); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := readCounters(coverMap, tt.layout, tt.n)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCounters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readCounters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
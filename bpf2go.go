@@ -0,0 +1,132 @@
+package coverbee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cilium/ebpf"
+)
+
+// InstrumentAndLoadAndAssign is the instrumenting equivalent of `ebpf.CollectionSpec.LoadAndAssign`, for the structs
+// of programs and maps generated by bpf2go. The collection is instrumented and loaded as by
+// `InstrumentAndLoadCollectionWithOptions`, after which the programs and maps named by the struct are assigned to it.
+// Unlike `LoadAndAssign`, all programs of the collection are loaded, objects which are not part of the struct are
+// closed again. A copy of the spec is instrumented, the spec itself is left as it is.
+//
+// The cover-map is returned separately and has to be closed by the caller, the struct can't contain it.
+func InstrumentAndLoadAndAssign(
+	spec *ebpf.CollectionSpec,
+	to interface{},
+	opts *ebpf.CollectionOptions,
+	instOpts InstrumentOptions,
+) (*ebpf.Map, *Instrumentation, error) {
+	if opts == nil {
+		opts = &ebpf.CollectionOptions{}
+	}
+
+	coll, instrumentation, err := InstrumentAndLoadCollectionWithOptions(spec.Copy(), *opts, instOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer coll.Close()
+
+	coverMap := coll.Maps[instrumentation.CoverMapName]
+	delete(coll.Maps, instrumentation.CoverMapName)
+
+	if err = coll.Assign(to); err != nil {
+		coverMap.Close()
+		return nil, nil, err
+	}
+
+	return coverMap, instrumentation, nil
+}
+
+const (
+	// EnvBlockListDir is the environment variable which enables instrumentation in `LoadAndAssign`. It is the
+	// directory where the block-lists of the instrumented collections are written.
+	EnvBlockListDir = "COVERBEE_BLOCK_LIST_DIR"
+	// EnvPinDir is the environment variable which sets the directory in a BPF file system where `LoadAndAssign` pins
+	// the cover-maps. Defaults to `DefaultPinDir`.
+	EnvPinDir = "COVERBEE_PIN_DIR"
+
+	// DefaultPinDir is the directory where `LoadAndAssign` pins the cover-maps if `EnvPinDir` isn't set.
+	DefaultPinDir = "/sys/fs/bpf"
+)
+
+// LoadAndAssign is a drop-in replacement for `ebpf.CollectionSpec.LoadAndAssign` in loaders generated by bpf2go,
+// which instruments the collection if instrumentation is enabled. Instrumentation is enabled by setting the
+// `EnvBlockListDir` environment variable, or by building with the `coverbee` build tag in which case the block-lists
+// are written to a `coverbee` directory in the temporary directory unless the variable is set. Otherwise the
+// collection is loaded as it is.
+//
+// When instrumenting, the collection is named after the first of its programs in order of name. The cover-map is
+// pinned at `<pin dir>/<name>_covermap` and the block-list is written to `<block-list dir>/<name>.json`, replacing
+// those of a previous load. After the programs ran, the coverage can be collected with `coverbee cover
+// --covermap-pin <pin dir>/<name>_covermap --block-list <block-list dir>/<name>.json`. Programs which the verifier
+// rejects when instrumented are retried with fallback strategies, see `InstrumentOptions.Fallback`.
+func LoadAndAssign(spec *ebpf.CollectionSpec, to interface{}, opts *ebpf.CollectionOptions) error {
+	blockListDir := os.Getenv(EnvBlockListDir)
+	if blockListDir == "" && instrumentByDefault {
+		blockListDir = filepath.Join(os.TempDir(), "coverbee")
+	}
+	if blockListDir == "" {
+		return spec.LoadAndAssign(to, opts)
+	}
+
+	pinDir := os.Getenv(EnvPinDir)
+	if pinDir == "" {
+		pinDir = DefaultPinDir
+	}
+
+	name, err := collectionName(spec)
+	if err != nil {
+		return err
+	}
+
+	coverMap, instrumentation, err := InstrumentAndLoadAndAssign(spec, to, opts, InstrumentOptions{Fallback: true})
+	if err != nil {
+		return err
+	}
+	defer coverMap.Close()
+
+	pinPath := filepath.Join(pinDir, name+"_covermap")
+	if err = os.Remove(pinPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove previous cover-map pin: %w", err)
+	}
+	if err = coverMap.Pin(pinPath); err != nil {
+		return fmt.Errorf("pin cover-map: %w", err)
+	}
+
+	if err = os.MkdirAll(blockListDir, 0o750); err != nil {
+		return fmt.Errorf("create block-list dir: %w", err)
+	}
+	blockListFile, err := os.Create(filepath.Join(blockListDir, name+".json"))
+	if err != nil {
+		return fmt.Errorf("create block-list: %w", err)
+	}
+	defer blockListFile.Close()
+
+	if err = json.NewEncoder(blockListFile).Encode(instrumentation.BlockList()); err != nil {
+		return fmt.Errorf("encode block-list: %w", err)
+	}
+
+	return nil
+}
+
+// collectionName returns the name of the first program of the collection in order of name.
+func collectionName(spec *ebpf.CollectionSpec) (string, error) {
+	names := make([]string, 0, len(spec.Programs))
+	for name := range spec.Programs {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "", errors.New("the collection contains no programs")
+	}
+	sort.Strings(names)
+
+	return names[0], nil
+}
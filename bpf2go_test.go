@@ -0,0 +1,113 @@
+package coverbee
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestCollectionName(t *testing.T) {
+	tests := []struct {
+		name     string
+		programs []string
+		want     string
+		wantErr  bool
+	}{
+		{name: "single", programs: []string{"xdp_prog"}, want: "xdp_prog"},
+		{name: "first by name", programs: []string{"tc_ingress", "tc_egress", "xdp_prog"}, want: "tc_egress"},
+		{name: "no programs", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &ebpf.CollectionSpec{Programs: make(map[string]*ebpf.ProgramSpec)}
+			for _, name := range tt.programs {
+				spec.Programs[name] = &ebpf.ProgramSpec{Name: name}
+			}
+
+			got, err := collectionName(spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("collectionName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("collectionName() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadAndAssign checks that `LoadAndAssign` only instruments if `EnvBlockListDir` is set or the `coverbee` build
+// tag is used, and that the spec can be loaded again afterwards.
+func TestLoadAndAssign(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	numInstructions := len(spec.Programs["firewall_prog"].Instructions)
+
+	pinDir, err := os.MkdirTemp(DefaultPinDir, "coverbee-test")
+	if err != nil {
+		t.Skipf("can't create a pin directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(pinDir) })
+	t.Setenv(EnvPinDir, pinDir)
+
+	type objects struct {
+		FirewallProg *ebpf.Program `ebpf:"firewall_prog"`
+		TCPStats     *ebpf.Map     `ebpf:"tcp_stats"`
+	}
+
+	tests := []struct {
+		name         string
+		blockListDir bool
+		instrumented bool
+	}{
+		{name: "Block-list dir set", blockListDir: true, instrumented: true},
+		{name: "Block-list dir not set", instrumented: instrumentByDefault},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without the environment variable, the block-list is written in the temporary directory.
+			tempDir := t.TempDir()
+			t.Setenv("TMPDIR", tempDir)
+			blockListDir := filepath.Join(tempDir, "coverbee")
+			if tt.blockListDir {
+				blockListDir = t.TempDir()
+				t.Setenv(EnvBlockListDir, blockListDir)
+			} else {
+				t.Setenv(EnvBlockListDir, "")
+			}
+
+			// Loading twice replaces the pin and block-list of the first load.
+			for i := 0; i < 2; i++ {
+				var objs objects
+				err := LoadAndAssign(spec, &objs, nil)
+				if errors.Is(err, os.ErrPermission) {
+					t.Skipf("can't load the collection: %v", err)
+				}
+				if err != nil {
+					t.Fatalf("load %d: %v", i, err)
+				}
+				objs.FirewallProg.Close()
+				objs.TCPStats.Close()
+			}
+
+			_, blockListErr := os.Stat(filepath.Join(blockListDir, "firewall_prog.json"))
+			_, pinErr := os.Stat(filepath.Join(pinDir, "firewall_prog_covermap"))
+			if tt.instrumented && (blockListErr != nil || pinErr != nil) {
+				t.Errorf("instrumented collection has no block-list (%v) or cover-map pin (%v)", blockListErr, pinErr)
+			}
+			if !tt.instrumented && (blockListErr == nil || pinErr == nil) {
+				t.Error("collection was instrumented")
+			}
+			os.Remove(filepath.Join(pinDir, "firewall_prog_covermap"))
+
+			if _, found := spec.Maps[DefaultCoverMapName]; found ||
+				len(spec.Programs["firewall_prog"].Instructions) != numInstructions {
+				t.Error("the spec of the caller was instrumented")
+			}
+		})
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/cilium/coverbee"
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
 	"github.com/spf13/cobra"
 )
 
@@ -24,6 +26,8 @@ var root = &cobra.Command{
 func main() {
 	root.AddCommand(
 		loadCmd(),
+		instrumentCmd(),
+		verifierLogsCmd(),
 		coverageCmd(),
 	)
 
@@ -36,6 +40,7 @@ func main() {
 var (
 	flagMapPinDir       string
 	flagCoverMapPinPath string
+	flagCoverMapName    string
 	flagBlockListPath   string
 )
 
@@ -45,6 +50,33 @@ var (
 	flagProgType   string
 	flagLogPath    string
 
+	flagKernelBTF       string
+	flagMapReplacements []string
+
+	flagCounterWidth    int
+	flagSaturating      bool
+	flagCounterStrategy string
+	flagCounterStorage  string
+	flagBranchCoverage  bool
+	flagAnalysis        string
+	flagCapacity        int
+	flagAppend          bool
+	flagLookupFailure   string
+	flagGranularity     string
+	flagMinimalProbes   bool
+	flagFallback        bool
+
+	flagIncludeProgs []string
+	flagExcludeProgs []string
+	flagIncludeFuncs []string
+	flagExcludeFuncs []string
+	flagIncludeFiles []string
+	flagExcludeFiles []string
+
+	flagVerifierLogsDir string
+	flagAsmPath         string
+	flagOutPath         string
+
 	flagDisableInterpolation bool
 	flagForceInterpolation   bool
 )
@@ -91,6 +123,12 @@ func loadCmd() *cobra.Command {
 
 	fs.StringVar(&flagLogPath, "log", "", "Path for ultra-verbose log output")
 
+	fs.BoolVar(&flagFallback, "fallback", false, "If the verifier rejects an instrumented program, retry with "+
+		"cheaper strategies: exclude the rejected function, count fewer blocks or leave the program uninstrumented")
+
+	addCollectionFlags(load)
+	addInstrumentFlags(load)
+
 	return load
 }
 
@@ -106,14 +144,344 @@ func checkCovermapFlags(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// coverMapPinPath returns the path of the covermap pin, in --map-pin-dir or at --covermap-pin.
+func coverMapPinPath() string {
+	if flagMapPinDir != "" {
+		return filepath.Join(flagMapPinDir, flagCoverMapName)
+	}
+
+	return flagCoverMapPinPath
+}
+
+// loadCoverMapPin loads the covermap pinned in --map-pin-dir or at --covermap-pin.
+func loadCoverMapPin() (*ebpf.Map, error) {
+	coverMap, err := ebpf.LoadPinnedMap(coverMapPinPath(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("load covermap pin: %w", err)
+	}
+
+	return coverMap, nil
+}
+
 func load(cmd *cobra.Command, args []string) error {
 	if err := checkCovermapFlags(cmd, args); err != nil {
 		return err
 	}
 
+	spec, err := loadSpec()
+	if err != nil {
+		return err
+	}
+
+	// Check before loading anything, pinning the covermap would fail after the programs are loaded and pinned.
+	if _, err = os.Stat(coverMapPinPath()); err == nil && !flagAppend {
+		return fmt.Errorf("a covermap is already pinned at '%s', use --append to share it or --covermap-name to "+
+			"pick another name", coverMapPinPath())
+	}
+
+	opts, closeMaps, err := collectionOptions()
+	if err != nil {
+		return err
+	}
+	defer closeMaps()
+
+	logWriter, closeLog, err := openLog()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	instOpts, err := instrumentOptions(logWriter)
+	if err != nil {
+		return err
+	}
+	instOpts.Fallback = flagFallback
+
+	var sharedBlockList *coverbee.BlockList
+	if flagAppend {
+		sharedBlockList, err = readBlockList()
+		if err != nil {
+			return err
+		}
+		instOpts.SharedCoverMap = sharedBlockList
+
+		var coverMap *ebpf.Map
+		coverMap, err = loadCoverMapPin()
+		if err != nil {
+			return err
+		}
+		defer coverMap.Close()
+
+		opts.MapReplacements[flagCoverMapName] = coverMap
+	}
+
+	coll, instrumentation, err := coverbee.InstrumentAndLoadCollectionWithOptions(spec, opts, instOpts)
+	if err != nil {
+		return fmt.Errorf("error while instrumenting and loading program: %w", err)
+	}
+	defer coll.Close()
+
+	for name, prog := range coll.Programs {
+		if err = prog.Pin(filepath.Join(flagProgPinDir, name)); err != nil {
+			return fmt.Errorf("error pinning program '%s': %w", name, err)
+		}
+	}
+
+	// When appending, the covermap is the existing pinned one.
+	if !flagAppend {
+		if err = coll.Maps[instrumentation.CoverMapName].Pin(coverMapPinPath()); err != nil {
+			return fmt.Errorf("error pinning covermap: %w", err)
+		}
+	}
+
+	if err = writeInstrumentedBlockList(sharedBlockList, instrumentation); err != nil {
+		return err
+	}
+
+	fmt.Println("Programs instrumented and loaded")
+	if flagFallback {
+		printProgramInstrumentation(os.Stdout, instrumentation.Programs)
+	}
+
+	return nil
+}
+
+// printProgramInstrumentation prints how each program was instrumented, in order of program name.
+func printProgramInstrumentation(w io.Writer, programs map[string]coverbee.ProgramInstrumentation) {
+	names := make([]string, 0, len(programs))
+	for name := range programs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %s\n", name, programs[name])
+	}
+}
+
+func instrumentCmd() *cobra.Command {
+	instrument := &cobra.Command{
+		Use: "instrument {--elf=ELF path} [--verifier-logs=path to dir] {--block-list=path to blocklist} " +
+			"[--out=instrumented ELF path]",
+		Short: "Instrument all programs in the given ELF file using recorded verifier logs or a static analysis, " +
+			"without loading them into the kernel",
+		RunE: instrument,
+	}
+
+	fs := instrument.Flags()
+
+	fs.StringVar(&flagElfPath, "elf", "", "Path to the ELF file containing the programs")
+	panicOnError(instrument.MarkFlagFilename("elf", "o", "elf"))
+	panicOnError(instrument.MarkFlagRequired("elf"))
+
+	fs.StringVar(&flagProgType, "prog-type", "", "Explicitly set the program type")
+
+	fs.StringVar(&flagVerifierLogsDir, "verifier-logs", "", "Path to the directory containing the verifier logs of "+
+		"the programs, as recorded by the verifier-logs command (needed with --analysis=verifier or cross-check)")
+	panicOnError(instrument.MarkFlagDirname("verifier-logs"))
+
+	fs.StringVar(&flagBlockListPath, "block-list", "", "Path where the block-list is stored (contains coverage data "+
+		"to source code mapping, needed when reading from cover map)")
+	panicOnError(instrument.MarkFlagFilename("block-list", "json"))
+	panicOnError(instrument.MarkFlagRequired("block-list"))
+
+	fs.StringVar(&flagAsmPath, "asm", "", "Path where the instrumented assembly of all programs is written")
+
+	fs.StringVar(&flagOutPath, "out", "", "Path where an ELF file with the instrumented programs is written, which "+
+		"can be loaded by any loader. The covermap is pinned by name")
+	panicOnError(instrument.MarkFlagFilename("out", "o", "elf"))
+
+	fs.StringVar(&flagLogPath, "log", "", "Path for ultra-verbose log output")
+
+	addInstrumentFlags(instrument)
+
+	// Nothing is loaded, so without verifier logs the registers and stack slots can only be found statically.
+	analysis := fs.Lookup("analysis")
+	analysis.DefValue = string(coverbee.AnalysisStatic)
+	analysis.Usage += ". Verifier if --verifier-logs is set"
+
+	return instrument
+}
+
+func instrument(cmd *cobra.Command, args []string) error {
+	spec, err := loadSpec()
+	if err != nil {
+		return err
+	}
+
+	// The --analysis flag is shared with the load command, so its default for this command is applied here.
+	if !cmd.Flags().Changed("analysis") {
+		flagAnalysis = string(coverbee.AnalysisStatic)
+		if flagVerifierLogsDir != "" {
+			flagAnalysis = string(coverbee.AnalysisVerifier)
+		}
+	}
+
+	if flagVerifierLogsDir == "" && coverbee.AnalysisMode(flagAnalysis) != coverbee.AnalysisStatic {
+		return fmt.Errorf("--verifier-logs must be set, unless --analysis=static")
+	}
+
+	// Loaders only support direct value access to global data sections, which they don't pin. So the covermap
+	// couldn't be read by the cover command.
+	if flagOutPath != "" && coverbee.CounterStorage(flagCounterStorage) == coverbee.CounterStorageGlobal {
+		return fmt.Errorf("--out can't be used with --counter-storage=global")
+	}
+
+	// An empty set of verifier logs still tells the instrumentation not to touch the kernel.
+	verifierLogs := make(map[string]string, len(spec.Programs))
+	if flagVerifierLogsDir != "" {
+		for name := range spec.Programs {
+			var verifierLog []byte
+			verifierLog, err = os.ReadFile(filepath.Join(flagVerifierLogsDir, name+".log"))
+			if err != nil {
+				return fmt.Errorf("read verifier log: %w", err)
+			}
+			verifierLogs[name] = string(verifierLog)
+		}
+	}
+
+	logWriter, closeLog, err := openLog()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	instOpts, err := instrumentOptions(logWriter)
+	if err != nil {
+		return err
+	}
+	instOpts.VerifierLogs = verifierLogs
+
+	var sharedBlockList *coverbee.BlockList
+	if flagAppend {
+		sharedBlockList, err = readBlockList()
+		if err != nil {
+			return err
+		}
+		instOpts.SharedCoverMap = sharedBlockList
+	}
+
+	instrumenter, err := coverbee.NewInstrumenter(instOpts)
+	if err != nil {
+		return err
+	}
+
+	instrumented, instrumentation, err := instrumenter.Instrument(cmd.Context(), spec)
+	if err != nil {
+		return fmt.Errorf("error while instrumenting program: %w", err)
+	}
+
+	if flagAsmPath != "" {
+		var asmFile *os.File
+		asmFile, err = os.Create(flagAsmPath)
+		if err != nil {
+			return fmt.Errorf("error create assembly file: %w", err)
+		}
+		defer asmFile.Close()
+
+		names := make([]string, 0, len(instrumented.Programs))
+		for name := range instrumented.Programs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintln(asmFile, "---", name, "---")
+			fmt.Fprint(asmFile, instrumented.Programs[name].Instructions)
+		}
+	}
+
+	if flagOutPath != "" {
+		// Pin the covermap so it can be read by the cover command, regardless of the loader used.
+		instrumented.Maps[instrumentation.CoverMapName].Pinning = ebpf.PinByName
+
+		var outFile *os.File
+		outFile, err = os.Create(flagOutPath)
+		if err != nil {
+			return fmt.Errorf("error create ELF file: %w", err)
+		}
+		defer outFile.Close()
+
+		if err = coverbee.WriteCollectionELF(instrumented, outFile); err != nil {
+			return fmt.Errorf("error writing ELF file: %w", err)
+		}
+	}
+
+	if err = writeInstrumentedBlockList(sharedBlockList, instrumentation); err != nil {
+		return err
+	}
+
+	fmt.Println("Programs instrumented")
+
+	return nil
+}
+
+func verifierLogsCmd() *cobra.Command {
+	verifierLogs := &cobra.Command{
+		Use:   "verifier-logs {--elf=ELF path} {--verifier-logs=path to dir}",
+		Short: "Load all programs in the given ELF file and record their verifier logs for offline instrumentation",
+		RunE:  verifierLogs,
+	}
+
+	fs := verifierLogs.Flags()
+
+	fs.StringVar(&flagElfPath, "elf", "", "Path to the ELF file containing the programs")
+	panicOnError(verifierLogs.MarkFlagFilename("elf", "o", "elf"))
+	panicOnError(verifierLogs.MarkFlagRequired("elf"))
+
+	fs.StringVar(&flagProgType, "prog-type", "", "Explicitly set the program type")
+
+	fs.StringVar(&flagVerifierLogsDir, "verifier-logs", "", "Path to the directory where the verifier logs are "+
+		"written, one <program name>.log file per program")
+	panicOnError(verifierLogs.MarkFlagDirname("verifier-logs"))
+	panicOnError(verifierLogs.MarkFlagRequired("verifier-logs"))
+
+	fs.StringVar(&flagMapPinDir, "map-pin-dir", "", "Path to the directory containing map pins")
+	panicOnError(verifierLogs.MarkFlagDirname("map-pin-dir"))
+
+	addCollectionFlags(verifierLogs)
+
+	return verifierLogs
+}
+
+func verifierLogs(cmd *cobra.Command, args []string) error {
+	spec, err := loadSpec()
+	if err != nil {
+		return err
+	}
+
+	opts, closeMaps, err := collectionOptions()
+	if err != nil {
+		return err
+	}
+	defer closeMaps()
+
+	logs, err := coverbee.RecordVerifierLogsWithOptions(spec, opts)
+	if err != nil {
+		return fmt.Errorf("error while recording verifier logs: %w", err)
+	}
+
+	if err = os.MkdirAll(flagVerifierLogsDir, 0o750); err != nil {
+		return fmt.Errorf("create verifier log dir: %w", err)
+	}
+
+	for name, log := range logs {
+		if err = os.WriteFile(filepath.Join(flagVerifierLogsDir, name+".log"), []byte(log), 0o600); err != nil {
+			return fmt.Errorf("write verifier log: %w", err)
+		}
+	}
+
+	fmt.Println("Verifier logs recorded")
+
+	return nil
+}
+
+// loadSpec loads the collection spec from the --elf file and sets the program type of programs with an unspecified
+// type to the --prog-type.
+func loadSpec() (*ebpf.CollectionSpec, error) {
 	spec, err := ebpf.LoadCollectionSpec(flagElfPath)
 	if err != nil {
-		return fmt.Errorf("Load collection spec: %w", err)
+		return nil, fmt.Errorf("Load collection spec: %w", err)
 	}
 
 	if flagProgType != "" {
@@ -131,7 +499,7 @@ func load(cmd *cobra.Command, args []string) error {
 				fmt.Fprintf(&sb, " - %s\n", option)
 			}
 
-			return errors.New(sb.String())
+			return nil, errors.New(sb.String())
 		}
 
 		// Set all unknown program types to the specified type
@@ -144,7 +512,7 @@ func load(cmd *cobra.Command, args []string) error {
 
 	for _, spec := range spec.Programs {
 		if spec.Type == ebpf.UnspecifiedProgram {
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"Program '%s' is of an unspecified type, use --prog-type to explicitly set one",
 				spec.Name,
 			)
@@ -158,65 +526,210 @@ func load(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	opts := ebpf.CollectionOptions{}
+	return spec, nil
+}
 
-	if flagMapPinDir != "" {
-		opts.Maps.PinPath = flagMapPinDir
+// openLog opens the --log file, the returned writer is nil if no log file is requested.
+func openLog() (io.Writer, func(), error) {
+	if flagLogPath == "" {
+		return nil, func() {}, nil
 	}
 
-	var logWriter io.Writer
-	if flagLogPath != "" {
-		var logFile *os.File
-		logFile, err = os.Create(flagLogPath)
-		if err != nil {
-			return fmt.Errorf("open log file: %w", err)
-		}
-		defer logFile.Close()
+	logFile, err := os.Create(flagLogPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open log file: %w", err)
+	}
+
+	logBuf := bufio.NewWriter(logFile)
 
-		logBuf := bufio.NewWriter(logFile)
-		defer logBuf.Flush()
+	return logBuf, func() {
+		logBuf.Flush()
+		logFile.Close()
+	}, nil
+}
+
+// addCollectionFlags adds the flags which control how the collection is loaded to the command.
+func addCollectionFlags(cmd *cobra.Command) {
+	fs := cmd.Flags()
+
+	fs.StringVar(&flagKernelBTF, "kernel-btf", "", "Path to a BTF file with the kernel types used for CO-RE "+
+		"relocations, instead of the BTF of the running kernel")
+	panicOnError(cmd.MarkFlagFilename("kernel-btf"))
+	fs.StringArrayVar(&flagMapReplacements, "map-replacement", nil, "Use a pinned map instead of creating a map of "+
+		"the collection, as <map name>=<pin path> (can be repeated)")
+}
 
-		logWriter = logBuf
+// collectionOptions returns the options to load the collection with, as set by --map-pin-dir and the flags added by
+// `addCollectionFlags`. The returned function closes the replacement maps.
+func collectionOptions() (ebpf.CollectionOptions, func(), error) {
+	opts := ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{
+			PinPath: flagMapPinDir,
+		},
+		MapReplacements: make(map[string]*ebpf.Map, len(flagMapReplacements)),
 	}
 
-	coll, cfg, err := coverbee.InstrumentAndLoadCollection(spec, opts, logWriter)
-	if err != nil {
-		return fmt.Errorf("error while instrumenting and loading program: %w", err)
+	closeMaps := func() {
+		for _, m := range opts.MapReplacements {
+			m.Close()
+		}
 	}
-	defer coll.Close()
 
-	for name, prog := range coll.Programs {
-		if err = prog.Pin(filepath.Join(flagProgPinDir, name)); err != nil {
-			return fmt.Errorf("error pinning program '%s': %w", name, err)
+	if flagKernelBTF != "" {
+		kernelTypes, err := btf.LoadSpec(flagKernelBTF)
+		if err != nil {
+			return opts, nil, fmt.Errorf("load kernel BTF: %w", err)
 		}
+		opts.Programs.KernelTypes = kernelTypes
 	}
 
-	if flagMapPinDir != "" {
-		if err = coll.Maps["coverbee_covermap"].Pin(filepath.Join(flagMapPinDir, "coverbee_covermap")); err != nil {
-			return fmt.Errorf("error pinning covermap: %w", err)
+	for _, replacement := range flagMapReplacements {
+		name, pinPath, found := strings.Cut(replacement, "=")
+		if !found || name == "" || pinPath == "" {
+			closeMaps()
+			return opts, nil, fmt.Errorf("invalid --map-replacement '%s', expected <map name>=<pin path>", replacement)
 		}
+
+		m, err := ebpf.LoadPinnedMap(pinPath, nil)
+		if err != nil {
+			closeMaps()
+			return opts, nil, fmt.Errorf("load replacement of map '%s': %w", name, err)
+		}
+		opts.MapReplacements[name] = m
 	}
 
-	if flagCoverMapPinPath != "" {
-		if err = coll.Maps["coverbee_covermap"].Pin(flagCoverMapPinPath); err != nil {
-			return fmt.Errorf("error pinning covermap: %w", err)
+	return opts, closeMaps, nil
+}
+
+// addInstrumentFlags adds the flags which control the instrumentation to the command.
+func addInstrumentFlags(cmd *cobra.Command) {
+	fs := cmd.Flags()
+
+	fs.IntVar(&flagCounterWidth, "counter-width", int(coverbee.Counter16Bit), "Width of the block counters in bits "+
+		"(options: 8, 16, 32, 64)")
+	fs.BoolVar(&flagSaturating, "saturating", false, "Stop counters at their max value instead of wrapping around")
+	fs.StringVar(&flagCounterStrategy, "counter-strategy", string(coverbee.CounterStrategyAuto), "The way counters "+
+		"are incremented (options: auto, shared, atomic, percpu)")
+	fs.StringVar(&flagCounterStorage, "counter-storage", string(coverbee.CounterStorageLookup), "The way counters "+
+		"are accessed, by a lookup at the start of each function or directly as global data (options: lookup, global)")
+	fs.BoolVar(&flagBranchCoverage, "branch-coverage", false, "Also count the taken and not-taken outcomes of "+
+		"every conditional jump")
+	fs.StringVar(&flagAnalysis, "analysis", string(coverbee.AnalysisVerifier), "The way used registers and stack "+
+		"slots are determined (options: verifier, static, cross-check)")
+	fs.IntVar(&flagCapacity, "covermap-capacity", 0, "Number of counters the covermap has room for, so the "+
+		"programs of other ELF files can be appended to it later (0 sizes the covermap for this ELF file only)")
+	fs.StringVar(&flagLookupFailure, "lookup-failure", string(coverbee.LookupFailureDefault), "What the programs do "+
+		"if the covermap lookup fails (options: default to return the default value for the program type, skip to "+
+		"continue without counting, or a return value)")
+	fs.StringVar(&flagCoverMapName, "covermap-name", coverbee.DefaultCoverMapName, "Name of the covermap in the "+
+		"collection, and of its pin in --map-pin-dir")
+	fs.StringVar(&flagGranularity, "granularity", string(coverbee.GranularityBlock), "Which blocks are counted "+
+		"(options: block, branch-target to count only function entries and jump targets, function to count only "+
+		"function entries)")
+	fs.BoolVar(&flagMinimalProbes, "minimal-probes", false, "Only count the blocks of which the count can't be "+
+		"derived from the counts of other blocks, which saves instructions")
+	fs.BoolVar(&flagAppend, "append", false, "Share the covermap of the existing block-list and append to it, "+
+		"instead of creating new ones. The covermap layout is taken from the existing block-list")
+
+	fs.StringSliceVar(&flagIncludeProgs, "include-prog", nil, "Only instrument programs of which the name matches "+
+		"one of these glob patterns")
+	fs.StringSliceVar(&flagExcludeProgs, "exclude-prog", nil, "Don't instrument programs of which the name matches "+
+		"one of these glob patterns")
+	fs.StringSliceVar(&flagIncludeFuncs, "include-func", nil, "Only instrument functions of which the BTF name "+
+		"matches one of these glob patterns")
+	fs.StringSliceVar(&flagExcludeFuncs, "exclude-func", nil, "Don't instrument functions of which the BTF name "+
+		"matches one of these glob patterns")
+	fs.StringSliceVar(&flagIncludeFiles, "include-file", nil, "Only instrument code from source files of which the "+
+		"path or its trailing elements match one of these glob patterns")
+	fs.StringSliceVar(&flagExcludeFiles, "exclude-file", nil, "Don't instrument code from source files of which the "+
+		"path or its trailing elements match one of these glob patterns")
+}
+
+// instrumentOptions returns the instrumentation options as set by the flags added by `addInstrumentFlags`.
+func instrumentOptions(logWriter io.Writer) (coverbee.InstrumentOptions, error) {
+	lookupFailure := coverbee.LookupFailure{Action: coverbee.LookupFailureAction(flagLookupFailure)}
+	if lookupFailure.Action != coverbee.LookupFailureDefault && lookupFailure.Action != coverbee.LookupFailureSkip {
+		returnValue, err := strconv.ParseInt(flagLookupFailure, 0, 32)
+		if err != nil {
+			return coverbee.InstrumentOptions{}, fmt.Errorf(
+				"invalid --lookup-failure '%s', pick from default, skip or a return value", flagLookupFailure,
+			)
+		}
+
+		lookupFailure = coverbee.LookupFailure{
+			Action:      coverbee.LookupFailureReturn,
+			ReturnValue: int32(returnValue),
 		}
 	}
 
-	blockList := coverbee.CFGToBlockList(cfg)
+	return coverbee.InstrumentOptions{
+		Layout: coverbee.CoverMapLayout{
+			CounterWidth: coverbee.CounterWidth(flagCounterWidth),
+			Saturating:   flagSaturating,
+			Strategy:     coverbee.CounterStrategy(flagCounterStrategy),
+			Storage:      coverbee.CounterStorage(flagCounterStorage),
+			Capacity:     flagCapacity,
+		},
+		CoverMapName:   flagCoverMapName,
+		LookupFailure:  lookupFailure,
+		Granularity:    coverbee.Granularity(flagGranularity),
+		BranchCoverage: flagBranchCoverage,
+		MinimalProbes:  flagMinimalProbes,
+		LogWriter:      logWriter,
+		Analysis:       coverbee.AnalysisMode(flagAnalysis),
+		Filter: coverbee.Filter{
+			IncludePrograms:  flagIncludeProgs,
+			ExcludePrograms:  flagExcludeProgs,
+			IncludeFunctions: flagIncludeFuncs,
+			ExcludeFunctions: flagExcludeFuncs,
+			IncludeFiles:     flagIncludeFiles,
+			ExcludeFiles:     flagExcludeFiles,
+		},
+	}, nil
+}
+
+// readBlockList reads the block-list from the --block-list file.
+func readBlockList() (*coverbee.BlockList, error) {
+	blockListFile, err := os.Open(flagBlockListPath)
+	if err != nil {
+		return nil, fmt.Errorf("open block-list: %w", err)
+	}
+	defer blockListFile.Close()
 
+	blockList, err := coverbee.ReadBlockList(blockListFile)
+	if err != nil {
+		return nil, fmt.Errorf("read block-list: %w", err)
+	}
+
+	return blockList, nil
+}
+
+// writeInstrumentedBlockList writes the block-list of the instrumentation to the --block-list file. If the collection
+// shares the covermap of an existing block-list, the block-list of the instrumentation is appended to it.
+func writeInstrumentedBlockList(shared *coverbee.BlockList, instrumentation *coverbee.Instrumentation) error {
+	if shared == nil {
+		return writeBlockList(instrumentation.BlockList())
+	}
+
+	if err := shared.Append(instrumentation.BlockList()); err != nil {
+		return fmt.Errorf("append block-list: %w", err)
+	}
+
+	return writeBlockList(shared)
+}
+
+// writeBlockList writes the block-list to the --block-list file.
+func writeBlockList(blockList *coverbee.BlockList) error {
 	blockListFile, err := os.Create(flagBlockListPath)
 	if err != nil {
 		return fmt.Errorf("error create block-list: %w", err)
 	}
 	defer blockListFile.Close()
 
-	if err = json.NewEncoder(blockListFile).Encode(&blockList); err != nil {
+	if err = json.NewEncoder(blockListFile).Encode(blockList); err != nil {
 		return fmt.Errorf("error encoding block-list: %w", err)
 	}
 
-	fmt.Println("Programs instrumented and loaded")
-
 	return nil
 }
 
@@ -241,12 +754,16 @@ func coverageCmd() *cobra.Command {
 		"containing coverage information)")
 	panicOnError(coverCmd.MarkFlagFilename("covermap-pin"))
 
+	fs.StringVar(&flagCoverMapName, "covermap-name", coverbee.DefaultCoverMapName, "Name of the covermap pin in "+
+		"--map-pin-dir")
+
 	fs.StringVar(&flagBlockListPath, "block-list", "", "Path where the block-list is stored (contains coverage data "+
 		"to source code mapping, needed when reading from cover map)")
 	panicOnError(coverCmd.MarkFlagFilename("block-list", "json"))
 	panicOnError(coverCmd.MarkFlagRequired("block-list"))
 
-	fs.StringVar(&flagOutputFormat, "format", "html", "Output format (options: html, go-cover)")
+	fs.StringVar(&flagOutputFormat, "format", "html", "Output format (options: html, go-cover, branches, functions, "+
+		"summary)")
 
 	fs.StringVar(&flagOutputPath, "output", "", "Path to the coverage output")
 	panicOnError(coverCmd.MarkFlagRequired("output"))
@@ -262,37 +779,33 @@ func coverage(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	var (
-		coverMap *ebpf.Map
-		err      error
-	)
-	if flagMapPinDir != "" {
-		coverMap, err = ebpf.LoadPinnedMap(filepath.Join(flagMapPinDir, "coverbee_covermap"), nil)
-		if err != nil {
-			return fmt.Errorf("load covermap pin: %w", err)
-		}
-	} else {
-		coverMap, err = ebpf.LoadPinnedMap(flagCoverMapPinPath, nil)
-		if err != nil {
-			return fmt.Errorf("load covermap pin: %w", err)
-		}
+	coverMap, err := loadCoverMapPin()
+	if err != nil {
+		return err
 	}
+	defer coverMap.Close()
 
-	blockList := make([][]coverbee.CoverBlock, 0)
-
-	blockListPath, err := os.Open(flagBlockListPath)
+	parsedBlockList, err := readBlockList()
 	if err != nil {
-		return fmt.Errorf("open block-list: %w", err)
+		return err
 	}
 
-	if err = json.NewDecoder(blockListPath).Decode(&blockList); err != nil {
-		return fmt.Errorf("decode block-list: %w", err)
+	if err = parsedBlockList.ApplyCoverMap(coverMap); err != nil {
+		return fmt.Errorf("apply covermap: %w", err)
 	}
 
-	if err = coverbee.ApplyCoverMapToBlockList(coverMap, blockList); err != nil {
-		return fmt.Errorf("apply covermap: %w", err)
+	// Coverage of programs which aren't counted per block, or not at all, is incomplete. Stderr keeps the output
+	// clean if it is written to stdout.
+	for _, program := range parsedBlockList.Programs {
+		if program.Granularity != coverbee.GranularityBlock || len(program.ExcludedFunctions) > 0 ||
+			len(program.Fallbacks) > 0 {
+			fmt.Fprintln(os.Stderr, "Programs:")
+			printProgramInstrumentation(os.Stderr, parsedBlockList.Programs)
+			break
+		}
 	}
 
+	blockList := parsedBlockList.Blocks
 	outBlocks := blockList
 	if !flagDisableInterpolation {
 		outBlocks, err = coverbee.SourceCodeInterpolation(blockList, nil)
@@ -319,18 +832,13 @@ func coverage(cmd *cobra.Command, args []string) error {
 		defer f.Close()
 	}
 
-	switch flagOutputFormat {
-	case "html":
-		if err = coverbee.BlockListToHTML(outBlocks, output, "count"); err != nil {
-			return fmt.Errorf("block list to HTML: %w", err)
-		}
-	case "go-cover", "cover":
-		coverbee.BlockListToGoCover(outBlocks, output, "count")
-	default:
-		return fmt.Errorf("unknown output format")
+	format := coverbee.ReportFormat(flagOutputFormat)
+	if format == "cover" {
+		format = coverbee.ReportGoCover
 	}
 
-	return nil
+	parsedBlockList.Blocks = outBlocks
+	return parsedBlockList.WriteReport(format, output)
 }
 
 var strToProgType = map[string]ebpf.ProgramType{
@@ -0,0 +1,172 @@
+package coverbee
+
+import (
+	"fmt"
+)
+
+// maxCoverMapValueSize is the max size of the value of a single cover-map entry. Counters are addressed with a signed
+// 16-bit offset from the start of the value and the kernel doesn't allow per-CPU values larger than 32KiB.
+const maxCoverMapValueSize = 32768
+
+// counterAllocation assigns counters to blocks and branches. Counters are numbered across all entries of the
+// cover-map, counter N is stored in entry N / perEntry. The instrumentation code only keeps a pointer to a single
+// cover-map entry per stack frame, so all counters of a function are allocated within the same entry.
+type counterAllocation struct {
+	// The number of counters in a single cover-map entry
+	perEntry int
+	// The total number of counters, including unused counters at the end of entries and room reserved by the
+	// capacity of the layout
+	total int
+	// The counter of each block, indexed by block ID. -1 if the count of the block is derived from other counters.
+	blockCounters []int
+	// The cover-map entry which contains the counters of the function of each block, indexed by block ID.
+	blockEntries []int
+	// The first of the two counters of the branch at the end of each block, indexed by block ID. -1 if the block
+	// doesn't end with a conditional jump or branch coverage is disabled.
+	branchCounters []int
+}
+
+// entry returns the index of the cover-map entry which contains the given counter.
+func (ca *counterAllocation) entry(counter int) int {
+	return counter / ca.perEntry
+}
+
+// offset returns the offset of the counter from the start of its cover-map entry.
+func (ca *counterAllocation) offset(counter int, width CounterWidth) int16 {
+	return int16((counter % ca.perEntry) * width.Bytes())
+}
+
+// numEntries returns the number of cover-map entries needed to store all counters.
+func (ca *counterAllocation) numEntries() int {
+	return (ca.total + ca.perEntry - 1) / ca.perEntry
+}
+
+// coverFunction is a range of blocks which make up a program or bpf-to-bpf function.
+type coverFunction struct {
+	prog   string
+	name   string
+	blocks []*BasicBlock
+	// For each block, true if it has a counter and false if its count is derived from the counters of other blocks.
+	counted []bool
+	// The number of counters needed for the blocks and branches of the function.
+	numCounters int
+	// True if the branches of the function are counted.
+	branchCoverage bool
+}
+
+// splitFunctions splits the blocks of the given programs into functions. A new function starts at the block of the
+// program symbol and at each block of which the symbol is called as a bpf-to-bpf function or referenced as callback.
+// Only the blocks which are instrumented are part of the functions. Branches are counted in the programs for which
+// `progBranchCoverage` is true. Blocks only get a counter if `progCounted` is true for them, or if it is nil for their
+// program.
+func splitFunctions(
+	progNames []string,
+	progBlocks map[string][]*BasicBlock,
+	progSubFuncs map[string]map[string]bool,
+	progInstrumented map[string][]bool,
+	progCounted map[string][]bool,
+	progBranchCoverage map[string]bool,
+) []coverFunction {
+	var funcs []coverFunction
+	for _, name := range progNames {
+		for i, block := range progBlocks[name] {
+			blockSym := block.Block[0].Symbol()
+			if i == 0 || progSubFuncs[name][blockSym] || name == blockSym {
+				funcs = append(funcs, coverFunction{
+					prog:           name,
+					name:           blockSym,
+					branchCoverage: progBranchCoverage[name],
+				})
+			}
+
+			if !progInstrumented[name][i] {
+				continue
+			}
+
+			counted := progCounted[name] == nil || progCounted[name][i]
+
+			fn := &funcs[len(funcs)-1]
+			fn.blocks = append(fn.blocks, block)
+			fn.counted = append(fn.counted, counted)
+			if counted {
+				fn.numCounters++
+			}
+			if fn.branchCoverage && isConditionalJump(block.Block[len(block.Block)-1]) {
+				fn.numCounters += 2
+			}
+		}
+	}
+
+	return funcs
+}
+
+// allocateCounters allocates counters for all blocks of the given functions, and for their branches if branch
+// coverage is enabled for the function. If all counters fit in a single cover-map entry, only one entry is used.
+// Otherwise counters are spread over multiple entries of the max value size of the layout, an error is returned if a
+// single function needs more counters than fit in one entry.
+//
+// Counters are allocated from `first` onwards, the counters before it belong to other collections which share the
+// cover-map. If the layout has a capacity, the cover-map is sized for the capacity instead of the allocated counters.
+func allocateCounters(
+	funcs []coverFunction,
+	layout CoverMapLayout,
+	first int,
+) (*counterAllocation, error) {
+	width := layout.CounterWidth
+
+	total := 0
+	for _, fn := range funcs {
+		total += fn.numCounters
+	}
+
+	alloc := &counterAllocation{
+		perEntry: max(total, layout.Capacity),
+	}
+	if maxPerEntry := layout.maxValueSize() / width.Bytes(); alloc.perEntry > maxPerEntry {
+		alloc.perEntry = maxPerEntry
+	}
+	if alloc.perEntry == 0 {
+		alloc.perEntry = 1
+	}
+
+	next := first
+	for _, fn := range funcs {
+		if fn.numCounters > alloc.perEntry {
+			return nil, fmt.Errorf(
+				"function '%s' in program '%s' needs %d counters, a cover-map entry can hold at most %d %d-bit counters",
+				fn.name, fn.prog, fn.numCounters, alloc.perEntry, width,
+			)
+		}
+
+		// Start at the next entry if the function doesn't fit in the remainder of the current one.
+		if next%alloc.perEntry+fn.numCounters > alloc.perEntry {
+			next = (alloc.entry(next) + 1) * alloc.perEntry
+		}
+
+		entry := alloc.entry(next)
+		for i, block := range fn.blocks {
+			alloc.blockEntries = append(alloc.blockEntries, entry)
+			if fn.counted[i] {
+				alloc.blockCounters = append(alloc.blockCounters, next)
+				next++
+			} else {
+				alloc.blockCounters = append(alloc.blockCounters, -1)
+			}
+
+			if fn.branchCoverage && isConditionalJump(block.Block[len(block.Block)-1]) {
+				alloc.branchCounters = append(alloc.branchCounters, next)
+				next += 2
+			} else {
+				alloc.branchCounters = append(alloc.branchCounters, -1)
+			}
+		}
+	}
+	if layout.Capacity > 0 && next > layout.Capacity {
+		return nil, fmt.Errorf(
+			"the cover-map has a capacity of %d counters but %d are needed", layout.Capacity, next,
+		)
+	}
+	alloc.total = max(next, layout.Capacity)
+
+	return alloc, nil
+}
@@ -0,0 +1,131 @@
+package coverbee
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cilium/ebpf/asm"
+)
+
+// testFunction returns a function with the given number of blocks, which all have a counter.
+func testFunction(name string, numBlocks int) coverFunction {
+	fn := coverFunction{prog: "prog", name: name, numCounters: numBlocks}
+	for i := 0; i < numBlocks; i++ {
+		fn.blocks = append(fn.blocks, &BasicBlock{Block: asm.Instructions{asm.Mov.Imm(asm.R0, 0)}})
+		fn.counted = append(fn.counted, true)
+	}
+	return fn
+}
+
+func TestAllocateCounters(t *testing.T) {
+	// 64-bit counters with the lookup storage fit 4096 in an entry.
+	const perEntry = maxCoverMapValueSize / 8
+
+	tests := []struct {
+		name   string
+		funcs  []coverFunction
+		layout CoverMapLayout
+		first  int
+		// The first counter and entry of each function.
+		wantFirst   []int
+		wantEntries []int
+		wantTotal   int
+		wantPer     int
+		wantErr     bool
+	}{
+		{
+			name:        "Single entry",
+			funcs:       []coverFunction{testFunction("a", 3), testFunction("b", 2)},
+			layout:      CoverMapLayout{CounterWidth: Counter64Bit},
+			wantFirst:   []int{0, 3},
+			wantEntries: []int{0, 0},
+			wantTotal:   5,
+			wantPer:     5,
+		},
+		{
+			// The second function doesn't fit in the remainder of the first entry.
+			name:        "Split across entries",
+			funcs:       []coverFunction{testFunction("a", 3000), testFunction("b", 3000), testFunction("c", 1000)},
+			layout:      CoverMapLayout{CounterWidth: Counter64Bit},
+			wantFirst:   []int{0, perEntry, perEntry + 3000},
+			wantEntries: []int{0, 1, 1},
+			wantTotal:   perEntry + 4000,
+			wantPer:     perEntry,
+		},
+		{
+			name:        "After other collection",
+			funcs:       []coverFunction{testFunction("a", 3000)},
+			layout:      CoverMapLayout{CounterWidth: Counter64Bit, Capacity: 2 * perEntry},
+			first:       perEntry - 10,
+			wantFirst:   []int{perEntry},
+			wantEntries: []int{1},
+			wantTotal:   2 * perEntry,
+			wantPer:     perEntry,
+		},
+		{
+			name:    "Function too large",
+			funcs:   []coverFunction{testFunction("a", 1), testFunction("b", perEntry+1)},
+			layout:  CoverMapLayout{CounterWidth: Counter64Bit},
+			wantErr: true,
+		},
+		{
+			name:    "Capacity exceeded",
+			funcs:   []coverFunction{testFunction("a", 10)},
+			layout:  CoverMapLayout{CounterWidth: Counter64Bit, Capacity: 5},
+			wantErr: true,
+		},
+		{
+			// Without counters the entries can't be empty, there is always room for one counter.
+			name:        "No counters",
+			funcs:       []coverFunction{testFunction("a", 0)},
+			layout:      CoverMapLayout{CounterWidth: Counter64Bit},
+			wantFirst:   []int{},
+			wantEntries: []int{},
+			wantTotal:   0,
+			wantPer:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc, err := allocateCounters(tt.funcs, tt.layout, tt.first)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("allocateCounters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if alloc.perEntry != tt.wantPer || alloc.total != tt.wantTotal {
+				t.Errorf("%d counters per entry and %d in total, want %d and %d",
+					alloc.perEntry, alloc.total, tt.wantPer, tt.wantTotal)
+			}
+
+			gotFirst, gotEntries := []int{}, []int{}
+			blockID := 0
+			for _, fn := range tt.funcs {
+				if len(fn.blocks) == 0 {
+					continue
+				}
+				gotFirst = append(gotFirst, alloc.blockCounters[blockID])
+				gotEntries = append(gotEntries, alloc.blockEntries[blockID])
+
+				// All counters of a function are in the same entry.
+				for i := range fn.blocks {
+					counter := alloc.blockCounters[blockID+i]
+					if alloc.entry(counter) != alloc.blockEntries[blockID] {
+						t.Errorf("counter %d of function '%s' is in entry %d, want %d",
+							counter, fn.name, alloc.entry(counter), alloc.blockEntries[blockID])
+					}
+				}
+				blockID += len(fn.blocks)
+			}
+			if !reflect.DeepEqual(gotFirst, tt.wantFirst) || !reflect.DeepEqual(gotEntries, tt.wantEntries) {
+				t.Errorf("functions start at counters %v in entries %v, want %v in %v",
+					gotFirst, gotEntries, tt.wantFirst, tt.wantEntries)
+			}
+			if want := (tt.wantTotal + tt.wantPer - 1) / tt.wantPer; alloc.numEntries() != want {
+				t.Errorf("%d entries, want %d", alloc.numEntries(), want)
+			}
+		})
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"io"
 	"math"
 	"os"
-	"sort"
 	"strings"
 
 	"golang.org/x/tools/cover"
@@ -21,8 +20,20 @@ import (
 // HTMLOutput generates an HTML page from profile data.
 // coverage report is written to the out writer.
 func HTMLOutput(profiles []*cover.Profile, out io.Writer) error {
+	return htmlOutput(profiles, nil, out)
+}
+
+func htmlOutput(profiles []*cover.Profile, branches []BranchCoverage, out io.Writer) error {
 	var d templateData
 
+	fileBranches := make(map[string]map[int][]BranchCoverage)
+	for _, branch := range branches {
+		if fileBranches[branch.Filename] == nil {
+			fileBranches[branch.Filename] = make(map[int][]BranchCoverage)
+		}
+		fileBranches[branch.Filename][branch.Line] = append(fileBranches[branch.Filename][branch.Line], branch)
+	}
+
 	for _, profile := range profiles {
 		if profile.Mode == "set" {
 			d.Set = true
@@ -34,7 +45,7 @@ func HTMLOutput(profiles []*cover.Profile, out io.Writer) error {
 		}
 
 		var buf strings.Builder
-		err = htmlGen(&buf, src, profile.Boundaries(src))
+		err = htmlGen(&buf, src, profile.Boundaries(src), fileBranches[profile.FileName])
 		if err != nil {
 			return err
 		}
@@ -73,12 +84,18 @@ func percentCovered(p *cover.Profile) float64 {
 
 // htmlGen generates an HTML coverage report with the provided filename,
 // source code, and tokens, and writes it to the given Writer.
-func htmlGen(w io.Writer, src []byte, boundaries []cover.Boundary) error {
+// The branches, indexed by line number, are annotated at the end of their line, after the spans ending there.
+func htmlGen(w io.Writer, src []byte, boundaries []cover.Boundary, branches map[int][]BranchCoverage) error {
 	dst := bufio.NewWriter(w)
-	for i := range src {
-		for len(boundaries) > 0 && boundaries[0].Offset == i {
+
+	// writeBoundaries writes the boundaries at the offset, only those which end a span if `endsOnly` is set.
+	writeBoundaries := func(offset int, endsOnly bool) {
+		for len(boundaries) > 0 && boundaries[0].Offset == offset {
 			b := boundaries[0]
 			if b.Start {
+				if endsOnly {
+					return
+				}
 				n := 0
 				if b.Count > 0 {
 					n = int(math.Floor(b.Norm*9)) + 1
@@ -90,6 +107,30 @@ func htmlGen(w io.Writer, src []byte, boundaries []cover.Boundary) error {
 			}
 			boundaries = boundaries[1:]
 		}
+	}
+
+	writeBranches := func(line int) {
+		for _, branch := range branches[line] {
+			n := 8
+			if branch.Taken == 0 || branch.NotTaken == 0 {
+				n = 0
+			}
+			fmt.Fprintf(dst,
+				` <span class="cov%v" title="branch taken %d times, not taken %d times">[%d/%d]</span>`,
+				n, branch.Taken, branch.NotTaken, branch.Taken, branch.NotTaken,
+			)
+		}
+	}
+
+	line := 1
+	for i := range src {
+		if src[i] == '\n' {
+			// Spans of blocks end at the newline, the annotation goes after them.
+			writeBoundaries(i, true)
+			writeBranches(line)
+			line++
+		}
+		writeBoundaries(i, false)
 
 		//nolint:errcheck // no remediation available if writes were to fail
 		switch b := src[i]; b {
@@ -105,6 +146,13 @@ func htmlGen(w io.Writer, src []byte, boundaries []cover.Boundary) error {
 			_ = dst.WriteByte(b)
 		}
 	}
+
+	// The last line doesn't end with a newline.
+	writeBoundaries(len(src), false)
+	if len(src) > 0 && src[len(src)-1] != '\n' {
+		writeBranches(line)
+	}
+
 	return dst.Flush()
 }
 
@@ -295,12 +343,7 @@ func (cb CoverBlock) String() string {
 // BlockListToGoCover convert a block-list into a go-cover file which can be interpreted by `go tool cover`.
 // `mode` value can be `set` or `count`, see `go tool cover -h` for details.
 func BlockListToGoCover(blockList [][]CoverBlock, out io.Writer, mode string) {
-	fmt.Fprintln(out, "mode:", mode)
-	for _, coverBlock := range blockList {
-		for _, line := range coverBlock {
-			fmt.Fprintln(out, line)
-		}
-	}
+	NewReport(&BlockList{Blocks: blockList}).WriteGoCover(out, mode)
 }
 
 // ProfilesToGoCover convert a profile list into a go-cover file which can be interpreted by `go tool cover`.
@@ -325,35 +368,31 @@ func ProfilesToGoCover(profiles []*cover.Profile, out io.Writer, mode string) {
 
 // BlockListToHTML converts a block-list into a HTML coverage report.
 func BlockListToHTML(blockList [][]CoverBlock, out io.Writer, mode string) error {
-	var buf bytes.Buffer
-	BlockListToGoCover(blockList, &buf, mode)
-	profiles, err := cover.ParseProfilesFromReader(&buf)
-	if err != nil {
-		return err
-	}
+	return BlockListWithBranchesToHTML(blockList, nil, out, mode)
+}
 
-	if err = HTMLOutput(profiles, out); err != nil {
-		return fmt.Errorf("write html: %w", err)
-	}
+// BlockListWithBranchesToHTML converts a block-list into a HTML coverage report, lines containing a conditional jump
+// are annotated with the number of times the jump was taken and not taken as `[taken/not taken]`.
+func BlockListWithBranchesToHTML(
+	blockList [][]CoverBlock,
+	branches []BranchCoverage,
+	out io.Writer,
+	mode string,
+) error {
+	return NewReport(&BlockList{Blocks: blockList, Branches: branches}).WriteHTML(out, mode)
+}
 
-	return nil
+// BranchesToText writes a line for every branch, sorted by source location, containing the number of times the
+// branch was taken and not taken.
+func BranchesToText(branches []BranchCoverage, out io.Writer) {
+	NewReport(&BlockList{Branches: branches}).WriteBranches(out)
 }
 
 // BlockListFilePaths returns a sorted and deduplicateed list of file paths included in the block list
 func BlockListFilePaths(blockList [][]CoverBlock) []string {
 	var uniqueFiles []string
-	for _, blocks := range blockList {
-		for _, block := range blocks {
-			i := sort.SearchStrings(uniqueFiles, block.Filename)
-			if i < len(uniqueFiles) && uniqueFiles[i] == block.Filename {
-				continue
-			}
-
-			// Insert sorted
-			uniqueFiles = append(uniqueFiles, "")
-			copy(uniqueFiles[i+1:], uniqueFiles[i:])
-			uniqueFiles[i] = block.Filename
-		}
+	for _, file := range NewReport(&BlockList{Blocks: blockList}).Files {
+		uniqueFiles = append(uniqueFiles, file.Name)
 	}
 	return uniqueFiles
 }
@@ -0,0 +1,59 @@
+package coverbee
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+func TestHTMLGen(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		boundaries []cover.Boundary
+		branches   map[int][]BranchCoverage
+		want       string
+	}{
+		{
+			name: "Annotation after span",
+			src:  "ab\ncd\n",
+			boundaries: []cover.Boundary{
+				{Offset: 0, Start: true, Count: 1, Norm: 1},
+				{Offset: 2},
+			},
+			branches: map[int][]BranchCoverage{1: {{Taken: 1, NotTaken: 2}}},
+			want: `<span class="cov10" title="1">ab</span>` +
+				` <span class="cov8" title="branch taken 1 times, not taken 2 times">[1/2]</span>` + "\ncd\n",
+		},
+		{
+			name: "Last line without newline",
+			src:  "ab\ncd",
+			boundaries: []cover.Boundary{
+				{Offset: 3, Start: true, Count: 0},
+				{Offset: 5},
+			},
+			branches: map[int][]BranchCoverage{2: {{Taken: 3}}},
+			want: "ab\n" + `<span class="cov0" title="0">cd</span>` +
+				` <span class="cov0" title="branch taken 3 times, not taken 0 times">[3/0]</span>`,
+		},
+		{
+			name:     "Escaping",
+			src:      "a<b\tc\n",
+			branches: map[int][]BranchCoverage{},
+			want:     "a&lt;b        c\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			if err := htmlGen(&sb, []byte(tt.src), tt.boundaries, tt.branches); err != nil {
+				t.Fatal(err)
+			}
+
+			if sb.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", sb.String(), tt.want)
+			}
+		})
+	}
+}
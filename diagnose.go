@@ -0,0 +1,254 @@
+package coverbee
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cilium/coverbee/pkg/verifierlog"
+	"github.com/cilium/ebpf"
+)
+
+// VerifierFailureKind classifies why the verifier rejected an instrumented program.
+type VerifierFailureKind string
+
+const (
+	// VerifierFailureStackTooLarge means the stack slots added by the instrumentation made a stack frame, or the
+	// combined stack of a call chain, larger than the 512 bytes allowed by the kernel.
+	VerifierFailureStackTooLarge VerifierFailureKind = "stack-too-large"
+	// VerifierFailureInstructionLimit means the program has more instructions than the kernel allows, or the verifier
+	// processed more instructions than its limit of 1 million.
+	VerifierFailureInstructionLimit VerifierFailureKind = "instruction-limit"
+	// VerifierFailureComplexityLimit means the verifier gave up because the program has too many paths to explore.
+	VerifierFailureComplexityLimit VerifierFailureKind = "complexity-limit"
+	// VerifierFailureInvalidStackRead means the instrumentation read a stack slot which doesn't hold the value it
+	// stored there, because the program uses the slot as well.
+	VerifierFailureInvalidStackRead VerifierFailureKind = "invalid-stack-read"
+	// VerifierFailureUnknown is any other failure.
+	VerifierFailureUnknown VerifierFailureKind = "unknown"
+)
+
+// VerifierFailure is the diagnosis of a verifier error of an instrumented program. It wraps the error returned by
+// the loader.
+type VerifierFailure struct {
+	// The name of the rejected program.
+	Program string
+	Kind    VerifierFailureKind
+	// The verifier message which explains why the program was rejected.
+	Message string
+	// The raw instruction number in the instrumented program at which the verifier failed, -1 if unknown.
+	Instruction int
+	// The raw instruction number in the original program which corresponds to `Instruction`, -1 if unknown. If the
+	// failing instruction was added by the instrumentation, this is the instruction it was added for.
+	OriginalInstruction int
+	// True if the failing instruction was added by the instrumentation.
+	InInstrumentation bool
+	// The symbol of the function which contains the failing instruction, empty if unknown.
+	Function string
+	// A human readable suggestion on how to avoid the failure.
+	Suggestion string
+
+	err error
+}
+
+func (vf *VerifierFailure) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "program '%s' rejected by the verifier (%s)", vf.Program, vf.Kind)
+	if vf.Instruction >= 0 {
+		fmt.Fprintf(&sb, " at instruction %d", vf.Instruction)
+		if vf.InInstrumentation {
+			fmt.Fprintf(&sb, ", instrumentation of original instruction %d", vf.OriginalInstruction)
+		} else if vf.OriginalInstruction >= 0 {
+			fmt.Fprintf(&sb, ", original instruction %d", vf.OriginalInstruction)
+		}
+		if vf.Function != "" {
+			fmt.Fprintf(&sb, " in function '%s'", vf.Function)
+		}
+	}
+	fmt.Fprintf(&sb, ": %s", vf.Message)
+	if vf.Suggestion != "" {
+		fmt.Fprintf(&sb, "\nSuggestion: %s", vf.Suggestion)
+	}
+
+	return sb.String()
+}
+
+func (vf *VerifierFailure) Unwrap() error {
+	return vf.err
+}
+
+// instructionOrigin describes where an instruction of an instrumented program comes from.
+type instructionOrigin struct {
+	// The raw instruction number in the original program. For instrumentation, the original instruction the
+	// instrumentation was added for.
+	original int
+	// True if the instruction was added by the instrumentation.
+	instrumentation bool
+	// The symbol of the function which contains the instruction.
+	function string
+}
+
+// instrumentedProgram records how an instrumented program relates to the original one, to diagnose verifier errors.
+type instrumentedProgram struct {
+	// The origin of every raw instruction of the instrumented program.
+	origins []instructionOrigin
+	// The frame pointer offsets of the stack slots used by the instrumentation, indexed by function symbol.
+	stackSlots map[string][]int
+}
+
+var (
+	loadErrorProgramRegex = regexp.MustCompile(`^program (\S+): `)
+	stackTooLargeRegex    = regexp.MustCompile(
+		`stack size .*[Tt]oo large|call stack of previous frames is \d+ bytes`,
+	)
+	stackOutOfBoundsRegex = regexp.MustCompile(`invalid (?:\w+ )?stack (?:R\d+ )?off=(-?\d+)`)
+	instructionLimitRegex = regexp.MustCompile(`BPF program is too large`)
+	complexityLimitRegex  = regexp.MustCompile(`is too complex|too many states`)
+	invalidStackReadRegex = regexp.MustCompile(
+		`invalid (?:\w+ )?read from stack (?:R\d+ )?off[ =](-?\d+)(?:\+(\d+))?`,
+	)
+	invalidMemoryAccessRegex = regexp.MustCompile(`R\d+ invalid mem access`)
+)
+
+// DiagnoseVerifierError diagnoses an error returned when loading the instrumented collection. If the error is a
+// verifier error of one of the instrumented programs, a `*VerifierFailure` which wraps the error is returned,
+// otherwise nil. The verifier log in the error is mapped back to the original programs and the failure is classified
+// so a suggestion can be made.
+func (i *Instrumentation) DiagnoseVerifierError(err error) *VerifierFailure {
+	var vErr *ebpf.VerifierError
+	if !errors.As(err, &vErr) {
+		return nil
+	}
+
+	// Collections prefix errors with the name of the program which failed to load.
+	var name string
+	if match := loadErrorProgramRegex.FindStringSubmatch(err.Error()); match != nil {
+		name = match[1]
+	} else if len(i.programs) == 1 {
+		for progName := range i.programs {
+			name = progName
+		}
+	}
+	prog := i.programs[name]
+	if prog == nil {
+		return nil
+	}
+
+	failure := &VerifierFailure{
+		Program:             name,
+		Kind:                VerifierFailureUnknown,
+		Instruction:         -1,
+		OriginalInstruction: -1,
+		err:                 err,
+	}
+
+	// The failing instruction is the last one the verifier logged, the message is the last line which isn't part of
+	// the statistics after it.
+	for _, stmt := range verifierlog.ParseVerifierLog(strings.Join(vErr.Log, "\n")) {
+		switch stmt := stmt.(type) {
+		case *verifierlog.Instruction:
+			failure.Instruction = stmt.InstructionNumber
+		case *verifierlog.InstructionState:
+			failure.Instruction = stmt.InstructionNumber
+		case *verifierlog.Unknown:
+			if !strings.HasPrefix(stmt.Log, "verification time") && !strings.HasPrefix(stmt.Log, "stack depth") {
+				failure.Message = stmt.Log
+			}
+		}
+	}
+	if failure.Message == "" {
+		failure.Message = vErr.Error()
+	}
+
+	if failure.Instruction >= 0 && failure.Instruction < len(prog.origins) {
+		origin := prog.origins[failure.Instruction]
+		failure.OriginalInstruction = origin.original
+		failure.InInstrumentation = origin.instrumentation
+		failure.Function = origin.function
+	}
+
+	failure.Kind = classifyVerifierFailure(failure, prog, errors.Is(err, syscall.E2BIG))
+	failure.Suggestion = verifierFailureSuggestion(failure)
+
+	return failure
+}
+
+// classifyVerifierFailure determines the kind of failure from the verifier message.
+func classifyVerifierFailure(failure *VerifierFailure, prog *instrumentedProgram, tooBig bool) VerifierFailureKind {
+	msg := failure.Message
+
+	if stackTooLargeRegex.MatchString(msg) {
+		return VerifierFailureStackTooLarge
+	}
+
+	if match := stackOutOfBoundsRegex.FindStringSubmatch(msg); match != nil {
+		if off, err := strconv.Atoi(match[1]); err == nil && -off > maxStackDepth {
+			return VerifierFailureStackTooLarge
+		}
+	}
+
+	// The kernel rejects programs with too many instructions before verifying them, without log.
+	if instructionLimitRegex.MatchString(msg) || tooBig {
+		return VerifierFailureInstructionLimit
+	}
+
+	if complexityLimitRegex.MatchString(msg) {
+		return VerifierFailureComplexityLimit
+	}
+
+	if match := invalidStackReadRegex.FindStringSubmatch(msg); match != nil {
+		off, _ := strconv.Atoi(match[1])
+		if match[2] != "" {
+			i, _ := strconv.Atoi(match[2])
+			off += i
+		}
+		for _, slot := range prog.stackSlots[failure.Function] {
+			if -off == slot {
+				return VerifierFailureInvalidStackRead
+			}
+		}
+	}
+
+	// The instrumentation only accesses memory through the pointer to the cover-map value it reads from the stack,
+	// if that isn't a pointer anymore the program overwrote the slot.
+	invalidAccess := invalidMemoryAccessRegex.MatchString(msg) || invalidStackReadRegex.MatchString(msg)
+	if failure.InInstrumentation && invalidAccess {
+		return VerifierFailureInvalidStackRead
+	}
+
+	return VerifierFailureUnknown
+}
+
+// verifierFailureSuggestion returns a suggestion on how to avoid the failure.
+func verifierFailureSuggestion(failure *VerifierFailure) string {
+	switch failure.Kind {
+	case VerifierFailureStackTooLarge:
+		return "the instrumentation needs up to 24 bytes of stack in every function. Global counter storage needs " +
+			"8 bytes less, or exclude the deepest functions of the call chain from instrumentation with a filter"
+	case VerifierFailureInstructionLimit:
+		return "instrument fewer blocks by excluding functions or files with a filter, or use fewer instructions " +
+			"per block by disabling branch coverage and saturating counters or switching to the atomic strategy"
+	case VerifierFailureComplexityLimit:
+		return "saturating counters, branch coverage and skipping failed lookups add branches which the verifier " +
+			"has to explore, disable them or exclude functions with a filter"
+	case VerifierFailureInvalidStackRead:
+		fn := "the function"
+		if failure.Function != "" {
+			fn = fmt.Sprintf("function '%s'", failure.Function)
+		}
+		return fmt.Sprintf("the stack slots used by the instrumentation are also used by the program. The "+
+			"analysis missed a stack slot, use the verifier or cross-check analysis, or exclude %s with a filter", fn)
+	}
+
+	if failure.InInstrumentation {
+		return "the failing instruction was added by the instrumentation, exclude the function with a filter and " +
+			"please report the issue with the log of the instrumentation"
+	}
+
+	return "the failing instruction is part of the original program. If the program loads without instrumentation, " +
+		"the instrumentation overwrote a register or stack slot in use. Use the verifier or cross-check analysis, or " +
+		"exclude the function with a filter"
+}
@@ -0,0 +1,134 @@
+package coverbee
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestDiagnoseVerifierError(t *testing.T) {
+	// Two original instructions with a counter increment of three instructions in front of each.
+	prog := &instrumentedProgram{
+		stackSlots: map[string][]int{"main": {16, 24, 8}},
+	}
+	for original := 0; original < 2; original++ {
+		for i := 0; i < 3; i++ {
+			prog.origins = append(prog.origins, instructionOrigin{
+				original:        original,
+				instrumentation: true,
+				function:        "main",
+			})
+		}
+		prog.origins = append(prog.origins, instructionOrigin{original: original, function: "main"})
+	}
+	instrumentation := &Instrumentation{programs: map[string]*instrumentedProgram{"main": prog}}
+
+	loadError := func(cause error, log ...string) error {
+		return fmt.Errorf("program main: %w", &ebpf.VerifierError{Cause: cause, Log: log})
+	}
+
+	tests := []struct {
+		name              string
+		err               error
+		kind              VerifierFailureKind
+		instruction       int
+		original          int
+		inInstrumentation bool
+	}{
+		{
+			name: "Invalid stack read",
+			err: loadError(syscall.EACCES,
+				"0: (79) r8 = *(u64 *)(r10 -8)",
+				"1: (69) r9 = *(u16 *)(r8 +0)",
+				"R8 invalid mem access 'scalar'",
+				"processed 2 insns (limit 1000000) max_states_per_insn 0 total_states 0 peak_states 0 mark_read 0",
+			),
+			kind:              VerifierFailureInvalidStackRead,
+			instruction:       1,
+			original:          0,
+			inInstrumentation: true,
+		},
+		{
+			name: "Uninitialized coverage slot",
+			err: loadError(syscall.EACCES,
+				"4: (79) r8 = *(u64 *)(r10 -16)",
+				"invalid read from stack off -16+0 size 8",
+			),
+			kind:              VerifierFailureInvalidStackRead,
+			instruction:       4,
+			original:          1,
+			inInstrumentation: true,
+		},
+		{
+			name: "Combined stack size",
+			err: loadError(syscall.EACCES,
+				"combined stack size of 3 calls is 528. Too large",
+				"processed 10 insns (limit 1000000) max_states_per_insn 0 total_states 1 peak_states 1 mark_read 0",
+			),
+			kind:        VerifierFailureStackTooLarge,
+			instruction: -1,
+			original:    -1,
+		},
+		{
+			name: "Processed instructions",
+			err: loadError(syscall.E2BIG,
+				"3: (07) r1 += 1",
+				"BPF program is too large. Processed 1000001 insn",
+			),
+			kind:        VerifierFailureInstructionLimit,
+			instruction: 3,
+			original:    0,
+		},
+		{
+			name: "Jump sequence",
+			err: loadError(syscall.EACCES,
+				"7: (15) if r1 == 0x0 goto pc+1",
+				"The sequence of 8193 jumps is too complex.",
+			),
+			kind:        VerifierFailureComplexityLimit,
+			instruction: 7,
+			original:    1,
+		},
+		{
+			name: "Original instruction",
+			err: loadError(syscall.EACCES,
+				"7: (69) r1 = *(u16 *)(r1 +2)",
+				"R1 offset is outside of the packet",
+			),
+			kind:        VerifierFailureUnknown,
+			instruction: 7,
+			original:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failure := instrumentation.DiagnoseVerifierError(tt.err)
+			if failure == nil {
+				t.Fatal("no diagnosis")
+			}
+
+			if failure.Kind != tt.kind {
+				t.Errorf("kind = %s, want %s", failure.Kind, tt.kind)
+			}
+			if failure.Instruction != tt.instruction || failure.OriginalInstruction != tt.original {
+				t.Errorf("instruction %d (original %d), want %d (original %d)",
+					failure.Instruction, failure.OriginalInstruction, tt.instruction, tt.original)
+			}
+			if failure.InInstrumentation != tt.inInstrumentation {
+				t.Errorf("in instrumentation = %v, want %v", failure.InInstrumentation, tt.inInstrumentation)
+			}
+			if failure.Suggestion == "" {
+				t.Error("no suggestion")
+			}
+			if failure.Unwrap() != tt.err {
+				t.Error("failure doesn't wrap the load error")
+			}
+		})
+	}
+
+	if instrumentation.DiagnoseVerifierError(fmt.Errorf("program other: %w", &ebpf.VerifierError{})) != nil {
+		t.Error("diagnosed a program which wasn't instrumented")
+	}
+}
@@ -0,0 +1,1071 @@
+package coverbee
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+)
+
+// Relocation types of the BPF ELF ABI, these are not defined in debug/elf.
+const (
+	relBPF64_64 = 1  // Relocation of a 64-bit immediate load, used for map and function pointers.
+	relBPF64_32 = 10 // Relocation of the 32-bit immediate of a call instruction.
+)
+
+// WriteCollectionELF writes the programs and maps of the given collection spec to `w` as a BPF ELF object file, which
+// can be loaded by any loader like libbpf, iproute2 or cilium/ebpf. This is typically used after
+// `InstrumentCollection` to store the instrumented programs, so they can be loaded by other tooling.
+//
+// All bpf-to-bpf functions are placed in the .text section and every program in the section given by its
+// `SectionName`, loaders derive the program type from this section name. Maps are written as BTF map definitions in
+// the .maps section, including their pinning type, global data is written to its original data section. Function and
+// line info are preserved in the .BTF.ext section.
+//
+// CO-RE relocations, kfunc calls, map-in-map definitions and initial map contents are not supported.
+func WriteCollectionELF(coll *ebpf.CollectionSpec, w io.Writer) error {
+	bo := coll.ByteOrder
+	if bo == nil {
+		bo = nativeEndianess()
+	}
+
+	ew := &elfWriter{
+		bo:      bo,
+		strings: map[string]uint32{"": 0},
+		strtab:  []byte{0},
+	}
+
+	if err := ew.addPrograms(coll.Programs); err != nil {
+		return err
+	}
+	if err := ew.addMaps(coll.Maps); err != nil {
+		return err
+	}
+	if err := ew.addLicense(coll.Programs); err != nil {
+		return err
+	}
+	ew.addSymbols()
+	if err := ew.encodePrograms(); err != nil {
+		return err
+	}
+	if err := ew.addBTF(); err != nil {
+		return err
+	}
+	ew.addRelocationSections()
+
+	return ew.write(w)
+}
+
+// elfFunction is a single BPF function, either a program or a bpf-to-bpf function, as written to an ELF section.
+type elfFunction struct {
+	// The program which contains the function and the name of the function in its instructions.
+	prog string
+	name string
+	// The name of the ELF symbol, which differs from `name` if multiple programs contain a copy of the function.
+	symbol string
+	insns  asm.Instructions
+	// The section of the function and its offset from the start of that section in bytes.
+	section *elfSection
+	offset  uint64
+	global  bool
+	// All functions of the program this function is part of, indexed by name.
+	progFuncs map[string]*elfFunction
+}
+
+type elfSection struct {
+	name    string
+	typ     elf.SectionType
+	flags   elf.SectionFlag
+	data    []byte
+	size    uint64
+	link    uint32
+	info    uint32
+	align   uint64
+	entsize uint64
+	index   int
+
+	// The functions in a code section.
+	funcs []*elfFunction
+	// The relocations of the instructions in a code section.
+	relocations []elf.Rel64
+	// The symbol of the section itself, used for relocations relative to the start of the section.
+	symbol int
+}
+
+type elfSymbol struct {
+	name    string
+	section *elfSection
+	value   uint64
+	size    uint64
+	bind    elf.SymBind
+	typ     elf.SymType
+}
+
+type elfWriter struct {
+	bo binary.ByteOrder
+
+	// The string table, which holds the names of both sections and symbols.
+	strtab  []byte
+	strings map[string]uint32
+
+	sections     []*elfSection
+	codeSections []*elfSection
+	text         *elfSection
+	// The data sections, indexed by map name.
+	dataSections map[string]*elfSection
+	mapsSection  *elfSection
+
+	// The names of all maps in the .maps section, with their BTF map definition and offset in the section.
+	mapNames   []string
+	mapSpecs   map[string]*ebpf.MapSpec
+	mapDefs    map[string]*btf.Struct
+	mapOffsets map[string]uint64
+
+	symbols []elfSymbol
+	// The index of the first global symbol, all symbols before it are local.
+	firstGlobal int
+	// The symbol indices of all maps, indexed by name.
+	mapSymbols map[string]int
+}
+
+func (ew *elfWriter) addString(str string) uint32 {
+	if off, ok := ew.strings[str]; ok {
+		return off
+	}
+
+	off := uint32(len(ew.strtab))
+	ew.strtab = append(ew.strtab, str...)
+	ew.strtab = append(ew.strtab, 0)
+	ew.strings[str] = off
+
+	return off
+}
+
+func (ew *elfWriter) addSection(sec *elfSection) *elfSection {
+	// Index 0 is the reserved null section
+	sec.index = len(ew.sections) + 1
+	ew.sections = append(ew.sections, sec)
+	return sec
+}
+
+// addPrograms splits all programs into functions and lays them out over the code sections. Programs are placed in the
+// section of their `SectionName`, their bpf-to-bpf functions in .text.
+func (ew *elfWriter) addPrograms(progs map[string]*ebpf.ProgramSpec) error {
+	progNames := make([]string, 0, len(progs))
+	for name := range progs {
+		progNames = append(progNames, name)
+	}
+	sort.Strings(progNames)
+
+	var (
+		entries      = make(map[string][]*elfFunction)
+		sectionNames []string
+		subFuncs     []*elfFunction
+		funcCount    = make(map[string]int)
+	)
+	for _, name := range progNames {
+		prog := progs[name]
+		if prog.SectionName == "" || prog.SectionName == ".text" {
+			return fmt.Errorf("program '%s' has no section name", name)
+		}
+
+		funcs, err := splitProgramFunctions(name, prog.Instructions)
+		if err != nil {
+			return fmt.Errorf("program '%s': %w", name, err)
+		}
+
+		if _, ok := entries[prog.SectionName]; !ok {
+			sectionNames = append(sectionNames, prog.SectionName)
+		}
+		entries[prog.SectionName] = append(entries[prog.SectionName], funcs[0])
+		funcCount[name]++
+
+		for _, fn := range funcs[1:] {
+			subFuncs = append(subFuncs, fn)
+			funcCount[fn.name]++
+		}
+	}
+
+	// Every program contains its own, differently instrumented, copy of the functions it calls. Give the copies
+	// unique symbols if a function is used by multiple programs.
+	for _, fn := range subFuncs {
+		fn.symbol = fn.name
+		if funcCount[fn.name] > 1 {
+			fn.symbol = fmt.Sprintf("%s.%s", fn.prog, fn.name)
+		}
+	}
+
+	if len(subFuncs) > 0 {
+		ew.text = ew.addCodeSection(".text", subFuncs)
+	}
+
+	sort.Strings(sectionNames)
+	for _, secName := range sectionNames {
+		ew.addCodeSection(secName, entries[secName])
+	}
+
+	return nil
+}
+
+func (ew *elfWriter) addCodeSection(name string, funcs []*elfFunction) *elfSection {
+	sec := ew.addSection(&elfSection{
+		name:  name,
+		typ:   elf.SHT_PROGBITS,
+		flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR,
+		align: 8,
+		funcs: funcs,
+	})
+
+	for _, fn := range funcs {
+		fn.section = sec
+		fn.offset = sec.size
+		sec.size += fn.insns.Size()
+	}
+
+	ew.codeSections = append(ew.codeSections, sec)
+
+	return sec
+}
+
+// splitProgramFunctions splits the instructions of a program into the program function and the bpf-to-bpf functions
+// it references. The first function is always the program itself.
+func splitProgramFunctions(name string, insns asm.Instructions) ([]*elfFunction, error) {
+	if len(insns) == 0 {
+		return nil, errors.New("no instructions")
+	}
+
+	referenced := make(map[string]bool)
+	for _, inst := range insns {
+		if inst.IsFunctionReference() {
+			referenced[inst.Reference()] = true
+		}
+	}
+
+	progFuncs := make(map[string]*elfFunction)
+	funcs := []*elfFunction{{
+		prog:      name,
+		name:      name,
+		symbol:    name,
+		global:    true,
+		progFuncs: progFuncs,
+	}}
+	progFuncs[name] = funcs[0]
+	// The program symbol refers to the program function, even if it differs from the name of the program.
+	if sym := insns[0].Symbol(); sym != "" {
+		progFuncs[sym] = funcs[0]
+	}
+
+	for i, inst := range insns {
+		sym := inst.Symbol()
+		if i > 0 && referenced[sym] {
+			if progFuncs[sym] != nil {
+				return nil, fmt.Errorf("duplicate function '%s'", sym)
+			}
+
+			fn := &elfFunction{
+				prog:      name,
+				name:      sym,
+				progFuncs: progFuncs,
+			}
+			if fnType := btf.FuncMetadata(&inst); fnType != nil && fnType.Linkage == btf.GlobalFunc {
+				fn.global = true
+			}
+			progFuncs[sym] = fn
+			funcs = append(funcs, fn)
+		}
+
+		fn := funcs[len(funcs)-1]
+		fn.insns = append(fn.insns, inst)
+	}
+
+	for sym := range referenced {
+		if progFuncs[sym] == nil {
+			return nil, fmt.Errorf("reference to unknown function '%s'", sym)
+		}
+	}
+
+	return funcs, nil
+}
+
+// addMaps adds a data section for every global data map and a BTF map definition in the .maps section for all other
+// maps.
+func (ew *elfWriter) addMaps(maps map[string]*ebpf.MapSpec) error {
+	ew.mapSpecs = maps
+	ew.dataSections = make(map[string]*elfSection)
+	ew.mapDefs = make(map[string]*btf.Struct)
+	ew.mapOffsets = make(map[string]uint64)
+
+	names := make([]string, 0, len(maps))
+	for name := range maps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		intType  = &btf.Int{Name: "int", Size: 4, Encoding: btf.Signed}
+		mapsSize uint64
+	)
+	for _, name := range names {
+		m := maps[name]
+		if m.InnerMap != nil {
+			return fmt.Errorf("map '%s': map-in-map definitions are not supported", name)
+		}
+
+		// Global data maps are named after their section, which can't clash with C identifiers.
+		if strings.HasPrefix(name, ".") {
+			sec, err := dataSection(name, m)
+			if err != nil {
+				return fmt.Errorf("map '%s': %w", name, err)
+			}
+			ew.dataSections[name] = ew.addSection(sec)
+			continue
+		}
+
+		if len(m.Contents) > 0 {
+			return fmt.Errorf("map '%s': initial map contents are not supported", name)
+		}
+
+		def := mapDefinition(m, intType)
+		ew.mapNames = append(ew.mapNames, name)
+		ew.mapDefs[name] = def
+		ew.mapOffsets[name] = mapsSize
+		mapsSize += uint64(def.Size)
+	}
+
+	if len(ew.mapNames) > 0 {
+		ew.mapsSection = ew.addSection(&elfSection{
+			name:  ".maps",
+			typ:   elf.SHT_PROGBITS,
+			flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+			data:  make([]byte, mapsSize),
+			align: 8,
+		})
+	}
+
+	return nil
+}
+
+// dataSection returns the ELF section of a global data map.
+func dataSection(name string, m *ebpf.MapSpec) (*elfSection, error) {
+	if m.Type != ebpf.Array || m.MaxEntries != 1 {
+		return nil, fmt.Errorf("global data must be an array with a single entry")
+	}
+
+	sec := &elfSection{
+		name:  name,
+		typ:   elf.SHT_NOBITS,
+		flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+		size:  uint64(m.ValueSize),
+		align: 8,
+	}
+	if strings.HasPrefix(name, ".rodata") {
+		sec.flags = elf.SHF_ALLOC
+	}
+
+	switch len(m.Contents) {
+	case 0:
+	case 1:
+		data, ok := m.Contents[0].Value.([]byte)
+		if !ok || len(data) != int(m.ValueSize) {
+			return nil, fmt.Errorf("contents of global data must be a byte slice of the value size")
+		}
+		sec.typ = elf.SHT_PROGBITS
+		sec.data = data
+	default:
+		return nil, fmt.Errorf("global data can only have a single entry")
+	}
+
+	return sec, nil
+}
+
+func (ew *elfWriter) addLicense(progs map[string]*ebpf.ProgramSpec) error {
+	var (
+		license       string
+		kernelVersion uint32
+	)
+	for name, prog := range progs {
+		if license != "" && prog.License != license {
+			return fmt.Errorf("program '%s' has license '%s', other programs have license '%s'",
+				name, prog.License, license)
+		}
+		license = prog.License
+
+		if prog.KernelVersion > kernelVersion {
+			kernelVersion = prog.KernelVersion
+		}
+	}
+
+	if license != "" {
+		ew.addSection(&elfSection{
+			name:  "license",
+			typ:   elf.SHT_PROGBITS,
+			flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+			data:  append([]byte(license), 0),
+			align: 1,
+		})
+	}
+
+	if kernelVersion != 0 {
+		data := make([]byte, 4)
+		ew.bo.PutUint32(data, kernelVersion)
+		ew.addSection(&elfSection{
+			name:  "version",
+			typ:   elf.SHT_PROGBITS,
+			flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+			data:  data,
+			align: 4,
+		})
+	}
+
+	return nil
+}
+
+// addSymbols adds symbols for all sections, functions, global variables and maps. Local symbols must precede all
+// global symbols in the symbol table.
+func (ew *elfWriter) addSymbols() {
+	var locals, globals []elfSymbol
+
+	for _, sec := range ew.sections {
+		sec.symbol = len(locals) + 1
+		locals = append(locals, elfSymbol{
+			section: sec,
+			bind:    elf.STB_LOCAL,
+			typ:     elf.STT_SECTION,
+		})
+	}
+
+	for _, sec := range ew.codeSections {
+		for _, fn := range sec.funcs {
+			sym := elfSymbol{
+				name:    fn.symbol,
+				section: sec,
+				value:   fn.offset,
+				size:    fn.insns.Size(),
+				bind:    elf.STB_LOCAL,
+				typ:     elf.STT_FUNC,
+			}
+			if fn.global {
+				sym.bind = elf.STB_GLOBAL
+				globals = append(globals, sym)
+			} else {
+				locals = append(locals, sym)
+			}
+		}
+	}
+
+	dataNames := make([]string, 0, len(ew.dataSections))
+	for name := range ew.dataSections {
+		dataNames = append(dataNames, name)
+	}
+	sort.Strings(dataNames)
+
+	for _, name := range dataNames {
+		ds, ok := ew.mapSpecs[name].Value.(*btf.Datasec)
+		if !ok {
+			continue
+		}
+
+		for _, vsi := range ds.Vars {
+			v, ok := vsi.Type.(*btf.Var)
+			if !ok || v.Name == "" {
+				continue
+			}
+
+			sym := elfSymbol{
+				name:    v.Name,
+				section: ew.dataSections[name],
+				value:   uint64(vsi.Offset),
+				size:    uint64(vsi.Size),
+				bind:    elf.STB_LOCAL,
+				typ:     elf.STT_OBJECT,
+			}
+			if v.Linkage == btf.GlobalVar {
+				sym.bind = elf.STB_GLOBAL
+				globals = append(globals, sym)
+			} else {
+				locals = append(locals, sym)
+			}
+		}
+	}
+
+	ew.firstGlobal = len(locals) + 1
+	ew.mapSymbols = make(map[string]int)
+	for _, name := range ew.mapNames {
+		ew.mapSymbols[name] = ew.firstGlobal + len(globals)
+		globals = append(globals, elfSymbol{
+			name:    name,
+			section: ew.mapsSection,
+			value:   ew.mapOffsets[name],
+			size:    uint64(ew.mapDefs[name].Size),
+			bind:    elf.STB_GLOBAL,
+			typ:     elf.STT_OBJECT,
+		})
+	}
+
+	ew.symbols = append(locals, globals...)
+}
+
+// encodePrograms encodes the instructions of all code sections. Jumps are resolved within each function, references
+// to other functions, maps and global data are turned into relocations.
+func (ew *elfWriter) encodePrograms() error {
+	for _, sec := range ew.codeSections {
+		var buf bytes.Buffer
+		for _, fn := range sec.funcs {
+			if err := ew.encodeFunction(&buf, sec, fn); err != nil {
+				return fmt.Errorf("function '%s': %w", fn.symbol, err)
+			}
+		}
+		sec.data = buf.Bytes()
+	}
+
+	return nil
+}
+
+func (ew *elfWriter) encodeFunction(buf *bytes.Buffer, sec *elfSection, fn *elfFunction) error {
+	insns := make(asm.Instructions, len(fn.insns))
+	copy(insns, fn.insns)
+
+	if err := resolveJumps(insns); err != nil {
+		return err
+	}
+
+	iter := insns.Iterate()
+	for iter.Next() {
+		ins := iter.Ins
+		offset := fn.offset + iter.Offset.Bytes()
+
+		if btf.CORERelocationMetadata(ins) != nil {
+			return fmt.Errorf("instruction %d: CO-RE relocations are not supported", iter.Index)
+		}
+
+		switch {
+		case ins.IsKfuncCall():
+			return fmt.Errorf("instruction %d: kfunc calls are not supported", iter.Index)
+
+		case ins.IsFunctionReference():
+			// Only bpf-to-bpf functions in .text can be referenced, not programs.
+			callee := fn.progFuncs[ins.Reference()]
+			if callee == nil || callee.section != ew.text {
+				return fmt.Errorf("instruction %d: reference to '%s' which is not a bpf-to-bpf function",
+					iter.Index, ins.Reference())
+			}
+
+			relType := uint32(relBPF64_64)
+			if ins.IsFunctionCall() {
+				// Calls are relative to the next instruction, in units of instructions.
+				ins.Constant = int64(callee.offset/asm.InstructionSize) - 1
+				relType = relBPF64_32
+			} else {
+				ins.Constant = int64(callee.offset)
+				ins.Src = asm.R0
+			}
+			sec.relocations = append(sec.relocations, elf.Rel64{
+				Off:  offset,
+				Info: elf.R_INFO(uint32(ew.text.symbol), relType),
+			})
+
+		case ins.IsLoadFromMap():
+			name := ins.Reference()
+			if dataSec, ok := ew.dataSections[name]; ok {
+				if ins.Src != asm.PseudoMapValue {
+					return fmt.Errorf("instruction %d: pointer to global data '%s' is not supported", iter.Index, name)
+				}
+				// The offset into the data section is stored in the upper 32 bits of the constant, the ELF
+				// expects it in the instruction, relative to the section symbol.
+				ins.Constant = int64(uint64(ins.Constant) >> 32)
+				ins.Src = asm.R0
+				sec.relocations = append(sec.relocations, elf.Rel64{
+					Off:  offset,
+					Info: elf.R_INFO(uint32(dataSec.symbol), relBPF64_64),
+				})
+				break
+			}
+
+			symbol, ok := ew.mapSymbols[name]
+			if !ok {
+				return fmt.Errorf("instruction %d: reference to unknown map '%s'", iter.Index, name)
+			}
+			if ins.Src != asm.PseudoMapFD {
+				return fmt.Errorf("instruction %d: direct value access of map '%s' is not supported", iter.Index, name)
+			}
+			ins.Constant = 0
+			ins.Src = asm.R0
+			sec.relocations = append(sec.relocations, elf.Rel64{
+				Off:  offset,
+				Info: elf.R_INFO(uint32(symbol), relBPF64_64),
+			})
+
+		case ins.OpCode.IsDWordLoad() && ins.Reference() != "":
+			return fmt.Errorf("instruction %d: unsupported reference to '%s'", iter.Index, ins.Reference())
+		}
+
+		if _, err := ins.Marshal(buf, ew.bo); err != nil {
+			return fmt.Errorf("instruction %d: %w", iter.Index, err)
+		}
+	}
+
+	return nil
+}
+
+// resolveJumps sets the offset of all jumps which reference a symbol in the given function, the same way the
+// cilium/ebpf linker does when loading a program.
+func resolveJumps(insns asm.Instructions) error {
+	symbols := make(map[string]asm.RawInstructionOffset)
+	iter := insns.Iterate()
+	for iter.Next() {
+		if sym := iter.Ins.Symbol(); sym != "" {
+			symbols[sym] = iter.Offset
+		}
+	}
+
+	iter = insns.Iterate()
+	for iter.Next() {
+		ins := iter.Ins
+		if ins.Reference() == "" || !ins.OpCode.Class().IsJump() || ins.OpCode.JumpOp() == asm.Call {
+			continue
+		}
+
+		target, ok := symbols[ins.Reference()]
+		if !ok {
+			return fmt.Errorf("instruction %d: jump to unknown symbol '%s'", iter.Index, ins.Reference())
+		}
+		delta := int64(target) - int64(iter.Offset) - 1
+
+		// A 32-bit unconditional jump stores its offset in the constant
+		if ins.OpCode.Class() == asm.Jump32Class && ins.OpCode.JumpOp() == asm.Ja {
+			if ins.Constant == -1 {
+				ins.Constant = delta
+			}
+			continue
+		}
+
+		if ins.Offset != -1 {
+			continue
+		}
+		if delta < math.MinInt16 || delta > math.MaxInt16 {
+			return fmt.Errorf("instruction %d: jump to '%s' is out of range", iter.Index, ins.Reference())
+		}
+		ins.Offset = int16(delta)
+	}
+
+	return nil
+}
+
+// mapDefinition returns the BTF map definition of the given map, as defined by the __uint and __type macros of libbpf.
+// Integer attributes are encoded as a pointer to an array with the value as number of elements, types as a pointer to
+// the type.
+func mapDefinition(m *ebpf.MapSpec, intType *btf.Int) *btf.Struct {
+	def := &btf.Struct{}
+	addType := func(name string, typ btf.Type) {
+		def.Members = append(def.Members, btf.Member{
+			Name:   name,
+			Type:   &btf.Pointer{Target: typ},
+			Offset: btf.Bits(64 * len(def.Members)),
+		})
+	}
+	addUint := func(name string, value uint32) {
+		addType(name, &btf.Array{Index: intType, Type: intType, Nelems: value})
+	}
+
+	addUint("type", uint32(m.Type))
+
+	if hasBTFType(m.Key) {
+		addType("key", m.Key)
+	} else if m.KeySize != 0 {
+		addUint("key_size", m.KeySize)
+	}
+
+	if hasBTFType(m.Value) {
+		addType("value", m.Value)
+	} else if m.ValueSize != 0 {
+		addUint("value_size", m.ValueSize)
+	}
+
+	if m.MaxEntries != 0 {
+		addUint("max_entries", m.MaxEntries)
+	}
+
+	if m.Flags != 0 {
+		addUint("map_flags", m.Flags)
+	}
+
+	if m.NumaNode != 0 {
+		addUint("numa_node", m.NumaNode)
+	}
+
+	if m.Pinning != ebpf.PinNone {
+		addUint("pinning", uint32(m.Pinning))
+	}
+
+	def.Size = uint32(8 * len(def.Members))
+
+	return def
+}
+
+func hasBTFType(typ btf.Type) bool {
+	if typ == nil {
+		return false
+	}
+	_, isVoid := typ.(*btf.Void)
+	return !isVoid
+}
+
+// elfExtInfo is the function and line info of a code section in kernel wire format.
+type elfExtInfo struct {
+	section   string
+	funcInfos []byte
+	lineInfos []byte
+}
+
+// addBTF adds the .BTF section, containing the map definitions, global data and function types, and the .BTF.ext
+// section with the function and line info of all code sections.
+func (ew *elfWriter) addBTF() error {
+	var b btf.Builder
+
+	if ew.mapsSection != nil {
+		maps := &btf.Datasec{
+			Name: ".maps",
+			Size: uint32(len(ew.mapsSection.data)),
+		}
+		for _, name := range ew.mapNames {
+			def := ew.mapDefs[name]
+			maps.Vars = append(maps.Vars, btf.VarSecinfo{
+				Type:   &btf.Var{Name: name, Type: def, Linkage: btf.GlobalVar},
+				Offset: uint32(ew.mapOffsets[name]),
+				Size:   def.Size,
+			})
+		}
+
+		if _, err := b.Add(maps); err != nil {
+			return fmt.Errorf("add map definitions to BTF: %w", err)
+		}
+	}
+
+	for _, sec := range ew.sections {
+		m, ok := ew.mapSpecs[sec.name]
+		if !ok || ew.dataSections[sec.name] != sec {
+			continue
+		}
+
+		if ds, ok := m.Value.(*btf.Datasec); ok {
+			if _, err := b.Add(ds); err != nil {
+				return fmt.Errorf("add %s to BTF: %w", sec.name, err)
+			}
+		}
+	}
+
+	var extInfos []elfExtInfo
+	for _, sec := range ew.codeSections {
+		var insns asm.Instructions
+		for _, fn := range sec.funcs {
+			insns = append(insns, fn.insns...)
+		}
+
+		funcInfos, lineInfos, err := btf.MarshalExtInfos(insns, &b)
+		if err != nil {
+			return fmt.Errorf("section %s: %w", sec.name, err)
+		}
+		if funcInfos != nil || lineInfos != nil {
+			extInfos = append(extInfos, elfExtInfo{
+				section:   sec.name,
+				funcInfos: funcInfos,
+				lineInfos: lineInfos,
+			})
+		}
+	}
+
+	raw, err := b.Marshal(nil, &btf.MarshalOptions{Order: ew.bo})
+	if err != nil {
+		return fmt.Errorf("marshal BTF: %w", err)
+	}
+
+	// The ext info refers to sections by name, which isn't part of any type. So the names are added to the end of
+	// the string table of the BTF.
+	sectionNames := make([]string, 0, len(extInfos))
+	for _, info := range extInfos {
+		sectionNames = append(sectionNames, info.section)
+	}
+	raw, nameOffsets, err := appendBTFStrings(raw, ew.bo, sectionNames)
+	if err != nil {
+		return err
+	}
+
+	ew.addSection(&elfSection{
+		name:  ".BTF",
+		typ:   elf.SHT_PROGBITS,
+		data:  raw,
+		align: 4,
+	})
+
+	if len(extInfos) > 0 {
+		ew.addSection(&elfSection{
+			name:  ".BTF.ext",
+			typ:   elf.SHT_PROGBITS,
+			data:  ew.marshalBTFExt(extInfos, nameOffsets),
+			align: 4,
+		})
+	}
+
+	return nil
+}
+
+// btfHeader is the header of raw BTF.
+type btfHeader struct {
+	Magic     uint16
+	Version   uint8
+	Flags     uint8
+	HdrLen    uint32
+	TypeOff   uint32
+	TypeLen   uint32
+	StringOff uint32
+	StringLen uint32
+}
+
+// appendBTFStrings appends strings to the string table of the raw BTF, which must be at the end of the BTF. It returns
+// the updated BTF and the offsets of the strings.
+func appendBTFStrings(raw []byte, bo binary.ByteOrder, strs []string) ([]byte, []uint32, error) {
+	var hdr btfHeader
+	if err := binary.Read(bytes.NewReader(raw), bo, &hdr); err != nil {
+		return nil, nil, fmt.Errorf("read BTF header: %w", err)
+	}
+
+	if uint64(hdr.HdrLen)+uint64(hdr.StringOff)+uint64(hdr.StringLen) != uint64(len(raw)) {
+		return nil, nil, errors.New("string table isn't at the end of the BTF")
+	}
+
+	offsets := make([]uint32, 0, len(strs))
+	for _, str := range strs {
+		offsets = append(offsets, hdr.StringLen)
+		raw = append(raw, str...)
+		raw = append(raw, 0)
+		hdr.StringLen += uint32(len(str) + 1)
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, bo, &hdr); err != nil {
+		return nil, nil, fmt.Errorf("write BTF header: %w", err)
+	}
+	copy(raw, buf.Bytes())
+
+	return raw, offsets, nil
+}
+
+// marshalBTFExt returns the .BTF.ext section for the given ext info. The kernel wire format only differs from the
+// ELF format in that instruction offsets are in bytes instead of instructions.
+func (ew *elfWriter) marshalBTFExt(extInfos []elfExtInfo, nameOffsets []uint32) []byte {
+	const (
+		funcInfoSize = 8
+		lineInfoSize = 16
+	)
+
+	var funcs, lines bytes.Buffer
+	ew.putUint32(&funcs, funcInfoSize)
+	ew.putUint32(&lines, lineInfoSize)
+	for i, info := range extInfos {
+		for _, sub := range []struct {
+			buf     *bytes.Buffer
+			records []byte
+			size    int
+		}{
+			{&funcs, info.funcInfos, funcInfoSize},
+			{&lines, info.lineInfos, lineInfoSize},
+		} {
+			if len(sub.records) == 0 {
+				continue
+			}
+
+			ew.putUint32(sub.buf, nameOffsets[i])
+			ew.putUint32(sub.buf, uint32(len(sub.records)/sub.size))
+			for off := 0; off < len(sub.records); off += 4 {
+				// The records are marshalled in native endianness for the kernel.
+				value := nativeEndianess().Uint32(sub.records[off:])
+				if off%sub.size == 0 {
+					value *= asm.InstructionSize
+				}
+				ew.putUint32(sub.buf, value)
+			}
+		}
+	}
+
+	// The header includes the offset and length of CO-RE relocations, which are always empty. Some loaders expect
+	// them to be present.
+	const hdrLen = 32
+	var buf bytes.Buffer
+	// Magic, version and flags
+	ew.putUint16(&buf, 0xeB9F)
+	buf.Write([]byte{1, 0})
+	ew.putUint32(&buf, hdrLen)
+	// Offset and length of the func info, line info and CO-RE relocations
+	ew.putUint32(&buf, 0)
+	ew.putUint32(&buf, uint32(funcs.Len()))
+	ew.putUint32(&buf, uint32(funcs.Len()))
+	ew.putUint32(&buf, uint32(lines.Len()))
+	ew.putUint32(&buf, uint32(funcs.Len()+lines.Len()))
+	ew.putUint32(&buf, 0)
+	buf.Write(funcs.Bytes())
+	buf.Write(lines.Bytes())
+
+	return buf.Bytes()
+}
+
+func (ew *elfWriter) putUint16(buf *bytes.Buffer, value uint16) {
+	var b [2]byte
+	ew.bo.PutUint16(b[:], value)
+	buf.Write(b[:])
+}
+
+func (ew *elfWriter) putUint32(buf *bytes.Buffer, value uint32) {
+	var b [4]byte
+	ew.bo.PutUint32(b[:], value)
+	buf.Write(b[:])
+}
+
+// addRelocationSections adds a relocation section for every code section with relocations.
+func (ew *elfWriter) addRelocationSections() {
+	for _, sec := range ew.codeSections {
+		if len(sec.relocations) == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+		for _, rel := range sec.relocations {
+			binary.Write(&buf, ew.bo, rel) //nolint:errcheck // Writing to a bytes.Buffer can't fail
+		}
+
+		ew.addSection(&elfSection{
+			name:    ".rel" + sec.name,
+			typ:     elf.SHT_REL,
+			data:    buf.Bytes(),
+			info:    uint32(sec.index),
+			align:   8,
+			entsize: uint64(binary.Size(elf.Rel64{})),
+		})
+	}
+}
+
+// write adds the symbol and string tables and writes the ELF file.
+func (ew *elfWriter) write(w io.Writer) error {
+	symtab := ew.addSection(&elfSection{
+		name:    ".symtab",
+		typ:     elf.SHT_SYMTAB,
+		info:    uint32(ew.firstGlobal),
+		align:   8,
+		entsize: uint64(binary.Size(elf.Sym64{})),
+	})
+	strtab := ew.addSection(&elfSection{
+		name:  ".strtab",
+		typ:   elf.SHT_STRTAB,
+		align: 1,
+	})
+	symtab.link = uint32(strtab.index)
+
+	// The first symbol is the reserved undefined symbol
+	syms := make([]elf.Sym64, 1, len(ew.symbols)+1)
+	for _, sym := range ew.symbols {
+		syms = append(syms, elf.Sym64{
+			Name:  ew.addString(sym.name),
+			Info:  elf.ST_INFO(sym.bind, sym.typ),
+			Shndx: uint16(sym.section.index),
+			Value: sym.value,
+			Size:  sym.size,
+		})
+	}
+	var symBuf bytes.Buffer
+	if err := binary.Write(&symBuf, ew.bo, syms); err != nil {
+		return fmt.Errorf("write symbols: %w", err)
+	}
+	symtab.data = symBuf.Bytes()
+
+	nameOffsets := make([]uint32, len(ew.sections))
+	for i, sec := range ew.sections {
+		nameOffsets[i] = ew.addString(sec.name)
+		if sec.typ == elf.SHT_REL {
+			sec.link = uint32(symtab.index)
+		}
+	}
+	strtab.data = ew.strtab
+
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	if ew.bo.Uint16([]byte{0, 1}) == 1 {
+		ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	header := elf.Header64{
+		Ident:     ident,
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_BPF),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     uint16(len(ew.sections) + 1),
+		Shstrndx:  uint16(strtab.index),
+	}
+
+	// Lay out the section contents after the ELF header, followed by the section headers.
+	var body bytes.Buffer
+	offset := uint64(header.Ehsize)
+	sectionHeaders := make([]elf.Section64, 1, len(ew.sections)+1)
+	for i, sec := range ew.sections {
+		if pad := alignUp(offset, sec.align) - offset; pad > 0 && sec.typ != elf.SHT_NOBITS {
+			body.Write(make([]byte, pad))
+			offset += pad
+		}
+
+		size := uint64(len(sec.data))
+		if sec.typ == elf.SHT_NOBITS {
+			size = sec.size
+		}
+
+		sectionHeaders = append(sectionHeaders, elf.Section64{
+			Name:      nameOffsets[i],
+			Type:      uint32(sec.typ),
+			Flags:     uint64(sec.flags),
+			Off:       offset,
+			Size:      size,
+			Link:      sec.link,
+			Info:      sec.info,
+			Addralign: sec.align,
+			Entsize:   sec.entsize,
+		})
+
+		if sec.typ != elf.SHT_NOBITS {
+			body.Write(sec.data)
+			offset += size
+		}
+	}
+
+	header.Shoff = alignUp(offset, 8)
+	body.Write(make([]byte, header.Shoff-offset))
+
+	if err := binary.Write(w, ew.bo, &header); err != nil {
+		return fmt.Errorf("write ELF header: %w", err)
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return fmt.Errorf("write sections: %w", err)
+	}
+	if err := binary.Write(w, ew.bo, sectionHeaders); err != nil {
+		return fmt.Errorf("write section headers: %w", err)
+	}
+
+	return nil
+}
+
+func alignUp(value, align uint64) uint64 {
+	if align <= 1 {
+		return value
+	}
+	return (value + align - 1) / align * align
+}
@@ -0,0 +1,255 @@
+package coverbee
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+)
+
+// TestWriteCollectionELF writes the instrumented example program to an ELF file and reads it back, the programs and
+// maps read from the ELF should match the instrumented collection.
+func TestWriteCollectionELF(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec("examples/bpf-to-bpf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InstrumentCollectionWithOptions(spec, InstrumentOptions{
+		Layout:       CoverMapLayout{Strategy: CounterStrategyShared},
+		VerifierLogs: map[string]string{},
+		Analysis:     AnalysisStatic,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Maps["coverbee_covermap"].Pinning = ebpf.PinByName
+
+	var buf bytes.Buffer
+	if err = WriteCollectionELF(spec, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, m := range spec.Maps {
+		wm := written.Maps[name]
+		if wm == nil {
+			t.Errorf("map '%s' is missing", name)
+			continue
+		}
+
+		if wm.Type != m.Type || wm.KeySize != m.KeySize || wm.ValueSize != m.ValueSize ||
+			wm.MaxEntries != m.MaxEntries || wm.Flags != m.Flags || wm.Pinning != m.Pinning {
+			t.Errorf("map '%s' differs, want %v, got %v", name, m, wm)
+		}
+	}
+
+	for name, prog := range spec.Programs {
+		wp := written.Programs[name]
+		if wp == nil {
+			t.Errorf("program '%s' is missing", name)
+			continue
+		}
+
+		if wp.SectionName != prog.SectionName || wp.License != prog.License {
+			t.Errorf("program '%s' has section '%s' and license '%s'", name, wp.SectionName, wp.License)
+		}
+
+		if len(wp.Instructions) != len(prog.Instructions) {
+			t.Fatalf("program '%s' has %d instructions, want %d", name, len(wp.Instructions), len(prog.Instructions))
+		}
+
+		for i := range prog.Instructions {
+			want, got := &prog.Instructions[i], &wp.Instructions[i]
+			if !sameInstruction(want, got) {
+				t.Errorf("program '%s' instruction %d: want %v, got %v", name, i, want, got)
+			}
+
+			if wantFn, gotFn := btf.FuncMetadata(want), btf.FuncMetadata(got); (wantFn == nil) != (gotFn == nil) ||
+				wantFn != nil && wantFn.Name != gotFn.Name {
+				t.Errorf("program '%s' instruction %d: want function %v, got %v", name, i, wantFn, gotFn)
+			}
+
+			if wantSrc, gotSrc := want.Source(), got.Source(); (wantSrc == nil) != (gotSrc == nil) ||
+				wantSrc != nil && wantSrc.String() != gotSrc.String() {
+				t.Errorf("program '%s' instruction %d: want source %v, got %v", name, i, wantSrc, gotSrc)
+			}
+		}
+	}
+}
+
+// sameInstruction returns true if both instructions are equal, ignoring jump offsets which are resolved from
+// references in the instrumented programs.
+func sameInstruction(want, got *asm.Instruction) bool {
+	if want.OpCode != got.OpCode || want.Dst != got.Dst || want.Src != got.Src {
+		return false
+	}
+
+	if want.OpCode.Class().IsJump() && want.Reference() != "" {
+		return want.IsFunctionCall() == got.IsFunctionCall() && (!want.IsFunctionCall() ||
+			want.Reference() == got.Reference())
+	}
+
+	if want.IsLoadFromMap() {
+		return want.Reference() == got.Reference() && want.Constant == got.Constant
+	}
+
+	return want.Offset == got.Offset && want.Constant == got.Constant
+}
+
+// TestWriteCollectionELFReferences writes a program with global data and a function pointer to an ELF file and checks
+// that the references survive reading it back.
+func TestWriteCollectionELFReferences(t *testing.T) {
+	answer := &btf.Var{
+		Name:    "answer",
+		Type:    &btf.Int{Name: "long long unsigned int", Size: 8},
+		Linkage: btf.GlobalVar,
+	}
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{
+			".rodata": {
+				Name:       ".rodata",
+				Type:       ebpf.Array,
+				KeySize:    4,
+				ValueSize:  16,
+				MaxEntries: 1,
+				Contents:   []ebpf.MapKV{{Key: uint32(0), Value: []byte{0, 0, 0, 0, 0, 0, 0, 0, 42, 0, 0, 0, 0, 0, 0, 0}}},
+				Key:        &btf.Void{},
+				Value: &btf.Datasec{
+					Name: ".rodata",
+					Size: 16,
+					Vars: []btf.VarSecinfo{{Type: answer, Offset: 8, Size: 8}},
+				},
+			},
+		},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"prog": {
+				Name:        "prog",
+				Type:        ebpf.SocketFilter,
+				SectionName: "socket",
+				License:     "MIT",
+				Instructions: asm.Instructions{
+					asm.LoadMapValue(asm.R1, 0, 8).WithReference(".rodata").WithSymbol("prog"),
+					asm.LoadMem(asm.R6, asm.R1, 0, asm.DWord),
+					asm.Mov.Imm(asm.R1, 1),
+					asm.Instruction{
+						OpCode:   asm.LoadImmOp(asm.DWord),
+						Dst:      asm.R2,
+						Src:      asm.PseudoFunc,
+						Constant: -1,
+					}.WithReference("callback"),
+					asm.Mov.Imm(asm.R3, 0),
+					asm.Mov.Imm(asm.R4, 0),
+					asm.FnLoop.Call(),
+					asm.JEq.Imm(asm.R6, 42, "exit"),
+					asm.Mov.Imm(asm.R0, 0),
+					asm.Return(),
+					asm.Mov.Imm(asm.R0, 1).WithSymbol("exit"),
+					asm.Return(),
+					asm.Mov.Imm(asm.R0, 0).WithSymbol("callback"),
+					asm.Return(),
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCollectionELF(spec, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rodata := written.Maps[".rodata"]
+	if rodata == nil || len(rodata.Contents) != 1 ||
+		!bytes.Equal(rodata.Contents[0].Value.([]byte), spec.Maps[".rodata"].Contents[0].Value.([]byte)) {
+		t.Fatalf("unexpected .rodata %v", rodata)
+	}
+
+	want := spec.Programs["prog"].Instructions
+	got := written.Programs["prog"].Instructions
+	if len(got) != len(want) {
+		t.Fatalf("got %d instructions, want %d:\n%v", len(got), len(want), got)
+	}
+
+	for i := range want {
+		if !sameInstruction(&want[i], &got[i]) && !(want[i].IsLoadOfFunctionPointer() &&
+			got[i].IsLoadOfFunctionPointer() && got[i].Reference() == want[i].Reference()) {
+			t.Errorf("instruction %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+// TestWriteCollectionELFIproute2 loads the written ELF file with iproute2, which uses libbpf if it was built with it,
+// by attaching the program to the loopback device of a new network namespace. The cover-map must be pinned by name.
+// Skipped if iproute2 or unshare are missing or the test doesn't run as root.
+func TestWriteCollectionELFIproute2(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loading with iproute2 needs root")
+	}
+	for _, tool := range []string{"ip", "unshare"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+
+	spec, err := ebpf.LoadCollectionSpec("examples/bpf-to-bpf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A name of its own, so the pin doesn't collide with a real cover-map.
+	const coverMapName = "coverbee_elf_test"
+	_, err = InstrumentCollectionWithOptions(spec, InstrumentOptions{
+		Layout:       CoverMapLayout{Strategy: CounterStrategyShared},
+		VerifierLogs: map[string]string{},
+		Analysis:     AnalysisStatic,
+		CoverMapName: coverMapName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec.Maps[coverMapName].Pinning = ebpf.PinByName
+
+	path := filepath.Join(t.TempDir(), "instrumented.o")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteCollectionELF(spec, f); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pin := filepath.Join("/sys/fs/bpf/xdp/globals", coverMapName)
+	t.Cleanup(func() { os.Remove(pin) })
+
+	section := spec.Programs["firewall_prog"].SectionName
+	out, err := exec.Command(
+		"unshare", "--net", "ip", "link", "set", "dev", "lo", "xdpgeneric", "obj", path, "sec", section,
+	).CombinedOutput()
+	if bytes.Contains(out, []byte("unshare failed")) {
+		t.Skipf("can't create a network namespace: %s", out)
+	}
+	if err != nil {
+		t.Fatalf("iproute2 can't load the ELF file: %v\n%s", err, out)
+	}
+
+	if _, err = os.Stat(pin); err != nil {
+		t.Errorf("cover-map isn't pinned by name: %v", err)
+	}
+}
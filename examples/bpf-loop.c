@@ -0,0 +1,44 @@
+#include <linux/bpf.h>
+#include "bpf_helpers.h"
+
+struct loop_ctx
+{
+	__u32 odd;
+	__u32 even;
+};
+
+// Called by bpf_loop for every iteration, counts the odd and even iterations
+static long count_parity(__u32 index, void *ctx)
+{
+	struct loop_ctx *lctx = ctx;
+
+	if (index & 1)
+		lctx->odd++;
+	else
+		lctx->even++;
+
+	return 0;
+}
+
+SEC("xdp")
+int loop_prog(struct xdp_md *ctx)
+{
+	void *data_end = (void *)(long)ctx->data_end;
+	void *data = (void *)(long)ctx->data;
+	__u8 *first = data;
+	struct loop_ctx lctx = {};
+
+	// Drop packets which are empty
+	if (data + 1 > data_end)
+		return XDP_DROP;
+
+	// Loop as many times as the value of the first byte of the packet
+	bpf_loop(*first, count_parity, &lctx, 0);
+
+	if (lctx.odd > lctx.even)
+		return XDP_DROP;
+
+	return XDP_PASS;
+}
+
+char _license[] SEC("license") = "GPL";
@@ -1,3 +1,4 @@
 #!/bin/bash
 
 clang -target bpf -Wall -O2 -g -c bpf-to-bpf.c -I/usr/include -o bpf-to-bpf
+clang -target bpf -Wall -O2 -g -c bpf-loop.c -I/usr/include -o bpf-loop
@@ -0,0 +1,97 @@
+package coverbee
+
+import (
+	"fmt"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// FallbackStrategy is a way to instrument a program with less code after the verifier rejected it.
+type FallbackStrategy string
+
+const (
+	// FallbackExcludeFunction excludes the function which contains the instruction the verifier rejected.
+	FallbackExcludeFunction FallbackStrategy = "exclude-function"
+	// FallbackGranularity switches the program to the next coarser granularity.
+	FallbackGranularity FallbackStrategy = "granularity"
+	// FallbackExcludeProgram leaves the program uninstrumented.
+	FallbackExcludeProgram FallbackStrategy = "exclude-program"
+)
+
+// Fallback is a fallback strategy applied to a program after the verifier rejected it.
+type Fallback struct {
+	Strategy FallbackStrategy
+	// The function excluded by `FallbackExcludeFunction`.
+	Function string
+	// The granularity switched to by `FallbackGranularity`.
+	Granularity Granularity
+	// Why the verifier rejected the program.
+	Failure VerifierFailureKind
+}
+
+func (f Fallback) String() string {
+	switch f.Strategy {
+	case FallbackExcludeFunction:
+		return fmt.Sprintf("excluded function '%s' after %s", f.Function, f.Failure)
+	case FallbackGranularity:
+		return fmt.Sprintf("switched to %s granularity after %s", f.Granularity, f.Failure)
+	default:
+		return fmt.Sprintf("excluded program after %s", f.Failure)
+	}
+}
+
+// nextFallback changes the options so the program rejected with the given failure is instrumented with less code. In
+// order of preference, the function which contains the rejected instruction is excluded, the granularity of the
+// program is made coarser, or the program is excluded altogether. The instruction and complexity limits apply to the
+// whole program, so for these failures the granularity is made coarser before excluding functions. If the stack is too
+// large, the granularity is left as it is. False is returned if there is no cheaper strategy left.
+func nextFallback(opts *InstrumentOptions, failure *VerifierFailure) (Fallback, bool) {
+	fallback := Fallback{Failure: failure.Kind}
+
+	progOpts := opts.Programs[failure.Program]
+	granularity := progOpts.Granularity
+	if granularity == "" {
+		granularity = opts.Granularity
+	}
+	if granularity == "" {
+		granularity = GranularityBlock
+	}
+
+	// The same stack slots are added to a function at every granularity, so a coarser granularity doesn't help if the
+	// stack is too large.
+	coarser := granularity.coarser()
+	if failure.Kind == VerifierFailureStackTooLarge {
+		coarser = ""
+	}
+
+	wholeProgram := failure.Kind == VerifierFailureInstructionLimit || failure.Kind == VerifierFailureComplexityLimit
+	canExcludeFunction := failure.Function != "" && !slices.Contains(progOpts.ExcludeFunctions, failure.Function)
+
+	switch {
+	case canExcludeFunction && (!wholeProgram || coarser == ""):
+		// ELF function symbols are the same as the BTF function names.
+		fallback.Strategy = FallbackExcludeFunction
+		fallback.Function = failure.Function
+		progOpts.ExcludeFunctions = append(slices.Clip(progOpts.ExcludeFunctions), failure.Function)
+	case coarser != "":
+		fallback.Strategy = FallbackGranularity
+		fallback.Granularity = coarser
+		progOpts.Granularity = fallback.Granularity
+	case opts.Filter.program(failure.Program):
+		fallback.Strategy = FallbackExcludeProgram
+		opts.Filter.ExcludePrograms = append(slices.Clip(opts.Filter.ExcludePrograms), failure.Program)
+		return fallback, true
+	default:
+		return fallback, false
+	}
+
+	// Don't modify the options of the caller.
+	opts.Programs = maps.Clone(opts.Programs)
+	if opts.Programs == nil {
+		opts.Programs = make(map[string]ProgramOptions)
+	}
+	opts.Programs[failure.Program] = progOpts
+
+	return fallback, true
+}
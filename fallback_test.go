@@ -0,0 +1,60 @@
+package coverbee
+
+import (
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestNextFallback(t *testing.T) {
+	callerPrograms := map[string]ProgramOptions{"other": {Granularity: GranularityFunction}}
+	opts := InstrumentOptions{Programs: callerPrograms}
+	failure := &VerifierFailure{Program: "prog", Kind: VerifierFailureInvalidStackRead, Function: "fn"}
+
+	want := []Fallback{
+		{Strategy: FallbackExcludeFunction, Function: "fn", Failure: VerifierFailureInvalidStackRead},
+		{Strategy: FallbackGranularity, Granularity: GranularityBranchTarget, Failure: VerifierFailureInvalidStackRead},
+		{Strategy: FallbackGranularity, Granularity: GranularityFunction, Failure: VerifierFailureInvalidStackRead},
+		{Strategy: FallbackExcludeProgram, Failure: VerifierFailureInvalidStackRead},
+	}
+	for i, wantFallback := range want {
+		fallback, ok := nextFallback(&opts, failure)
+		if !ok {
+			t.Fatalf("fallback %d: no fallback left", i)
+		}
+		if fallback != wantFallback {
+			t.Errorf("fallback %d = %+v, want %+v", i, fallback, wantFallback)
+		}
+	}
+
+	if _, ok := nextFallback(&opts, failure); ok {
+		t.Error("expected no fallback after excluding the program")
+	}
+
+	progOpts := opts.Programs["prog"]
+	if progOpts.Granularity != GranularityFunction || !slices.Equal(progOpts.ExcludeFunctions, []string{"fn"}) {
+		t.Errorf("unexpected program options %+v", progOpts)
+	}
+	if !slices.Equal(opts.Filter.ExcludePrograms, []string{"prog"}) {
+		t.Errorf("unexpected excluded programs %v", opts.Filter.ExcludePrograms)
+	}
+	if len(callerPrograms) != 1 {
+		t.Error("the program options of the caller were modified")
+	}
+
+	// The instruction limit applies to the whole program, so the granularity is made coarser first.
+	opts = InstrumentOptions{}
+	failure = &VerifierFailure{Program: "prog", Kind: VerifierFailureInstructionLimit, Function: "fn"}
+	fallback, _ := nextFallback(&opts, failure)
+	if fallback.Strategy != FallbackGranularity {
+		t.Errorf("expected a granularity fallback, got %+v", fallback)
+	}
+
+	// A coarser granularity adds the same stack slots, so the program is excluded if there is no function to exclude.
+	opts = InstrumentOptions{}
+	failure = &VerifierFailure{Program: "prog", Kind: VerifierFailureStackTooLarge}
+	fallback, _ = nextFallback(&opts, failure)
+	if fallback.Strategy != FallbackExcludeProgram {
+		t.Errorf("expected the program to be excluded, got %+v", fallback)
+	}
+}
@@ -0,0 +1,92 @@
+package coverbee
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+)
+
+// HaveCounterStrategy probes the running kernel for support of the given counter strategy. Returns nil if the
+// strategy is supported and an error wrapping `ebpf.ErrNotSupported` if it is not.
+func HaveCounterStrategy(strategy CounterStrategy) error {
+	switch strategy {
+	case CounterStrategyShared, CounterStrategyAuto:
+		return nil
+	case CounterStrategyPerCPU:
+		return features.HaveMapType(ebpf.PerCPUArray)
+	case CounterStrategyAtomic:
+		return haveAtomicAdd()
+	default:
+		return fmt.Errorf("unknown counter strategy '%s'", strategy)
+	}
+}
+
+// haveAtomicAdd probes if the kernel accepts atomic adds to a map value.
+func haveAtomicAdd() error {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		return fmt.Errorf("create probe map: %w", err)
+	}
+	defer m.Close()
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.SocketFilter,
+		Instructions: asm.Instructions{
+			asm.LoadMapPtr(asm.R1, m.FD()),
+			asm.Mov.Reg(asm.R2, asm.R10),
+			asm.Add.Imm(asm.R2, -8),
+			asm.StoreImm(asm.R2, 0, 0, asm.DWord),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "exit"),
+			asm.Mov.Imm(asm.R1, 1),
+			asm.StoreXAdd(asm.R0, asm.R1, asm.DWord),
+			asm.Mov.Imm(asm.R0, 0).WithSymbol("exit"),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+	if err != nil {
+		var vErr *ebpf.VerifierError
+		if errors.As(err, &vErr) {
+			return fmt.Errorf("atomic add: %w", ebpf.ErrNotSupported)
+		}
+		return fmt.Errorf("load probe program: %w", err)
+	}
+
+	return prog.Close()
+}
+
+// resolveStrategy replaces `CounterStrategyAuto` with the best strategy supported by the kernel and checks if an
+// explicitly requested strategy is supported.
+func (l CoverMapLayout) resolveStrategy() (CoverMapLayout, error) {
+	if l.Strategy != CounterStrategyAuto {
+		if err := HaveCounterStrategy(l.Strategy); err != nil {
+			return l, fmt.Errorf("counter strategy '%s': %w", l.Strategy, err)
+		}
+
+		return l, nil
+	}
+
+	// Global counters are accessed directly, which isn't possible for per-CPU maps.
+	if l.Storage != CounterStorageGlobal && HaveCounterStrategy(CounterStrategyPerCPU) == nil {
+		l.Strategy = CounterStrategyPerCPU
+		return l, nil
+	}
+
+	atomicLayout := l
+	atomicLayout.Strategy = CounterStrategyAtomic
+	if atomicLayout.validate() == nil && HaveCounterStrategy(CounterStrategyAtomic) == nil {
+		return atomicLayout, nil
+	}
+
+	l.Strategy = CounterStrategyShared
+	return l, nil
+}
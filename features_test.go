@@ -0,0 +1,83 @@
+package coverbee
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/exp/slices"
+)
+
+// TestCounterStrategies runs the example program instrumented with every counter strategy the kernel supports and
+// checks that they all count the same, the test is skipped without the privileges to load it.
+func TestCounterStrategies(t *testing.T) {
+	if err := HaveCounterStrategy("unknown"); err == nil {
+		t.Error("unknown counter strategy is supported")
+	}
+
+	data, err := os.ReadFile(filepath.Join("examples", "datain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []int
+	for _, strategy := range []CounterStrategy{CounterStrategyShared, CounterStrategyAtomic, CounterStrategyPerCPU} {
+		t.Run(string(strategy), func(t *testing.T) {
+			if err := HaveCounterStrategy(strategy); errors.Is(err, ebpf.ErrNotSupported) {
+				t.Skipf("counter strategy not supported: %v", err)
+			} else if errors.Is(err, os.ErrPermission) {
+				t.Skipf("can't probe the counter strategy: %v", err)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			layout := CoverMapLayout{CounterWidth: Counter32Bit, Strategy: strategy}
+			session, err := NewSession(spec, ebpf.CollectionOptions{}, InstrumentOptions{Layout: layout})
+			if errors.Is(err, os.ErrPermission) {
+				t.Skipf("can't load the collection: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			if got := session.Instrumentation.Layout.Strategy; got != strategy {
+				t.Fatalf("instrumented with strategy %s, want %s", got, strategy)
+			}
+
+			for i := 0; i < 3; i++ {
+				if _, err = session.Collection.Programs["firewall_prog"].Run(&ebpf.RunOptions{Data: data}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			snapshot, err := session.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts := make([]int, len(snapshot.BlockList.Blocks))
+			for blockID, block := range snapshot.BlockList.Blocks {
+				if len(block) > 0 {
+					counts[blockID] = block[0].ProfileBlock.Count
+				}
+			}
+			if counts[0] != 3 {
+				t.Errorf("entry block has count %d, want 3", counts[0])
+			}
+
+			if want == nil {
+				want = counts
+			} else if !slices.Equal(counts, want) {
+				t.Errorf("block counts %v differ from %v", counts, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package coverbee
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// Filter selects which code is instrumented. Code which is not selected keeps its original instructions and is left
+// out of the block-list. All patterns are glob patterns as matched by `path.Match`. Code is instrumented if it matches
+// at least one include pattern of every kind with include patterns, and no exclude patterns. The zero value
+// instruments everything.
+type Filter struct {
+	// Names of the programs to instrument.
+	IncludePrograms []string
+	// Names of the programs not to instrument.
+	ExcludePrograms []string
+	// BTF function names of the functions to instrument, this includes the functions of the programs themselves.
+	IncludeFunctions []string
+	// BTF function names of the functions not to instrument.
+	ExcludeFunctions []string
+	// Source files of which the blocks are instrumented. A block belongs to the file of its first line info, blocks
+	// without line info only match if no files are included. Patterns match the whole path or its trailing path
+	// elements, so `*.h` matches all headers and `lib/*.h` all headers in any directory named lib.
+	IncludeFiles []string
+	// Source files of which the blocks are not instrumented.
+	ExcludeFiles []string
+}
+
+func (f Filter) validate() error {
+	for _, patterns := range [][]string{
+		f.IncludePrograms, f.ExcludePrograms,
+		f.IncludeFunctions, f.ExcludeFunctions,
+		f.IncludeFiles, f.ExcludeFiles,
+	} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("filter pattern '%s': %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// program returns true if the program with the given name should be instrumented.
+func (f Filter) program(name string) bool {
+	return filterMatch(f.IncludePrograms, f.ExcludePrograms, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// function returns true if the function with the given BTF name should be instrumented.
+func (f Filter) function(name string) bool {
+	return filterMatch(f.IncludeFunctions, f.ExcludeFunctions, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// file returns true if blocks from the given source file should be instrumented. An empty file name is used for
+// blocks without line info.
+func (f Filter) file(fileName string) bool {
+	return filterMatch(f.IncludeFiles, f.ExcludeFiles, func(pattern string) bool {
+		if fileName == "" {
+			return false
+		}
+
+		name := fileName
+		for {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+
+			i := strings.IndexByte(name, '/')
+			if i < 0 {
+				return false
+			}
+			name = name[i+1:]
+		}
+	})
+}
+
+// filterMatch returns true if no include patterns are given or any of them matches, and none of the exclude patterns
+// match.
+func filterMatch(include, exclude []string, match func(pattern string) bool) bool {
+	included := len(include) == 0
+	for _, pattern := range include {
+		if match(pattern) {
+			included = true
+			break
+		}
+	}
+
+	for _, pattern := range exclude {
+		if match(pattern) {
+			return false
+		}
+	}
+
+	return included
+}
+
+// instrumentedBlocks returns for every block of the program with the given name if it should be instrumented.
+func (f Filter) instrumentedBlocks(name string, blocks []*BasicBlock, subProgFuncs map[string]bool) []bool {
+	instrumented := make([]bool, len(blocks))
+
+	var funcSelected bool
+	for i, block := range blocks {
+		if sym := block.Block[0].Symbol(); i == 0 || subProgFuncs[sym] || sym == name {
+			funcName := sym
+			if fn := btf.FuncMetadata(&block.Block[0]); fn != nil {
+				funcName = fn.Name
+			}
+			funcSelected = f.function(funcName)
+		}
+
+		fileName, _ := firstSourceLine(block.Block)
+		instrumented[i] = funcSelected && f.file(fileName)
+	}
+
+	return instrumented
+}
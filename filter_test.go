@@ -0,0 +1,82 @@
+package coverbee
+
+import (
+	"testing"
+)
+
+func TestFilterFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   Filter
+		fileName string
+		want     bool
+	}{
+		{name: "Zero value", fileName: "/src/prog.c", want: true},
+		{name: "No line info", fileName: "", want: true},
+		{
+			name:     "Include base name",
+			filter:   Filter{IncludeFiles: []string{"*.c"}},
+			fileName: "/src/prog.c",
+			want:     true,
+		},
+		{
+			name:     "Include doesn't match",
+			filter:   Filter{IncludeFiles: []string{"*.c"}},
+			fileName: "/src/bpf_helpers.h",
+			want:     false,
+		},
+		{
+			name:     "Include without line info",
+			filter:   Filter{IncludeFiles: []string{"*"}},
+			fileName: "",
+			want:     false,
+		},
+		{
+			name:     "Include trailing elements",
+			filter:   Filter{IncludeFiles: []string{"src/*.c"}},
+			fileName: "/home/user/src/prog.c",
+			want:     true,
+		},
+		{
+			name:     "Include partial element",
+			filter:   Filter{IncludeFiles: []string{"rc/*.c"}},
+			fileName: "/home/user/src/prog.c",
+			want:     false,
+		},
+		{
+			name:     "Include absolute path",
+			filter:   Filter{IncludeFiles: []string{"/home/*/src/prog.c"}},
+			fileName: "/home/user/src/prog.c",
+			want:     true,
+		},
+		{
+			name:     "Exclude overrides include",
+			filter:   Filter{IncludeFiles: []string{"*"}, ExcludeFiles: []string{"vendor/*"}},
+			fileName: "/src/vendor/lib.h",
+			want:     false,
+		},
+		{
+			name:     "Exclude without line info",
+			filter:   Filter{ExcludeFiles: []string{"*.h"}},
+			fileName: "",
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.file(tt.fileName); got != tt.want {
+				t.Errorf("file(%q) = %v, want %v", tt.fileName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterValidate(t *testing.T) {
+	if err := (Filter{ExcludeFunctions: []string{"handle_[ipv4"}}).validate(); err == nil {
+		t.Error("expected an error for a malformed pattern")
+	}
+
+	if err := (Filter{IncludePrograms: []string{"xdp_*"}, ExcludePrograms: []string{"xdp_test"}}).validate(); err != nil {
+		t.Error(err)
+	}
+}
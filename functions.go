@@ -0,0 +1,45 @@
+package coverbee
+
+import (
+	"io"
+
+	"github.com/cilium/ebpf/btf"
+)
+
+// FunctionCoverage is the coverage of a program or bpf-to-bpf function, which is the count of its entry block. At
+// `GranularityFunction` the entry blocks are the only blocks which are counted.
+type FunctionCoverage struct {
+	// The name of the program which contains the function.
+	Program string
+	// The BTF name of the function, for the main function of a program the name of the program.
+	Name string
+	// The block ID of the entry block of the function.
+	BlockID int
+	// The source location of the start of the function, empty if the function has no line info.
+	Filename string
+	Line     int
+	// The number of times the function was called, set by `BlockList.ApplyCoverMap`. Calls of a function which jumps
+	// back to its first instruction in a loop also include the iterations of the loop.
+	Calls int
+}
+
+// newFunctionCoverage returns the coverage of the function which starts with the given block.
+func newFunctionCoverage(progName string, blockID int, entry *BasicBlock) FunctionCoverage {
+	fn := FunctionCoverage{
+		Program: progName,
+		Name:    entry.Block[0].Symbol(),
+		BlockID: blockID,
+	}
+	if btfFunc := btf.FuncMetadata(&entry.Block[0]); btfFunc != nil {
+		fn.Name = btfFunc.Name
+	}
+	fn.Filename, fn.Line = firstSourceLine(entry.Block)
+
+	return fn
+}
+
+// FunctionsToText writes a line for every function, sorted by program and function name, telling if the function was
+// called and how often.
+func FunctionsToText(functions []FunctionCoverage, out io.Writer) {
+	NewReport(&BlockList{Functions: functions}).WriteFunctions(out)
+}
@@ -0,0 +1,24 @@
+package coverbee
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFunctionsToText(t *testing.T) {
+	functions := []FunctionCoverage{
+		{Program: "xdp_prog", Name: "xdp_prog", Filename: "/src/prog.c", Line: 40, Calls: 3},
+		{Program: "xdp_prog", Name: "handle_ipv6"},
+		{Program: "tc_prog", Name: "tc_prog", Filename: "/src/prog.c", Line: 80, Calls: 1},
+	}
+
+	var sb strings.Builder
+	FunctionsToText(functions, &sb)
+
+	want := "tc_prog tc_prog (/src/prog.c:80) called 1\n" +
+		"xdp_prog handle_ipv6 not called\n" +
+		"xdp_prog xdp_prog (/src/prog.c:40) called 3\n"
+	if sb.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
@@ -0,0 +1,127 @@
+package coverbee
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Granularity determines which blocks of a function are counted. Coarser granularities need fewer instructions and
+// counters, so programs which exceed the limits of the verifier when every block is counted might still load.
+type Granularity string
+
+const (
+	// GranularityBlock counts every block. This is the default.
+	GranularityBlock Granularity = "block"
+	// GranularityBranchTarget only counts the entry block of every function and the blocks which are the target of
+	// a jump. Blocks which are only entered by not taking a jump are not counted, and neither are branches.
+	GranularityBranchTarget Granularity = "branch-target"
+	// GranularityFunction only counts the entry block of every function, which shows which functions were called and
+	// how often. Branches are not counted.
+	GranularityFunction Granularity = "function"
+)
+
+func (g Granularity) validate() error {
+	switch g {
+	case GranularityBlock, GranularityBranchTarget, GranularityFunction:
+		return nil
+	default:
+		return fmt.Errorf("invalid granularity '%s', pick from block, branch-target or function", g)
+	}
+}
+
+// coarser returns the next granularity which counts fewer blocks, or an empty string if there is none.
+func (g Granularity) coarser() Granularity {
+	switch g {
+	case GranularityBlock:
+		return GranularityBranchTarget
+	case GranularityBranchTarget:
+		return GranularityFunction
+	default:
+		return ""
+	}
+}
+
+// ProgramOptions override the instrumentation options for a single program.
+type ProgramOptions struct {
+	// Overrides `InstrumentOptions.Granularity` if set.
+	Granularity Granularity
+	// BTF names of the functions of the program which are not instrumented, in addition to the functions excluded by
+	// the filter.
+	ExcludeFunctions []string
+}
+
+// ProgramInstrumentation describes how a program ended up being instrumented.
+type ProgramInstrumentation struct {
+	Granularity Granularity
+	// BTF names of the functions excluded by `ProgramOptions.ExcludeFunctions`.
+	ExcludedFunctions []string
+	// True if the program isn't instrumented at all, because the verifier rejected every fallback strategy.
+	Excluded bool
+	// The fallback strategies applied after the verifier rejected the instrumented program, in order. Empty if the
+	// program loaded as instrumented at first.
+	Fallbacks []Fallback
+
+	// The number of instrumented blocks of the program.
+	Blocks int
+	// The number of raw instructions of the original and the instrumented program.
+	Instructions             int
+	InstrumentedInstructions int
+}
+
+func (pi ProgramInstrumentation) String() string {
+	var sb strings.Builder
+	if pi.Excluded {
+		sb.WriteString("not instrumented")
+	} else {
+		fmt.Fprintf(&sb, "%s granularity", pi.Granularity)
+		if len(pi.ExcludedFunctions) > 0 {
+			fmt.Fprintf(&sb, ", excluded functions %s", strings.Join(pi.ExcludedFunctions, ", "))
+		}
+	}
+
+	if len(pi.Fallbacks) > 0 {
+		fallbacks := make([]string, 0, len(pi.Fallbacks))
+		for _, fallback := range pi.Fallbacks {
+			fallbacks = append(fallbacks, fallback.String())
+		}
+		fmt.Fprintf(&sb, " (fallbacks: %s)", strings.Join(fallbacks, "; "))
+	}
+
+	return sb.String()
+}
+
+// applyGranularity removes the blocks which aren't counted at the given granularity from the instrumented blocks of
+// the program with the given name. It returns the symbols of the functions which still contain at least one
+// instrumented block.
+func applyGranularity(
+	granularity Granularity,
+	name string,
+	blocks []*BasicBlock,
+	subProgFuncs map[string]bool,
+	instrumented []bool,
+) map[string]bool {
+	funcs := make(map[string]bool)
+
+	var funcSym string
+	for i, block := range blocks {
+		sym := block.Block[0].Symbol()
+		entry := i == 0 || subProgFuncs[sym] || sym == name
+		if entry {
+			funcSym = sym
+		}
+
+		switch granularity {
+		case GranularityBranchTarget:
+			// Every jump target has a symbol, see `ProgramBlocks`.
+			instrumented[i] = instrumented[i] && (entry || sym != "")
+		case GranularityFunction:
+			instrumented[i] = instrumented[i] && entry
+		}
+
+		if instrumented[i] {
+			funcs[funcSym] = true
+		}
+	}
+
+	return funcs
+}
@@ -0,0 +1,78 @@
+package coverbee
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+func TestApplyGranularity(t *testing.T) {
+	// Block 0 ends with a jump to block 2, block 1 is only entered by not taking the jump. Block 3 is a function.
+	insns := asm.Instructions{
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("prog"),
+		{
+			OpCode: asm.OpCode(asm.JumpClass).SetJumpOp(asm.JEq).SetSource(asm.ImmSource),
+			Dst:    asm.R1,
+			Offset: 1,
+		},
+		asm.Mov.Imm(asm.R0, 1),
+		asm.Mov.Imm(asm.R0, 2),
+		asm.Return(),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("fn"),
+		asm.Return(),
+	}
+	blocks := ProgramBlocks(insns)
+	if len(blocks) != 4 {
+		t.Fatalf("expected 4 blocks, got %d", len(blocks))
+	}
+
+	tests := []struct {
+		granularity  Granularity
+		instrumented []bool
+		want         []bool
+		wantFuncs    []string
+	}{
+		{
+			granularity:  GranularityBlock,
+			instrumented: []bool{true, true, true, true},
+			want:         []bool{true, true, true, true},
+			wantFuncs:    []string{"fn", "prog"},
+		},
+		{
+			granularity:  GranularityBranchTarget,
+			instrumented: []bool{true, true, true, true},
+			want:         []bool{true, false, true, true},
+			wantFuncs:    []string{"fn", "prog"},
+		},
+		{
+			granularity:  GranularityFunction,
+			instrumented: []bool{true, true, true, true},
+			want:         []bool{true, false, false, true},
+			wantFuncs:    []string{"fn", "prog"},
+		},
+		{
+			// Blocks which are filtered out stay filtered out.
+			granularity:  GranularityFunction,
+			instrumented: []bool{true, true, true, false},
+			want:         []bool{true, false, false, false},
+			wantFuncs:    []string{"prog"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.granularity), func(t *testing.T) {
+			instrumented := slices.Clone(tt.instrumented)
+			funcs := applyGranularity(tt.granularity, "prog", blocks, map[string]bool{"fn": true}, instrumented)
+			if !slices.Equal(instrumented, tt.want) {
+				t.Errorf("instrumented = %v, want %v", instrumented, tt.want)
+			}
+
+			gotFuncs := maps.Keys(funcs)
+			slices.Sort(gotFuncs)
+			if !slices.Equal(gotFuncs, tt.wantFuncs) {
+				t.Errorf("funcs = %v, want %v", gotFuncs, tt.wantFuncs)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+//go:build coverbee
+
+package coverbee
+
+const instrumentByDefault = true
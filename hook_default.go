@@ -0,0 +1,7 @@
+//go:build !coverbee
+
+package coverbee
+
+// instrumentByDefault is true if `LoadAndAssign` instruments collections without `EnvBlockListDir` being set, which is
+// the case when building with the `coverbee` build tag.
+const instrumentByDefault = false
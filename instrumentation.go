@@ -1,18 +1,24 @@
 package coverbee
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"unsafe"
 
+	"github.com/cilium/coverbee/pkg/cfg"
 	"github.com/cilium/coverbee/pkg/verifierlog"
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/asm"
 	"github.com/cilium/ebpf/btf"
 	"github.com/davecgh/go-spew/spew"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	"golang.org/x/tools/cover"
 )
@@ -24,17 +30,117 @@ func InstrumentAndLoadCollection(
 	opts ebpf.CollectionOptions,
 	logWriter io.Writer,
 ) (*ebpf.Collection, []*BasicBlock, error) {
-	blockList, err := InstrumentCollection(coll, logWriter)
-	if err != nil {
-		return nil, nil, fmt.Errorf("InstrumentCollection: %w", err)
+	loadedColl, instrumentation, err := InstrumentAndLoadCollectionWithOptions(coll, opts, InstrumentOptions{
+		LogWriter: logWriter,
+	})
+	if instrumentation == nil {
+		return loadedColl, nil, err
 	}
 
+	return loadedColl, instrumentation.Blocks, err
+}
+
+// InstrumentAndLoadCollectionWithOptions is like `InstrumentAndLoadCollection` but allows the caller to control the
+// instrumentation process with `instOpts`. If `InstrumentOptions.Fallback` is set and the verifier rejects an
+// instrumented program, the original collection is instrumented again with a cheaper strategy for that program, until
+// the collection loads or no cheaper strategy is left.
+func InstrumentAndLoadCollectionWithOptions(
+	coll *ebpf.CollectionSpec,
+	opts ebpf.CollectionOptions,
+	instOpts InstrumentOptions,
+) (*ebpf.Collection, *Instrumentation, error) {
+	logWriter := instOpts.LogWriter
+
 	if logWriter != nil {
 		// Verbose
 		opts.Programs.LogLevel = 2
 	}
 
+	// The collection is loaded anyway, so the counter strategy is picked for the kernel even if the instrumentation
+	// itself doesn't touch the kernel. A shared cover-map already has its strategy.
+	if instOpts.SharedCoverMap == nil {
+		layout, err := instOpts.Layout.withDefaults().resolveStrategy()
+		if err != nil {
+			return nil, nil, err
+		}
+		instOpts.Layout.Strategy = layout.Strategy
+	}
+
+	// Every attempt instruments a copy of the original collection.
+	var original *ebpf.CollectionSpec
+	if instOpts.Fallback {
+		original = coll.Copy()
+	}
+
+	fallbacks := make(map[string][]Fallback)
+	var failure *VerifierFailure
+	for {
+		attempt := coll
+		if original != nil {
+			attempt = original.Copy()
+		}
+
+		loadedColl, instrumentation, err := instrumentAndLoad(attempt, opts, instOpts)
+		if instrumentation == nil {
+			if failure != nil {
+				// A fallback excluded all code.
+				return nil, nil, fmt.Errorf("%w\nno fallback left: %w", failure, err)
+			}
+			return nil, nil, err
+		}
+
+		if err != nil && instOpts.Fallback && errors.As(err, &failure) {
+			if fallback, ok := nextFallback(&instOpts, failure); ok {
+				fallbacks[failure.Program] = append(fallbacks[failure.Program], fallback)
+
+				if logWriter != nil {
+					fmt.Fprintln(logWriter, "=== Fallback ===")
+					fmt.Fprintf(logWriter, "program '%s' %s\n", failure.Program, fallback)
+				}
+
+				// The original programs and the counter strategy don't change, so there is no need to record the
+				// verifier logs or probe the kernel again.
+				instOpts.VerifierLogs = instrumentation.verifierLogs
+				instOpts.Layout.Strategy = instrumentation.Layout.Strategy
+				continue
+			}
+		}
+
+		if original != nil {
+			*coll = *attempt
+		}
+
+		for name, progFallbacks := range fallbacks {
+			report, found := instrumentation.Programs[name]
+			if !found {
+				report.Excluded = true
+			}
+			report.Fallbacks = progFallbacks
+			instrumentation.Programs[name] = report
+		}
+
+		return loadedColl, instrumentation, err
+	}
+}
+
+// instrumentAndLoad instruments the given collection and loads it. Verifier errors are diagnosed.
+func instrumentAndLoad(
+	coll *ebpf.CollectionSpec,
+	opts ebpf.CollectionOptions,
+	instOpts InstrumentOptions,
+) (*ebpf.Collection, *Instrumentation, error) {
+	logWriter := instOpts.LogWriter
+
+	instOpts.CollectionOptions = opts
+	instrumentation, err := InstrumentCollectionWithOptions(coll, instOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("InstrumentCollection: %w", err)
+	}
+
 	loadedColl, err := ebpf.NewCollectionWithOptions(coll, opts)
+	if failure := instrumentation.DiagnoseVerifierError(err); failure != nil {
+		err = failure
+	}
 
 	if logWriter != nil {
 		fmt.Fprintln(logWriter, "=== Instrumented verifier logs ===")
@@ -49,26 +155,201 @@ func InstrumentAndLoadCollection(
 			if errors.As(err, &vErr) {
 				fmt.Fprintf(logWriter, "%+v\n", vErr)
 			}
+
+			var failure *VerifierFailure
+			if errors.As(err, &failure) {
+				fmt.Fprintln(logWriter, "=== Verifier failure ===")
+				fmt.Fprintln(logWriter, failure)
+			}
+		}
+	}
+
+	return loadedColl, instrumentation, err
+}
+
+// DefaultCoverMapName is the name of the cover-map in the instrumented collection, unless another name is set with
+// `InstrumentOptions.CoverMapName`.
+const DefaultCoverMapName = "coverbee_covermap"
+
+// InstrumentOptions control the instrumentation process.
+type InstrumentOptions struct {
+	// Layout of the counters in the cover-map. The zero value results in the default layout.
+	Layout CoverMapLayout
+	// If true, the taken and not-taken outcomes of every conditional jump are counted in addition to the blocks.
+	BranchCoverage bool
+	// If set, the whole instrumentation process is logged to this writer.
+	LogWriter io.Writer
+	// Verifier logs of the original programs at `ebpf.LogLevelInstruction` indexed by program name, as returned by
+	// `RecordVerifierLogs`. If set, these logs are used instead of loading the programs so the instrumentation doesn't
+	// touch the kernel. The counter strategy isn't probed in this case, `CounterStrategyAuto` results in shared
+	// counters, unless the collection is loaded by `InstrumentAndLoadCollectionWithOptions`. May be empty if the
+	// analysis mode doesn't use verifier logs.
+	VerifierLogs map[string]string
+	// The options used to load a copy of the collection to record the verifier logs if `VerifierLogs` isn't set, see
+	// `RecordVerifierLogsWithOptions`. Set these to the options the instrumented collection will be loaded with, so
+	// the verifier sees the same maps and kernel types. `InstrumentAndLoadCollectionWithOptions` uses the options it
+	// loads the collection with instead.
+	CollectionOptions ebpf.CollectionOptions
+	// The way used registers and stack slots are determined, defaults to `AnalysisVerifier`. `AnalysisStatic` doesn't
+	// touch the kernel, like instrumenting with `VerifierLogs` the counter strategy isn't probed.
+	Analysis AnalysisMode
+	// Selects the programs, functions and source files which are instrumented. The zero value instruments everything.
+	Filter Filter
+	// The block-list of the collections which were already instrumented into the cover-map this collection should
+	// share. If set, `Layout` is ignored and the layout of the block-list is used, the counters of this collection are
+	// allocated after the counters of the block-list. The block-list must have a cover-map capacity. The caller is
+	// responsible for replacing the cover-map of this collection with the existing one when loading, and for
+	// appending the resulting block-list with `BlockList.Append`.
+	SharedCoverMap *BlockList
+	// Name of the cover-map added to the collection, defaults to `DefaultCoverMapName`. The collection must not contain
+	// a map with this name already. Collections instrumented with different names can pin their cover-maps in the
+	// same directory.
+	CoverMapName string
+	// What the instrumented programs do if the lookup of the cover-map entry fails. The zero value returns the default
+	// value for the program type.
+	LookupFailure LookupFailure
+	// Which blocks of the instrumented functions are counted, defaults to `GranularityBlock`.
+	Granularity Granularity
+	// Options which override the options above for single programs, indexed by program name.
+	Programs map[string]ProgramOptions
+	// If true and the verifier rejects an instrumented program, `InstrumentAndLoadCollectionWithOptions` retries with
+	// progressively cheaper fallback strategies until the collection loads, see `Fallback`. The strategies each
+	// program ended up with are recorded in `Instrumentation.Programs`. Ignored when instrumenting without loading.
+	Fallback bool
+	// If true, only the blocks of which the count can't be derived from the counts of other blocks get a counter, which
+	// saves instructions. The counts of the other blocks are derived when applying the cover-map to the block-list,
+	// see `BlockList.ApplyCoverMap`. Derived counts wrap around like counters do. Only applies to
+	// programs at `GranularityBlock`, and can't be combined with branch coverage or saturating counters.
+	MinimalProbes bool
+}
+
+// validate checks the options, without instrumenting anything.
+func (opts InstrumentOptions) validate() error {
+	layout := opts.Layout
+	if opts.SharedCoverMap != nil {
+		layout = opts.SharedCoverMap.Layout
+		if layout.Capacity == 0 {
+			return errors.New("the shared cover-map has no capacity, it was made for a single collection")
 		}
 	}
 
-	return loadedColl, blockList, err
+	layout = layout.withDefaults()
+	if err := layout.validate(); err != nil {
+		return fmt.Errorf("cover-map layout: %w", err)
+	}
+
+	analysis := opts.Analysis
+	if analysis == "" {
+		analysis = AnalysisVerifier
+	}
+	if err := analysis.validate(); err != nil {
+		return err
+	}
+
+	if err := opts.Filter.validate(); err != nil {
+		return err
+	}
+
+	// Derived counts are the difference of counters, which is meaningless if counters saturate. Branch coverage
+	// counts the outcomes of jumps, which would need counters on the edges of the CFG.
+	if opts.MinimalProbes && opts.BranchCoverage {
+		return errors.New("minimal probes can't be combined with branch coverage")
+	}
+	if opts.MinimalProbes && layout.Saturating {
+		return errors.New("minimal probes can't be combined with saturating counters")
+	}
+
+	if err := opts.LookupFailure.withDefaults().Action.validate(); err != nil {
+		return err
+	}
+
+	granularity := opts.Granularity
+	if granularity == "" {
+		granularity = GranularityBlock
+	}
+	if err := granularity.validate(); err != nil {
+		return err
+	}
+	for name, progOpts := range opts.Programs {
+		if progOpts.Granularity == "" {
+			continue
+		}
+		if err := progOpts.Granularity.validate(); err != nil {
+			return fmt.Errorf("program '%s': %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Instrumentation is the result of instrumenting a collection.
+type Instrumentation struct {
+	// Layout of the counters in the cover-map as used by the instrumented programs.
+	Layout CoverMapLayout
+	// Name of the cover-map in the instrumented collection.
+	CoverMapName string
+	// The policy for failed cover-map lookups of each instrumented program, indexed by program name. Empty with
+	// `CounterStorageGlobal`.
+	LookupFailures map[string]LookupFailure
+	// The CFG of all instrumented programs, the index of a block is its block ID. Block IDs are assigned to the
+	// programs in order of their name.
+	Blocks []*BasicBlock
+	// The counter of each block, indexed by block ID. -1 for blocks of which the count is derived.
+	BlockCounters []int
+	// How the counts of blocks without counter are derived, only set with `InstrumentOptions.MinimalProbes`.
+	DerivedCounts []DerivedCount
+	// The programs and functions of which the entry block is instrumented.
+	Functions []FunctionCoverage
+	// The content-based identity of each block, indexed by block ID.
+	Identities []BlockIdentity
+	// The conditional jumps of which the outcomes are counted, only set if branch coverage is enabled.
+	Branches []BranchCoverage
+	// How each program was instrumented, indexed by program name. Programs which are filtered out are only present if
+	// they were excluded by a fallback strategy.
+	Programs map[string]ProgramInstrumentation
+	// The raw offset in the instrumented program of every raw instruction of the original program, indexed by program
+	// name and then by the raw offset in the original program. Jumps to an original instruction which starts a block
+	// enter at the instrumentation code of the block, which comes before the instruction.
+	InstructionOffsets map[string][]int
+
+	// How the instrumented programs relate to the original ones, indexed by program name.
+	programs map[string]*instrumentedProgram
+	// The verifier logs of the original programs, if the analysis used them.
+	verifierLogs map[string]string
+}
+
+// BlockList converts the CFG to a block-list which also records the cover-map layout, so it can be stored and later
+// applied to the contents of the cover-map.
+func (i *Instrumentation) BlockList() *BlockList {
+	return &BlockList{
+		Layout:         i.Layout,
+		Blocks:         CFGToBlockList(i.Blocks),
+		BlockCounters:  slices.Clone(i.BlockCounters),
+		DerivedCounts:  slices.Clone(i.DerivedCounts),
+		Functions:      slices.Clone(i.Functions),
+		Identities:     slices.Clone(i.Identities),
+		Branches:       slices.Clone(i.Branches),
+		LookupFailures: maps.Clone(i.LookupFailures),
+		Programs:       maps.Clone(i.Programs),
+	}
 }
 
 // InstrumentCollection adds instrumentation instructions to all programs contained within the given collection.
 // This "instrumentation" consists of an additional map with a single key and a value which is an array of 16-bit
-// counters. Each index of the array corresponds to the basic block index. The instrumentation code will increment
-// the counter just before the basic block is executed.
+// counters (see `InstrumentCollectionWithOptions` for other counter widths). Each index of the array corresponds to
+// the basic block index. The instrumentation code will increment the counter just before the basic block is executed.
 //
-// The given spec is modified with this instrumentation. The whole process is logged to the `logWriter` and a list of
-// all the basic blocks are returned and can later be matched to the counters in the map.
+// The given spec is modified with this instrumentation, `Instrumenter` instruments a copy instead. The whole process is
+// logged to the `logWriter` and a list of all the basic blocks are returned and can later be matched to the counters
+// in the map.
 //
 // Steps of the function:
 //  1. Load the original programs and collect the verbose verifier log
 //  2. Parse the verifier log, which tells us which registers and stack slots are occupied at any given time.
 //  3. Convert the program into a CFG(Control Flow Graph)
 //  4. At the start of each program and bpf-to-bpf function, load the cover-map's index 0 and store the map value in a
-//     available slot on the stack.
+//     available slot on the stack. With `CounterStorageGlobal` this step is skipped, the address of each counter is
+//     loaded directly.
 //  5. At the start of each block, load an offset into the cover-map value, increment it, write it back. This requires 2
 //     registers which can be clobbered. If only 1 or no registers are unused, store the register values to the stack
 //     and restore values afterwards.
@@ -76,7 +357,84 @@ func InstrumentAndLoadCollection(
 //     instrumentation.
 //  7. Load all modified program into the kernel.
 func InstrumentCollection(coll *ebpf.CollectionSpec, logWriter io.Writer) ([]*BasicBlock, error) {
+	instrumentation, err := InstrumentCollectionWithOptions(coll, InstrumentOptions{
+		LogWriter: logWriter,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return instrumentation.Blocks, nil
+}
+
+// InstrumentCollectionWithOptions is like `InstrumentCollection` but allows the caller to control the
+// instrumentation process with `opts`.
+func InstrumentCollectionWithOptions(coll *ebpf.CollectionSpec, opts InstrumentOptions) (*Instrumentation, error) {
+	return instrumentCollection(context.Background(), coll, opts)
+}
+
+// instrumentCollection instruments the collection in place, see `InstrumentCollection`. It stops with the error of
+// the context once the context is done.
+func instrumentCollection(
+	ctx context.Context,
+	coll *ebpf.CollectionSpec,
+	opts InstrumentOptions,
+) (*Instrumentation, error) {
+	logWriter := opts.LogWriter
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	layout := opts.Layout
+	firstCounter := 0
+	if opts.SharedCoverMap != nil {
+		layout = opts.SharedCoverMap.Layout
+		firstCounter = opts.SharedCoverMap.numCounters()
+	}
+	layout = layout.withDefaults()
+
+	analysis := opts.Analysis
+	if analysis == "" {
+		analysis = AnalysisVerifier
+	}
+
+	lookupFailure := opts.LookupFailure.withDefaults()
+
+	granularity := opts.Granularity
+	if granularity == "" {
+		granularity = GranularityBlock
+	}
+
+	coverMapName := opts.CoverMapName
+	if coverMapName == "" {
+		coverMapName = DefaultCoverMapName
+	}
+	if _, found := coll.Maps[coverMapName]; found {
+		return nil, fmt.Errorf(
+			"the collection already contains a map named '%s', pick another cover-map name", coverMapName,
+		)
+	}
+
+	// The kernel is only probed if the collection is loaded to record the verifier logs. Instrumenting offline gives
+	// the same result on every machine, shared counters work on every kernel.
+	var err error
+	if opts.VerifierLogs == nil && analysis.needsVerifierLog() {
+		layout, err = layout.resolveStrategy()
+		if err != nil {
+			return nil, err
+		}
+	} else if layout.Strategy == CounterStrategyAuto {
+		layout.Strategy = CounterStrategyShared
+	}
+
 	if logWriter != nil {
+		fmt.Fprintln(logWriter, "=== Counter strategy ===")
+		fmt.Fprintln(logWriter, layout.Strategy)
+
 		fmt.Fprintln(logWriter, "=== Original program ===")
 		for name, prog := range coll.Programs {
 			fmt.Fprintln(logWriter, "---", name, "---")
@@ -84,30 +442,40 @@ func InstrumentCollection(coll *ebpf.CollectionSpec, logWriter io.Writer) ([]*Ba
 		}
 	}
 
-	// Clone the spec so we can load and unload without side effects
-	clone := coll.Copy()
-	clonedOpts := ebpf.CollectionOptions{
-		Programs: ebpf.ProgramOptions{
-			LogLevel: ebpf.LogLevelInstruction,
-		},
+	verifierLogs := opts.VerifierLogs
+	if verifierLogs == nil && analysis.needsVerifierLog() {
+		verifierLogs, err = RecordVerifierLogsWithOptions(coll, opts.CollectionOptions)
+		if err != nil {
+			return nil, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
 	}
 
-	cloneColl, err := ebpf.NewCollectionWithOptions(clone, clonedOpts)
-	if err != nil {
-		return nil, fmt.Errorf("load program: %w", err)
+	if analysis.needsVerifierLog() {
+		for name := range coll.Programs {
+			if !opts.Filter.program(name) {
+				continue
+			}
+
+			if _, found := verifierLogs[name]; !found {
+				return nil, fmt.Errorf("no verifier log for program '%s'", name)
+			}
+		}
 	}
 
-	if logWriter != nil {
+	if logWriter != nil && analysis.needsVerifierLog() {
 		fmt.Fprintln(logWriter, "=== Original verifier logs ===")
-		for name, prog := range cloneColl.Programs {
+		for name := range coll.Programs {
 			fmt.Fprintln(logWriter, "---", name, "---")
-			fmt.Fprintln(logWriter, prog.VerifierLog)
+			fmt.Fprintln(logWriter, verifierLogs[name])
 		}
 
 		fmt.Fprintln(logWriter, "\n=== Parsed verifier logs ===")
-		for name, prog := range cloneColl.Programs {
+		for name := range coll.Programs {
 			fmt.Fprintln(logWriter, "---", name, "---")
-			for _, line := range verifierlog.ParseVerifierLog(prog.VerifierLog) {
+			for _, line := range verifierlog.ParseVerifierLog(verifierLogs[name]) {
 				spew.Fdump(logWriter, line)
 			}
 		}
@@ -115,163 +483,242 @@ func InstrumentCollection(coll *ebpf.CollectionSpec, logWriter io.Writer) ([]*Ba
 
 	blockList := make([]*BasicBlock, 0)
 
-	blockID := 0
-	if logWriter != nil {
-		fmt.Fprintln(logWriter, "\n=== Instrumentation ===")
+	// Counters are allocated for all programs up front, so we need to know the blocks and functions of all programs
+	// before instrumenting. Programs are sorted by name so block IDs and counters are the same for every load.
+	// Programs which are filtered out are left untouched.
+	progNames := make([]string, 0, len(coll.Programs))
+	for name := range coll.Programs {
+		if opts.Filter.program(name) {
+			progNames = append(progNames, name)
+		}
 	}
-	for name, prog := range coll.Programs {
-		mergedStates := verifierlog.MergedPerInstruction(cloneColl.Programs[name].VerifierLog)
-		if logWriter != nil {
-			fmt.Fprintln(logWriter, "---", name, "--- Merged states ---")
-			for i, mergedState := range mergedStates {
-				fmt.Fprintf(logWriter, "%5d: %s\n", i, mergedState.String())
-			}
+	sort.Strings(progNames)
+
+	progBlocks := make(map[string][]*BasicBlock, len(coll.Programs))
+	progSubFuncs := make(map[string]map[string]bool, len(coll.Programs))
+	progCallbacks := make(map[string]map[string]bool, len(coll.Programs))
+	progInstrumented := make(map[string][]bool, len(coll.Programs))
+	progInstrumentedFuncs := make(map[string]map[string]bool, len(coll.Programs))
+	progBranchCoverage := make(map[string]bool, len(coll.Programs))
+	progCounted := make(map[string][]bool, len(coll.Programs))
+	progDerived := make(map[string][]derivedBlock, len(coll.Programs))
+	programReports := make(map[string]ProgramInstrumentation, len(progNames))
+	var identities []BlockIdentity
+	for _, name := range progNames {
+		if err = ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		// TODO check per subprogram (it currently works, but uses way to much memory than is required)
-		progMaxFPOff := 0
-		for _, state := range mergedStates {
-			for _, slot := range state.Stack {
-				if slot.Offset > progMaxFPOff {
-					progMaxFPOff = slot.Offset
-				}
-			}
-		}
-		coverMapPFOff := progMaxFPOff + 8
-		regSave1FPOff := progMaxFPOff + 16
-		regSave2FPOff := progMaxFPOff + 24
+		prog := coll.Programs[name]
+		progBlocks[name] = ProgramBlocks(prog.Instructions)
+		progSubFuncs[name], progCallbacks[name] = subProgramFuncs(prog.Instructions)
 
-		if logWriter != nil {
-			fmt.Fprintln(logWriter, "---", name, "--- Stack offset ---")
-			fmt.Fprintln(logWriter, "Max used by prog:", progMaxFPOff)
-			fmt.Fprintln(logWriter, "Cover map value:", coverMapPFOff)
-			fmt.Fprintln(logWriter, "Reg save 1:", regSave1FPOff)
-			fmt.Fprintln(logWriter, "Reg save 2:", regSave2FPOff)
+		progOpts := opts.Programs[name]
+		progGranularity := progOpts.Granularity
+		if progGranularity == "" {
+			progGranularity = granularity
+		}
+		programReports[name] = ProgramInstrumentation{
+			Granularity:       progGranularity,
+			ExcludedFunctions: slices.Clone(progOpts.ExcludeFunctions),
 		}
 
-		blocks := ProgramBlocks(prog.Instructions)
-		instn := 0
+		filter := opts.Filter
+		filter.ExcludeFunctions = append(slices.Clip(filter.ExcludeFunctions), progOpts.ExcludeFunctions...)
+		progInstrumented[name] = filter.instrumentedBlocks(name, progBlocks[name], progSubFuncs[name])
+		progInstrumentedFuncs[name] = applyGranularity(
+			progGranularity, name, progBlocks[name], progSubFuncs[name], progInstrumented[name],
+		)
+		// Branches are only counted at block granularity, coarser granularities are meant to be cheaper.
+		progBranchCoverage[name] = opts.BranchCoverage && progGranularity == GranularityBlock
+
+		if opts.MinimalProbes && progGranularity == GranularityBlock {
+			progCounted[name], progDerived[name] = minimalProbes(
+				name, progBlocks[name], progSubFuncs[name], progInstrumented[name],
+			)
+		}
 
-		if logWriter != nil {
-			fmt.Fprintln(logWriter, "---", name, "--- Blocks ---")
-			for i, block := range blocks {
-				fmt.Fprint(logWriter, "Block ", i, ":\n")
-				fmt.Fprintln(logWriter, block.Block)
+		for i, identity := range blockIdentities(name, progBlocks[name]) {
+			if progInstrumented[name][i] {
+				identities = append(identities, identity)
 			}
 		}
+	}
 
-		blockList = append(blockList, blocks...)
+	funcs := splitFunctions(progNames, progBlocks, progSubFuncs, progInstrumented, progCounted, progBranchCoverage)
+	counters, err := allocateCounters(funcs, layout, firstCounter)
+	if err != nil {
+		return nil, fmt.Errorf("allocate counters: %w", err)
+	}
+	if len(counters.blockCounters) == 0 {
+		return nil, errors.New("the filter excludes all code, nothing to instrument")
+	}
+	layout.CountersPerEntry = counters.perEntry
 
-		newProgram := make([]asm.Instruction, 0, len(prog.Instructions)+2*len(blocks))
+	// Translate the derivations from blocks of the program to counters.
+	var derivedCounts []DerivedCount
+	blockID := 0
+	for _, name := range progNames {
+		blockIDs := make(map[int]int)
+		for i, instrumented := range progInstrumented[name] {
+			if instrumented {
+				blockIDs[i] = blockID
+				blockID++
+			}
+		}
 
-		subProgFuncs := make(map[string]bool)
-		for _, inst := range prog.Instructions {
-			if inst.IsFunctionCall() {
-				subProgFuncs[inst.Reference()] = true
+		for _, derived := range progDerived[name] {
+			count := DerivedCount{BlockID: blockIDs[derived.block]}
+			for block, factor := range derived.terms {
+				count.Terms = append(count.Terms, CounterTerm{
+					Counter: counters.blockCounters[blockIDs[block]],
+					Factor:  factor,
+				})
 			}
+			sort.Slice(count.Terms, func(i, j int) bool {
+				return count.Terms[i].Counter < count.Terms[j].Counter
+			})
+			derivedCounts = append(derivedCounts, count)
 		}
+	}
 
-		for _, block := range blocks {
-			instr := make(asm.Instructions, 0)
+	if logWriter != nil {
+		fmt.Fprintln(logWriter, "\n=== Counters ===")
+		fmt.Fprintln(logWriter, "Counters:", counters.total)
+		fmt.Fprintln(logWriter, "Counters per entry:", counters.perEntry)
+		fmt.Fprintln(logWriter, "Entries:", counters.numEntries())
+	}
 
-			blockSym := block.Block[0].Symbol()
-			// At the start of each program/sub-program we need to lookup the the covermap value and store in in the
-			// stack so we can access it while in the current stack frame.
-			if subProgFuncs[blockSym] || name == blockSym {
-				// 1. Get registers used by function
-				progFunc := btf.FuncMetadata(&block.Block[0])
-				if progFunc == nil {
-					return nil, fmt.Errorf("can't find Func for '%s' in '%s': %w", blockSym, name, err)
-				}
+	var (
+		branches  []BranchCoverage
+		functions []FunctionCoverage
+	)
 
-				funcProto, ok := progFunc.Type.(*btf.FuncProto)
-				if !ok {
-					return nil, fmt.Errorf("Func type for '%s' in '%s' is not a FuncProto", blockSym, name)
-				}
+	var lookupFailures map[string]LookupFailure
+	if layout.Storage == CounterStorageLookup {
+		lookupFailures = make(map[string]LookupFailure, len(progNames))
+	}
 
-				regCnt := len(funcProto.Params)
+	programs := make(map[string]*instrumentedProgram, len(progNames))
+	instructionOffsets := make(map[string][]int, len(progNames))
 
-				// 2.1. Initialize all un-initialized registers
-				// This allows us to assume we can always save a register to the stack
-				instr = append(instr,
-					asm.Mov.Imm(asm.R0, 0),
-				)
-				for i := asm.R1 + asm.Register(regCnt); i <= asm.R9; i++ {
-					instr = append(instr,
-						asm.Mov.Imm(i, 0),
-					)
-				}
+	blockID = 0
+	if logWriter != nil {
+		fmt.Fprintln(logWriter, "\n=== Instrumentation ===")
+	}
+	for _, name := range progNames {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
 
-				// 2.2. Store used registers in R6-R9 (and stack slot if all 5 regs are used)
-				if regCnt == 5 {
-					// We can store R1-R4 in R6-R9 but if a function uses all five registers we need to store
-					// R5 on the stack.
-					instr = append(instr,
-						asm.StoreMem(asm.R10, -int16(regSave2FPOff), asm.R5, asm.DWord),
-					)
-					regCnt = 4
-				}
+		prog := coll.Programs[name]
+		usage, err := analyzeProgram(name, prog.Instructions, verifierLogs[name], analysis, logWriter)
+		if err != nil {
+			return nil, fmt.Errorf("analyze program '%s': %w", name, err)
+		}
 
-				for i := asm.R1; i < asm.R1+asm.Register(regCnt); i++ {
-					instr = append(instr,
-						asm.Mov.Reg(i+5, i),
-					)
-				}
+		// The stack slots used by the instrumentation are placed just below the deepest slot used by the function
+		// they are in. Every bpf-to-bpf function has its own stack frame, so the offsets are set at the start of each
+		// function. Global counters are accessed directly, so no slot is needed for the pointer to the cover-map value.
+		instProg := &instrumentedProgram{
+			stackSlots: make(map[string][]int),
+		}
+		programs[name] = instProg
+
+		var coverMapPFOff, regSave1FPOff, regSave2FPOff int
+		setStackOffsets := func(fn string) error {
+			maxFPOff := usage.stackDepth[fn]
+			regSaveFPOff := maxFPOff
+			if layout.Storage == CounterStorageLookup {
+				coverMapPFOff = maxFPOff + 8
+				regSaveFPOff = coverMapPFOff
+			}
+			regSave1FPOff = regSaveFPOff + 8
+			regSave2FPOff = regSaveFPOff + 16
 
-				instr = append(instr,
-					// 3. Load map ptr
-					asm.LoadMapPtr(asm.R1, 0).WithReference("coverbee_covermap"),
-					// 4. Store key=0 in regSave1 slot
-					asm.Mov.Reg(asm.R2, asm.R10),
-					asm.Add.Imm(asm.R2, -int32(regSave1FPOff)),
-					asm.StoreImm(asm.R2, 0, 0, asm.DWord),
-					// 5. Lookup map value
-					asm.FnMapLookupElem.Call(),
-					// 6. Null check (exit on R0 = null)
-					//    Note: Exit with code 1, some program types have restrictions on return values.
-					asm.Instruction{
-						OpCode:   asm.OpCode(asm.JumpClass).SetJumpOp(asm.JNE).SetSource(asm.ImmSource),
-						Dst:      asm.R0,
-						Offset:   2,
-						Constant: 0,
-					},
-					asm.Mov.Imm(asm.R0, 1),
-					asm.Return(),
-					// 7. Store map value on in coverMapFPOff
-					asm.StoreMem(asm.R10, -int16(coverMapPFOff), asm.R0, asm.DWord),
+			instProg.stackSlots[fn] = []int{regSave1FPOff, regSave2FPOff}
+			if layout.Storage == CounterStorageLookup {
+				instProg.stackSlots[fn] = append(instProg.stackSlots[fn], coverMapPFOff)
+			}
+
+			if regSave2FPOff > maxStackDepth {
+				return fmt.Errorf(
+					"function '%s' in program '%s' uses %d bytes of stack, which leaves no room for the %d bytes "+
+						"used by the instrumentation", fn, name, maxFPOff, regSave2FPOff-maxFPOff,
 				)
+			}
 
-				// 8. Restore R1-R5
-				for i := asm.R1; i < asm.R1+asm.Register(regCnt); i++ {
-					instr = append(instr,
-						asm.Mov.Reg(i, i+5),
-					)
+			if logWriter != nil {
+				fmt.Fprintln(logWriter, "---", name, "---", fn, "--- Stack offset ---")
+				fmt.Fprintln(logWriter, "Max used by func:", maxFPOff)
+				if layout.Storage == CounterStorageLookup {
+					fmt.Fprintln(logWriter, "Cover map value:", coverMapPFOff)
 				}
+				fmt.Fprintln(logWriter, "Reg save 1:", regSave1FPOff)
+				fmt.Fprintln(logWriter, "Reg save 2:", regSave2FPOff)
+			}
 
-				if len(funcProto.Params) == 5 {
-					instr = append(instr,
-						asm.LoadMem(asm.R5, asm.R10, -int16(regSave2FPOff), asm.DWord),
-					)
-				}
+			return nil
+		}
+
+		var progLookupFailure LookupFailure
+		if layout.Storage == CounterStorageLookup {
+			progLookupFailure = lookupFailure.resolve(prog.Type)
+			lookupFailures[name] = progLookupFailure
+
+			if logWriter != nil {
+				fmt.Fprintln(logWriter, "---", name, "--- Lookup failure ---")
+				fmt.Fprintf(logWriter, "%+v\n", progLookupFailure)
 			}
+		}
 
-			// Index which registers are sometimes used and which are never used
-			var usedRegs [11]bool
+		blocks := progBlocks[name]
+		instn := 0
 
-			// It is possible that the number of merged states is lower than the instruction count if
-			// the end of a program is dynamically dead code. (the verifier didn't reach it but it also doesn't error)
-			if instn < len(mergedStates) && !mergedStates[instn].Unknown {
-				// Index which registers are sometimes used and which are never used
-				for _, reg := range mergedStates[instn].Registers {
-					usedRegs[reg.Register] = true
-				}
-			} else {
-				// Mark all registers as in use, that is the worst case assumption, but it should work even
-				// without verifier log.
-				for i := range usedRegs {
-					usedRegs[i] = true
+		if logWriter != nil {
+			fmt.Fprintln(logWriter, "---", name, "--- Blocks ---")
+			for i, block := range blocks {
+				fmt.Fprint(logWriter, "Block ", i, ":\n")
+				fmt.Fprintln(logWriter, block.Block)
+			}
+		}
+
+		newProgram := make([]asm.Instruction, 0, len(prog.Instructions)+2*len(blocks))
+
+		// addOrigins records the origin of the given instructions, which are appended to the new program.
+		var funcSym string
+		addOrigins := func(insns asm.Instructions, original int, instrumentation bool) {
+			for _, inst := range insns {
+				for i := uint64(0); i < inst.Size()/asm.InstructionSize; i++ {
+					instProg.origins = append(instProg.origins, instructionOrigin{
+						original:        original,
+						instrumentation: instrumentation,
+						function:        funcSym,
+					})
+					if !instrumentation {
+						original++
+					}
 				}
 			}
+		}
+
+		subProgFuncs := progSubFuncs[name]
+		callbacks := progCallbacks[name]
+		instrumented := progInstrumented[name]
+		instrumentedFuncs := progInstrumentedFuncs[name]
+
+		// incrementCounter returns the instructions which increment the given counter, these instructions clobber no
+		// registers which are in use at instruction `instn` of the original program.
+		incrementCounter := func(counterID, instn int) asm.Instructions {
+			instr := make(asm.Instructions, 0)
+
+			// Index which registers are sometimes used and which are never used. If the usage at the instruction is
+			// unknown all registers are marked as in use, that is the worst case assumption.
+			var usedRegs [11]bool
+			regs := usage.usedRegisters(instn)
+			for i := range usedRegs {
+				usedRegs[i] = regs.has(asm.Register(i))
+			}
 
 			var (
 				unusedR1 asm.Register = 255
@@ -318,16 +765,64 @@ func InstrumentCollection(coll *ebpf.CollectionSpec, logWriter io.Writer) ([]*Ba
 				)
 			}
 
-			instr = append(instr,
-				// Load cover map value into `mapValR`
-				asm.LoadMem(mapValR, asm.R10, -int16(coverMapPFOff), asm.DWord),
-				// Get the current count of the blockID
-				asm.LoadMem(counterR, mapValR, int16(blockID)*2, asm.Half),
-				// Increment it
-				asm.Add.Imm(counterR, 1),
-				// Write it back
-				asm.StoreMem(mapValR, int16(blockID)*2, counterR, asm.Half),
-			)
+			counterOff := counters.offset(counterID, layout.CounterWidth)
+			counterSize := layout.CounterWidth.asmSize()
+			if layout.Storage == CounterStorageGlobal {
+				// Load the address of the counter into `mapValR`, all counters are in the first entry so the offset
+				// of the counter is the offset into the map value. It doesn't have to fit in the 16-bit offset of
+				// the instructions below.
+				instr = append(instr,
+					asm.LoadMapValue(mapValR, 0, uint32(counterID*layout.CounterWidth.Bytes())).
+						WithReference(coverMapName),
+				)
+				counterOff = 0
+			} else {
+				instr = append(instr,
+					// Load cover map value into `mapValR`
+					asm.LoadMem(mapValR, asm.R10, -int16(coverMapPFOff), asm.DWord),
+				)
+			}
+
+			increment := make(asm.Instructions, 0)
+			if layout.Strategy == CounterStrategyAtomic {
+				addOne := asm.StoreXAdd(mapValR, counterR, counterSize)
+				addOne.Offset = counterOff
+				increment = append(increment,
+					asm.Mov.Imm(counterR, 1),
+					// Atomically increment the counter
+					addOne,
+				)
+			} else {
+				increment = append(increment,
+					// Get the current count
+					asm.LoadMem(counterR, mapValR, counterOff, counterSize),
+				)
+				if layout.Saturating {
+					increment = append(increment,
+						// Skip the increment and write if the counter is already at its max value
+						layout.CounterWidth.jumpIfMax(counterR, 2),
+					)
+				}
+				increment = append(increment,
+					// Increment it
+					asm.Add.Imm(counterR, 1),
+					// Write it back
+					asm.StoreMem(mapValR, counterOff, counterR, counterSize),
+				)
+			}
+
+			if progLookupFailure.Action == LookupFailureSkip {
+				instr = append(instr,
+					// Skip the increment if the lookup at the start of the function failed
+					asm.Instruction{
+						OpCode:   asm.OpCode(asm.JumpClass).SetJumpOp(asm.JEq).SetSource(asm.ImmSource),
+						Dst:      mapValR,
+						Offset:   int16(increment.Size() / asm.InstructionSize),
+						Constant: 0,
+					},
+				)
+			}
+			instr = append(instr, increment...)
 
 			if unusedR1 == 255 {
 				// Restore map value register if it was saved
@@ -343,19 +838,218 @@ func InstrumentCollection(coll *ebpf.CollectionSpec, logWriter io.Writer) ([]*Ba
 				)
 			}
 
+			return instr
+		}
+
+		for i, block := range blocks {
+			instr := make(asm.Instructions, 0)
+
+			blockSym := block.Block[0].Symbol()
+			if i == 0 || subProgFuncs[blockSym] || name == blockSym {
+				funcSym = blockSym
+				if instrumented[i] {
+					functions = append(functions, newFunctionCoverage(name, blockID, block))
+				}
+			}
+			// At the start of each program/sub-program we need to lookup the the covermap value and store in in the
+			// stack so we can access it while in the current stack frame. Global counters don't need a lookup.
+			// Functions without instrumented blocks are left as they are.
+			if (subProgFuncs[blockSym] || name == blockSym) && instrumentedFuncs[blockSym] {
+				if err = setStackOffsets(blockSym); err != nil {
+					return nil, err
+				}
+
+				// 1. Get registers used by function
+				progFunc := btf.FuncMetadata(&block.Block[0])
+				if progFunc == nil {
+					return nil, fmt.Errorf("can't find Func for '%s' in '%s': %w", blockSym, name, err)
+				}
+
+				funcProto, ok := progFunc.Type.(*btf.FuncProto)
+				if !ok {
+					return nil, fmt.Errorf("Func type for '%s' in '%s' is not a FuncProto", blockSym, name)
+				}
+
+				regCnt := len(funcProto.Params)
+
+				// 2.1. Initialize all un-initialized registers
+				// This allows us to assume we can always save a register to the stack
+				instr = append(instr,
+					asm.Mov.Imm(asm.R0, 0),
+				)
+				for i := asm.R1 + asm.Register(regCnt); i <= asm.R9; i++ {
+					instr = append(instr,
+						asm.Mov.Imm(i, 0),
+					)
+				}
+
+				// Global counters are accessed directly, so the cover-map value doesn't have to be looked up.
+				if layout.Storage == CounterStorageLookup {
+					// Exit with the return value of the policy if the lookup fails. Callbacks of helpers like bpf_loop
+					// and bpf_for_each_map_elem must return 0 or 1 and for some, like timer callbacks, 0 is the only
+					// valid return value.
+					lookupFailRet := progLookupFailure.ReturnValue
+					if callbacks[blockSym] {
+						lookupFailRet = 0
+					}
+
+					// 2.2. Store used registers in R6-R9 (and stack slot if all 5 regs are used)
+					if regCnt == 5 {
+						// We can store R1-R4 in R6-R9 but if a function uses all five registers we need to store
+						// R5 on the stack.
+						instr = append(instr,
+							asm.StoreMem(asm.R10, -int16(regSave2FPOff), asm.R5, asm.DWord),
+						)
+						regCnt = 4
+					}
+
+					for i := asm.R1; i < asm.R1+asm.Register(regCnt); i++ {
+						instr = append(instr,
+							asm.Mov.Reg(i+5, i),
+						)
+					}
+
+					instr = append(instr,
+						// 3. Load map ptr
+						asm.LoadMapPtr(asm.R1, 0).WithReference(coverMapName),
+						// 4. Store the key of the entry holding the counters of this function in regSave1 slot
+						asm.Mov.Reg(asm.R2, asm.R10),
+						asm.Add.Imm(asm.R2, -int32(regSave1FPOff)),
+						asm.StoreImm(asm.R2, 0, int64(counters.blockEntries[blockID]), asm.Word),
+						// 5. Lookup map value
+						asm.FnMapLookupElem.Call(),
+					)
+
+					// 6. Null check (exit on R0 = null). When skipping, the null check is done before every counter
+					// increment instead.
+					if progLookupFailure.Action != LookupFailureSkip {
+						instr = append(instr,
+							asm.Instruction{
+								OpCode:   asm.OpCode(asm.JumpClass).SetJumpOp(asm.JNE).SetSource(asm.ImmSource),
+								Dst:      asm.R0,
+								Offset:   2,
+								Constant: 0,
+							},
+							asm.Mov.Imm(asm.R0, lookupFailRet),
+							asm.Return(),
+						)
+					}
+
+					instr = append(instr,
+						// 7. Store map value on in coverMapFPOff
+						asm.StoreMem(asm.R10, -int16(coverMapPFOff), asm.R0, asm.DWord),
+					)
+
+					// 8. Restore R1-R5
+					for i := asm.R1; i < asm.R1+asm.Register(regCnt); i++ {
+						instr = append(instr,
+							asm.Mov.Reg(i, i+5),
+						)
+					}
+
+					if len(funcProto.Params) == 5 {
+						instr = append(instr,
+							asm.LoadMem(asm.R5, asm.R10, -int16(regSave2FPOff), asm.DWord),
+						)
+					}
+				}
+			}
+
+			counted := instrumented[i] && counters.blockCounters[blockID] >= 0
+			if !counted && len(instr) == 0 {
+				// Blocks which are filtered out, or of which the count is derived, keep their original instructions.
+				newProgram = append(newProgram, block.Block...)
+				addOrigins(block.Block, instn, false)
+				instn += int(block.Block.Size()) / asm.InstructionSize
+
+				if instrumented[i] {
+					blockList = append(blockList, block)
+					blockID++
+				}
+				continue
+			}
+
+			if counted {
+				instr = append(instr, incrementCounter(counters.blockCounters[blockID], instn)...)
+			}
+
 			// Move the metadata from head of the original code to the instrumented block so jumps and function calls
-			// enter at the instrumented code first.
-			newProgram = append(newProgram, instr[0].WithMetadata(block.Block[0].Metadata))
+			// enter at the instrumented code first. The reference is not moved, it belongs to the original instruction
+			// and the instrumented code might have a reference of its own to the cover-map.
+			head := instr[0].WithMetadata(block.Block[0].Metadata).WithReference(instr[0].Reference())
+			newProgram = append(newProgram, head)
 			newProgram = append(newProgram, instr[1:]...)
+			addOrigins(instr, instn, true)
 
 			// Remove the symbol and function metadata from the original start of the basic block since the symbol
 			// was moved to the instrumented code for any jump targets along with the BTF function info.
-			newProgram = append(newProgram, btf.WithFuncMetadata(block.Block[0].WithSymbol(""), nil))
-			newProgram = append(newProgram, block.Block[1:]...)
+			body := make(asm.Instructions, 0, len(block.Block))
+			body = append(body, btf.WithFuncMetadata(block.Block[0].WithSymbol(""), nil))
+			body = append(body, block.Block[1:]...)
+
+			if instrumented[i] && progBranchCoverage[name] && isConditionalJump(body[len(body)-1]) {
+				branch := BranchCoverage{
+					BlockID:         blockID,
+					TakenCounter:    counters.branchCounters[blockID],
+					NotTakenCounter: counters.branchCounters[blockID] + 1,
+				}
+				branch.Filename, branch.Line = lastSourceLine(block.Block)
+				branches = append(branches, branch)
+
+				// The instrumentation of both outcomes can use the registers which are unused at the jump.
+				jumpInstn := instn + int(block.Block[:len(block.Block)-1].Size())/asm.InstructionSize
+
+				// Redirect the jump to a trampoline which counts the taken outcome before jumping to the original
+				// target.
+				jump := &body[len(body)-1]
+				target := jump.Reference()
+				takenLabel := fmt.Sprintf("coverbee-branch-%d", branch.TakenCounter)
+				*jump = jump.WithReference(takenLabel)
+
+				taken := incrementCounter(branch.TakenCounter, jumpInstn)
+				taken[0] = taken[0].WithSymbol(takenLabel)
+				taken = append(taken, asm.Ja.Label(target))
+
+				// If the jump is not taken, we count the not-taken outcome and skip over the trampoline.
+				notTaken := incrementCounter(branch.NotTakenCounter, jumpInstn)
+				notTaken = append(notTaken, asm.Instruction{
+					OpCode: asm.OpCode(asm.JumpClass).SetJumpOp(asm.Ja),
+					Offset: int16(taken.Size() / asm.InstructionSize),
+				})
+
+				body = append(body, notTaken...)
+				body = append(body, taken...)
+			}
+
+			newProgram = append(newProgram, body...)
+			addOrigins(body[:len(block.Block)], instn, false)
+			// The branch instrumentation is added for the jump at the end of the block.
+			lastInstn := instn + int(block.Block[:len(block.Block)-1].Size())/asm.InstructionSize
+			addOrigins(body[len(block.Block):], lastInstn, true)
 
 			instn += int(block.Block.Size()) / asm.InstructionSize
 
-			blockID++
+			if instrumented[i] {
+				blockList = append(blockList, block)
+				blockID++
+			}
+		}
+
+		// Every frame fits on its own, but the kernel also limits the stack of all frames of a bpf-to-bpf call chain
+		// combined, which the slots added to each frame can push over the limit.
+		frameDepths := make(map[string]int, len(usage.stackDepth))
+		for fn, depth := range usage.stackDepth {
+			frameDepths[fn] = depth
+			for _, off := range instProg.stackSlots[fn] {
+				frameDepths[fn] = max(frameDepths[fn], off)
+			}
+		}
+		chain, depth := deepestCallChain(name, callGraph(name, prog.Instructions), frameDepths)
+		if depth > maxStackDepth {
+			return nil, fmt.Errorf(
+				"call chain %s in program '%s' uses %d bytes of stack with the instrumentation, more than the %d "+
+					"bytes allowed", strings.Join(chain, " -> "), name, depth, maxStackDepth,
+			)
 		}
 
 		if logWriter != nil {
@@ -363,136 +1057,296 @@ func InstrumentCollection(coll *ebpf.CollectionSpec, logWriter io.Writer) ([]*Ba
 			fmt.Fprintln(logWriter, asm.Instructions(newProgram))
 		}
 
+		// Every original instruction is copied to the instrumented program exactly once.
+		offsets := make([]int, instn)
+		for off, origin := range instProg.origins {
+			if !origin.instrumentation {
+				offsets[origin.original] = off
+			}
+		}
+		instructionOffsets[name] = offsets
+
+		report := programReports[name]
+		for _, blockInstrumented := range instrumented {
+			if blockInstrumented {
+				report.Blocks++
+			}
+		}
+		report.Instructions = instn
+		report.InstrumentedInstructions = len(instProg.origins)
+		programReports[name] = report
+
 		coll.Programs[name].Instructions = newProgram
 	}
 
-	cloneColl.Close()
-
 	coverMap := ebpf.MapSpec{
 		Name:       "covermap",
-		Type:       ebpf.Array,
+		Type:       layout.mapType(),
 		KeySize:    4,
-		MaxEntries: 1,
-		ValueSize:  uint32(2 * (blockID + 1)),
+		MaxEntries: uint32(counters.numEntries()),
+		ValueSize:  uint32(layout.CounterWidth.Bytes() * counters.perEntry),
 	}
-	coll.Maps["coverbee_covermap"] = &coverMap
+	coll.Maps[coverMapName] = &coverMap
+
+	return &Instrumentation{
+		Layout:             layout,
+		CoverMapName:       coverMapName,
+		LookupFailures:     lookupFailures,
+		Blocks:             blockList,
+		BlockCounters:      counters.blockCounters,
+		DerivedCounts:      derivedCounts,
+		Functions:          functions,
+		Identities:         identities,
+		Branches:           branches,
+		Programs:           programReports,
+		InstructionOffsets: instructionOffsets,
+		programs:           programs,
+		verifierLogs:       verifierLogs,
+	}, nil
+}
 
-	return blockList, nil
+// RecordVerifierLogs loads a copy of the given collection and returns the verifier logs of all programs at
+// `ebpf.LogLevelInstruction`, indexed by program name. The logs can be stored and passed to the instrumentation later
+// via `InstrumentOptions.VerifierLogs` to instrument without loading the programs.
+func RecordVerifierLogs(coll *ebpf.CollectionSpec) (map[string]string, error) {
+	return RecordVerifierLogsWithOptions(coll, ebpf.CollectionOptions{})
 }
 
-// ProgramBlocks takes a list of instructions and converts it into a a CFG(Control Flow Graph).
-// Which works as follows:
-//  1. Construct a translation map from RawOffsets to the instructions(since index within the slice doesn't account for
-//     LDIMM64 instructions which use two instructions).
-//  2. Apply a label to every jump target and set that label as a reference in the branching instruction. This does two
-//     things. First, it makes it easy to find all block boundaries since each block has a function name or jump label.
-//     The second is that cilium/ebpf will recalculate the offsets of the jumps based on the symbols when loading, so
-//     we can easily add instructions to blocks without fear of breaking offsets.
-//  3. Loop over all instructions, creating a block at each branching instruction or symbol/jump label.
-//  4. Build a translation map from symbol/jump label to block.
-//  5. Loop over all blocks, using the map from step 4 to link blocks together on the branching and non-branching edges.
-func ProgramBlocks(prog asm.Instructions) []*BasicBlock {
-	prog = slices.Clone(prog)
+// RecordVerifierLogsWithOptions is like `RecordVerifierLogs` but loads the copy with the given options, so the
+// verifier sees the same maps and kernel types as when loading the collection with these options. Maps which are
+// already pinned under `ebpf.MapOptions.PinPath` are reused, but no new pins are created.
+func RecordVerifierLogsWithOptions(coll *ebpf.CollectionSpec, opts ebpf.CollectionOptions) (map[string]string, error) {
+	// Clone the spec so loading it doesn't change the spec of the caller
+	clone := coll.Copy()
 
-	// Make a RawInstOffset -> instruction lookup which improves performance during jump labeling
-	iter := prog.Iterate()
-	offToInst := map[asm.RawInstructionOffset]*asm.Instruction{}
-	for iter.Next() {
-		offToInst[iter.Offset] = iter.Ins
+	pinned, err := pinnedMaps(clone, opts.Maps.PinPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, m := range pinned {
+			m.Close()
+		}
+	}()
+	// The maps which aren't pinned yet are created without pin.
+	for _, m := range clone.Maps {
+		m.Pinning = ebpf.PinNone
 	}
 
-	iter = prog.Iterate()
-	for iter.Next() {
-		inst := iter.Ins
+	cloneColl, err := ebpf.NewCollectionWithOptions(clone, verifierLogOptions(clone, opts, pinned))
+	if err != nil {
+		return nil, fmt.Errorf("load program: %w", err)
+	}
+	defer cloneColl.Close()
+
+	logs := make(map[string]string, len(cloneColl.Programs))
+	for name, prog := range cloneColl.Programs {
+		logs[name] = prog.VerifierLog
+	}
+
+	return logs, nil
+}
+
+// verifierLogOptions returns the options used to load the collection to record its verifier logs, based on the given
+// options. Replacements of maps which aren't part of the collection, like the cover-map when appending to a shared
+// one, are left out since the collection can't be loaded with them. The pin path is left out as well so the load
+// doesn't pin any maps, the given pinned maps replace the maps which would be reused from the pin path instead.
+func verifierLogOptions(
+	coll *ebpf.CollectionSpec, opts ebpf.CollectionOptions, pinned map[string]*ebpf.Map,
+) ebpf.CollectionOptions {
+	opts.Programs.LogLevel = ebpf.LogLevelInstruction
+	opts.Programs.LogDisabled = false
+	opts.Maps.PinPath = ""
+
+	replacements := opts.MapReplacements
+	opts.MapReplacements = make(map[string]*ebpf.Map, len(replacements)+len(pinned))
+	for name, m := range pinned {
+		opts.MapReplacements[name] = m
+	}
+	for name, m := range replacements {
+		if _, found := coll.Maps[name]; found {
+			opts.MapReplacements[name] = m
+		}
+	}
+
+	return opts
+}
+
+// pinnedMaps opens the maps of the collection which are pinned by name and of which a pin exists in the given
+// directory, indexed by map name. The caller must close the returned maps.
+func pinnedMaps(coll *ebpf.CollectionSpec, pinPath string) (map[string]*ebpf.Map, error) {
+	pinned := make(map[string]*ebpf.Map)
+	if pinPath == "" {
+		return pinned, nil
+	}
 
-		// Ignore non-jump ops, or "special" jump instructions
-		op := inst.OpCode.JumpOp()
-		switch op {
-		case asm.InvalidJumpOp, asm.Call, asm.Exit:
+	for name, spec := range coll.Maps {
+		if spec.Pinning != ebpf.PinByName {
 			continue
 		}
 
-		targetOff := iter.Offset + asm.RawInstructionOffset(inst.Offset+1)
-		label := fmt.Sprintf("j-%d", targetOff)
+		m, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, spec.Name), nil)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			for _, m := range pinned {
+				m.Close()
+			}
+			return nil, fmt.Errorf("open pinned map '%s': %w", name, err)
+		}
+		pinned[name] = m
+	}
 
-		target := offToInst[targetOff]
-		*target = target.WithSymbol(label)
+	return pinned, nil
+}
 
-		inst.Offset = -1
-		*inst = inst.WithReference(label)
+// isConditionalJump returns true if the instruction is a jump which can either be taken or not taken.
+func isConditionalJump(inst asm.Instruction) bool {
+	switch inst.OpCode.JumpOp() {
+	case asm.InvalidJumpOp, asm.Ja, asm.Call, asm.Exit:
+		return false
+	default:
+		return true
 	}
+}
 
-	blocks := make([]*BasicBlock, 0)
-	curBlock := &BasicBlock{}
-	for _, inst := range prog {
-		if inst.Symbol() != "" {
-			if len(curBlock.Block) > 0 {
-				newBlock := &BasicBlock{
-					Index: curBlock.Index + 1,
-				}
-				curBlock.NoBranch = newBlock
-				blocks = append(blocks, curBlock)
-				curBlock = newBlock
-			}
+// subProgramFuncs returns the symbols of all sub-programs of the given instructions, which are the bpf-to-bpf functions
+// called directly and the callback functions passed to helpers like bpf_loop via a function pointer. The callbacks are
+// also returned separately since they have different restrictions on return values.
+func subProgramFuncs(insns asm.Instructions) (funcs, callbacks map[string]bool) {
+	funcs = make(map[string]bool)
+	callbacks = make(map[string]bool)
+	for _, inst := range insns {
+		if inst.IsFunctionReference() {
+			funcs[inst.Reference()] = true
+		}
+		if inst.IsLoadOfFunctionPointer() {
+			callbacks[inst.Reference()] = true
 		}
+	}
 
-		curBlock.Block = append(curBlock.Block, inst)
+	return funcs, callbacks
+}
 
-		// Continue on non-jump ops
-		op := inst.OpCode.JumpOp()
-		if op == asm.InvalidJumpOp {
+// callGraph returns the functions called by each function of the program with the given name. Callbacks passed to
+// helpers like bpf_loop count as called by the function which passes them, since their frame is placed on top of it.
+func callGraph(name string, insns asm.Instructions) map[string][]string {
+	funcs := functionOfInstruction(name, insns)
+	graph := make(map[string][]string)
+	iter := insns.Iterate()
+	for iter.Next() {
+		if !iter.Ins.IsFunctionReference() {
 			continue
 		}
 
-		newBlock := &BasicBlock{
-			Index: curBlock.Index + 1,
+		caller := funcs[iter.Offset]
+		if callee := iter.Ins.Reference(); !slices.Contains(graph[caller], callee) {
+			graph[caller] = append(graph[caller], callee)
 		}
+	}
+
+	return graph
+}
 
-		if op != asm.Exit {
-			// If the current op is exit, then the current block will not continue into the block after it.
-			curBlock.NoBranch = newBlock
+// deepestCallChain returns the call chain starting at the given function which uses the most stack, and the bytes of
+// stack it uses. Like the kernel does, the size of every frame is rounded up to 32 bytes.
+func deepestCallChain(fn string, graph map[string][]string, frameDepths map[string]int) ([]string, int) {
+	type chainDepth struct {
+		chain []string
+		depth int
+	}
+	deepest := make(map[string]chainDepth)
+	onChain := make(map[string]bool)
+
+	var walk func(fn string) chainDepth
+	walk = func(fn string) chainDepth {
+		if cd, found := deepest[fn]; found {
+			return cd
 		}
 
-		blocks = append(blocks, curBlock)
-		curBlock = newBlock
+		// Recursion is rejected by the verifier, stop at the first repeated function so it doesn't hang us.
+		var callees chainDepth
+		onChain[fn] = true
+		for _, callee := range graph[fn] {
+			if onChain[callee] {
+				continue
+			}
+			if cd := walk(callee); cd.depth > callees.depth {
+				callees = cd
+			}
+		}
+		onChain[fn] = false
+
+		cd := chainDepth{
+			chain: append([]string{fn}, callees.chain...),
+			depth: (max(frameDepths[fn], 1)+31)/32*32 + callees.depth,
+		}
+		deepest[fn] = cd
+		return cd
 	}
 
-	symToBlock := make(map[string]*BasicBlock)
+	cd := walk(fn)
+	return cd.chain, cd.depth
+}
+
+// blockIdentities returns the identity of each of the given blocks of the program with the given name.
+func blockIdentities(progName string, blocks []*BasicBlock) []BlockIdentity {
+	identities := make([]BlockIdentity, 0, len(blocks))
+	offset := 0
 	for _, block := range blocks {
-		sym := block.Block[0].Symbol()
-		if sym != "" {
-			symToBlock[sym] = block
+		identity := BlockIdentity{
+			Program: progName,
+			Offset:  offset,
 		}
+		identity.Filename, identity.Line = firstSourceLine(block.Block)
+		identities = append(identities, identity)
+
+		offset += int(block.Block.Size()) / asm.InstructionSize
 	}
 
-	for _, block := range blocks {
-		lastInst := block.Block[len(block.Block)-1]
+	return identities
+}
+
+// firstSourceLine returns the file name and line number of the first instruction with line info in the given block.
+func firstSourceLine(block asm.Instructions) (string, int) {
+	for _, inst := range block {
+		if line, ok := inst.Source().(*btf.Line); ok {
+			return filepath.Clean(line.FileName()), int(line.LineNumber())
+		}
+	}
+
+	return "", 0
+}
 
-		// Ignore non-jump ops and exit's
-		op := lastInst.OpCode.JumpOp()
-		switch op {
-		case asm.InvalidJumpOp, asm.Exit:
+// lastSourceLine returns the file name and line number of the last instruction with line info in the given block.
+func lastSourceLine(block asm.Instructions) (string, int) {
+	var (
+		fileName string
+		lineNum  int
+	)
+	for _, inst := range block {
+		line, ok := inst.Source().(*btf.Line)
+		if !ok {
 			continue
 		}
 
-		block.Branch = symToBlock[lastInst.Reference()]
+		fileName = filepath.Clean(line.FileName())
+		lineNum = int(line.LineNumber())
 	}
 
-	return blocks
+	return fileName, lineNum
 }
 
-// BasicBlock is a block of non-branching code, which makes up a node within the CFG.
-type BasicBlock struct {
-	Index int
-	// The current block of code
-	Block asm.Instructions
-
-	// The next block of we don't branch
-	NoBranch *BasicBlock
-	// The next block if we do branch
-	Branch *BasicBlock
+// ProgramBlocks takes a list of instructions and converts it into a a CFG(Control Flow Graph), see
+// `cfg.ProgramBlocks`.
+func ProgramBlocks(prog asm.Instructions) []*BasicBlock {
+	return cfg.ProgramBlocks(prog)
 }
 
+// BasicBlock is a block of non-branching code, which makes up a node within the CFG.
+type BasicBlock = cfg.BasicBlock
+
 // CFGToBlockList convert a CFG to a "BlockList", the outer slice indexed by BlockID which maps to an inner slice, each
 // element of which is a reference to a specific block of code inside a source file. Thus the resulting block list
 // can be used to translate blockID's into the pieces of source code to apply coverage mapping.
@@ -528,24 +1382,12 @@ func CFGToBlockList(cfg []*BasicBlock) [][]CoverBlock {
 }
 
 // ApplyCoverMapToBlockList reads from the coverage map and applies the counts inside the map to the block list.
-// The blocklist can be iterated after this to create a go-cover coverage file.
+// The blocklist can be iterated after this to create a go-cover coverage file. The cover-map is assumed to use the
+// default layout with all counters in a single entry, use `BlockList.ApplyCoverMap` for cover-maps with a different
+// layout, collections with too many blocks for a single entry or collections instrumented with minimal probes, of
+// which the counts of blocks without counter have to be derived.
 func ApplyCoverMapToBlockList(coverMap *ebpf.Map, blockList [][]CoverBlock) error {
-	key := uint32(0)
-	value := make([]byte, coverMap.ValueSize())
-
-	err := coverMap.Lookup(&key, &value)
-	if err != nil {
-		return fmt.Errorf("error looking up coverage output: %w", err)
-	}
-
-	for blockID, lines := range blockList {
-		blockCnt := nativeEndianess().Uint16(value[blockID*2 : (blockID+1)*2])
-		for i := range lines {
-			blockList[blockID][i].ProfileBlock.Count = int(blockCnt)
-		}
-	}
-
-	return nil
+	return applyCoverMap(coverMap, CoverMapLayout{}.withDefaults(), blockList)
 }
 
 var nativeEndian binary.ByteOrder
@@ -0,0 +1,521 @@
+package coverbee
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/andreyvit/diff"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files in testdata")
+
+// TestInstrumentGolden instruments the example programs with recorded verifier logs and compares the instrumented
+// assembly to the golden files in testdata. Run with `-update` to update the golden files.
+func TestInstrumentGolden(t *testing.T) {
+	tests := []struct {
+		example string
+		name    string
+		opts    InstrumentOptions
+	}{
+		{
+			example: "bpf-to-bpf",
+			name:    "shared",
+			opts: InstrumentOptions{
+				Layout: CoverMapLayout{Strategy: CounterStrategyShared},
+			},
+		},
+		{
+			example: "bpf-to-bpf",
+			name:    "static-analysis",
+			opts: InstrumentOptions{
+				Layout:   CoverMapLayout{Strategy: CounterStrategyShared},
+				Analysis: AnalysisStatic,
+			},
+		},
+		{
+			example: "bpf-to-bpf",
+			name:    "atomic",
+			opts: InstrumentOptions{
+				Layout: CoverMapLayout{CounterWidth: Counter32Bit, Strategy: CounterStrategyAtomic},
+			},
+		},
+		{
+			example: "bpf-to-bpf",
+			name:    "branch-coverage-atomic",
+			opts: InstrumentOptions{
+				Layout:         CoverMapLayout{CounterWidth: Counter64Bit, Strategy: CounterStrategyAtomic},
+				BranchCoverage: true,
+			},
+		},
+		{
+			example: "bpf-to-bpf",
+			name:    "global-storage",
+			opts: InstrumentOptions{
+				Layout: CoverMapLayout{Strategy: CounterStrategyShared, Storage: CounterStorageGlobal},
+			},
+		},
+		{
+			// The filtered function keeps its original instructions, but is still called by the instrumented code.
+			example: "bpf-to-bpf",
+			name:    "filter",
+			opts: InstrumentOptions{
+				Layout: CoverMapLayout{Strategy: CounterStrategyShared},
+				Filter: Filter{ExcludeFunctions: []string{"handle_ipv4"}, ExcludeFiles: []string{"bpf_endian.h"}},
+			},
+		},
+		{
+			example: "bpf-to-bpf",
+			name:    "lookup-failure-skip",
+			opts: InstrumentOptions{
+				Layout:        CoverMapLayout{Strategy: CounterStrategyShared, Saturating: true},
+				LookupFailure: LookupFailure{Action: LookupFailureSkip},
+			},
+		},
+		{
+			// Branches are only counted at block granularity.
+			example: "bpf-to-bpf",
+			name:    "granularity-branch-target",
+			opts: InstrumentOptions{
+				Layout:         CoverMapLayout{Strategy: CounterStrategyShared},
+				Granularity:    GranularityBranchTarget,
+				BranchCoverage: true,
+				Programs:       map[string]ProgramOptions{"firewall_prog": {ExcludeFunctions: []string{"handle_ipv6"}}},
+			},
+		},
+		{
+			example: "bpf-to-bpf",
+			name:    "minimal-probes",
+			opts: InstrumentOptions{
+				Layout:        CoverMapLayout{Strategy: CounterStrategyShared},
+				MinimalProbes: true,
+			},
+		},
+		{
+			// The callback passed to bpf_loop is a sub-program which is never called directly.
+			example: "bpf-loop",
+			name:    "shared",
+			opts: InstrumentOptions{
+				Layout: CoverMapLayout{Strategy: CounterStrategyShared},
+			},
+		},
+		{
+			example: "bpf-loop",
+			name:    "static-analysis",
+			opts: InstrumentOptions{
+				Layout:   CoverMapLayout{Strategy: CounterStrategyShared},
+				Analysis: AnalysisStatic,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.example+"/"+tt.name, func(t *testing.T) {
+			spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", tt.example))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.opts.VerifierLogs = readVerifierLogs(t, filepath.Join("testdata", tt.example), spec)
+			if _, err = InstrumentCollectionWithOptions(spec, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+
+			got := programsToString(spec)
+			goldenPath := filepath.Join("testdata", fmt.Sprintf("%s.%s.golden", tt.example, tt.name))
+			if *updateGolden {
+				if err = os.WriteFile(goldenPath, []byte(got), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != string(want) {
+				t.Errorf("instrumented programs differ from %s:\n%s", goldenPath, diff.LineDiff(string(want), got))
+			}
+		})
+	}
+}
+
+func readVerifierLogs(t *testing.T, dir string, spec *ebpf.CollectionSpec) map[string]string {
+	t.Helper()
+
+	logs := make(map[string]string, len(spec.Programs))
+	for name := range spec.Programs {
+		log, err := os.ReadFile(filepath.Join(dir, name+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs[name] = string(log)
+	}
+
+	return logs
+}
+
+func programsToString(spec *ebpf.CollectionSpec) string {
+	names := make([]string, 0, len(spec.Programs))
+	for name := range spec.Programs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintln(&sb, "---", name, "---")
+		fmt.Fprint(&sb, spec.Programs[name].Instructions)
+	}
+
+	return sb.String()
+}
+
+// TestInstrumentSharedCoverMap instruments two examples into the same cover-map and checks that their counters don't
+// overlap and that the cover-maps of both collections are interchangeable.
+func TestInstrumentSharedCoverMap(t *testing.T) {
+	instrument := func(example string, opts InstrumentOptions) (*ebpf.CollectionSpec, *Instrumentation, error) {
+		t.Helper()
+
+		spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", example))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts.VerifierLogs = readVerifierLogs(t, filepath.Join("testdata", example), spec)
+		instrumentation, err := InstrumentCollectionWithOptions(spec, opts)
+		return spec, instrumentation, err
+	}
+
+	layout := CoverMapLayout{Strategy: CounterStrategyShared, Capacity: 100}
+	firstSpec, first, err := instrument("bpf-to-bpf", InstrumentOptions{Layout: layout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockList := first.BlockList()
+	numBlocks := len(blockList.Blocks)
+	secondSpec, second, err := instrument("bpf-loop", InstrumentOptions{SharedCoverMap: blockList})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstMap, secondMap := firstSpec.Maps["coverbee_covermap"], secondSpec.Maps["coverbee_covermap"]
+	if firstMap.Type != secondMap.Type || firstMap.ValueSize != secondMap.ValueSize ||
+		firstMap.MaxEntries != secondMap.MaxEntries {
+		t.Errorf("cover-maps are not interchangeable: %+v and %+v", firstMap, secondMap)
+	}
+
+	if second.BlockCounters[0] != numBlocks {
+		t.Errorf("first counter of the second collection is %d, want %d", second.BlockCounters[0], numBlocks)
+	}
+
+	if err = blockList.Append(second.BlockList()); err != nil {
+		t.Fatal(err)
+	}
+	if len(blockList.Blocks) != numBlocks+len(second.Blocks) || len(blockList.Identities) != len(blockList.Blocks) {
+		t.Errorf("appended block-list has %d blocks and %d identities, want %d",
+			len(blockList.Blocks), len(blockList.Identities), numBlocks+len(second.Blocks))
+	}
+
+	if err = blockList.Append(second.BlockList()); err == nil {
+		t.Error("appending overlapping counters should fail")
+	}
+
+	// The capacity is used up.
+	if _, _, err = instrument("bpf-to-bpf", InstrumentOptions{SharedCoverMap: blockList}); err == nil {
+		t.Error("exceeding the cover-map capacity should fail")
+	}
+
+	if _, _, err = instrument("bpf-loop", InstrumentOptions{SharedCoverMap: &BlockList{}}); err == nil {
+		t.Error("sharing a cover-map without capacity should fail")
+	}
+}
+
+func TestInstrumentCoverMapName(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := InstrumentOptions{
+		Layout:       CoverMapLayout{Strategy: CounterStrategyShared},
+		VerifierLogs: readVerifierLogs(t, filepath.Join("testdata", "bpf-to-bpf"), spec),
+	}
+
+	// The name of a map of the program itself.
+	opts.CoverMapName = "tcp_stats"
+	if _, err = InstrumentCollectionWithOptions(spec, opts); err == nil {
+		t.Fatal("a cover-map name which collides with a map of the collection should fail")
+	}
+
+	opts.CoverMapName = "firewall_cover"
+	instrumentation, err := InstrumentCollectionWithOptions(spec, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if instrumentation.CoverMapName != "firewall_cover" || spec.Maps["firewall_cover"] == nil {
+		t.Errorf("cover-map '%s' not added to the collection", instrumentation.CoverMapName)
+	}
+	if _, found := spec.Maps[DefaultCoverMapName]; found {
+		t.Errorf("collection contains the default cover-map")
+	}
+
+	references := 0
+	for _, prog := range spec.Programs {
+		for _, inst := range prog.Instructions {
+			if inst.IsLoadFromMap() && inst.Reference() == "firewall_cover" {
+				references++
+			}
+		}
+	}
+	if references == 0 {
+		t.Error("the instrumented programs don't reference the cover-map")
+	}
+}
+
+// TestInstrumentFunctions checks that at function granularity only the entry blocks of the functions are counted, and
+// that they are recorded by their BTF name.
+// TestInstrumentOfflineStrategy checks that instrumenting with static analysis doesn't probe the kernel, so the
+// automatic counter strategy always results in shared counters.
+func TestInstrumentOfflineStrategy(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumentation, err := InstrumentCollectionWithOptions(spec, InstrumentOptions{Analysis: AnalysisStatic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := instrumentation.Layout.Strategy; got != CounterStrategyShared {
+		t.Errorf("strategy = %s, want %s", got, CounterStrategyShared)
+	}
+}
+
+func TestInstrumentFunctions(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumentation, err := InstrumentCollectionWithOptions(spec, InstrumentOptions{
+		Layout:       CoverMapLayout{Strategy: CounterStrategyShared},
+		Granularity:  GranularityFunction,
+		VerifierLogs: readVerifierLogs(t, filepath.Join("testdata", "bpf-to-bpf"), spec),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for blockID, fn := range instrumentation.Functions {
+		if fn.BlockID != blockID {
+			t.Errorf("function '%s' has block %d, want %d", fn.Name, fn.BlockID, blockID)
+		}
+		names = append(names, fn.Name)
+	}
+	sort.Strings(names)
+
+	want := []string{"firewall_prog", "handle_ipv4", "handle_ipv6", "inc_ip_proto", "inc_tcp", "inc_udp"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("functions = %v, want %v", names, want)
+	}
+	if len(instrumentation.Blocks) != len(want) {
+		t.Errorf("%d blocks are instrumented, want one per function", len(instrumentation.Blocks))
+	}
+}
+
+// TestInstrumentBranches checks that every conditional jump jumps to a trampoline which counts the taken outcome
+// before jumping to the original target, and that the not-taken outcome is counted right after the jump. Each outcome
+// has a counter of its own.
+func TestInstrumentBranches(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumentation, err := InstrumentCollectionWithOptions(spec, InstrumentOptions{
+		Layout:         CoverMapLayout{CounterWidth: Counter64Bit, Strategy: CounterStrategyAtomic},
+		BranchCoverage: true,
+		VerifierLogs:   readVerifierLogs(t, filepath.Join("testdata", "bpf-to-bpf"), spec),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instrumentation.Branches) == 0 {
+		t.Fatal("no branches are counted")
+	}
+
+	used := make(map[int]bool)
+	for _, counter := range instrumentation.BlockCounters {
+		used[counter] = true
+	}
+
+	// atomicAdd returns the offset of the first counter increment at or after the given instruction.
+	atomicAdd := func(insns asm.Instructions, from int) int16 {
+		for _, inst := range insns[from:] {
+			if inst.OpCode.Class() == asm.StXClass && inst.OpCode.Mode() == asm.XAddMode {
+				return inst.Offset
+			}
+		}
+		t.Fatal("no counter increment found")
+		return 0
+	}
+
+	for _, branch := range instrumentation.Branches {
+		for _, counter := range []int{branch.TakenCounter, branch.NotTakenCounter} {
+			if used[counter] {
+				t.Errorf("counter %d of the branch of block %d is used twice", counter, branch.BlockID)
+			}
+			used[counter] = true
+		}
+
+		label := fmt.Sprintf("coverbee-branch-%d", branch.TakenCounter)
+		insns := spec.Programs[instrumentation.Identities[branch.BlockID].Program].Instructions
+		jump, trampoline := -1, -1
+		for i, inst := range insns {
+			if inst.OpCode.JumpOp() != asm.Ja && inst.Reference() == label {
+				jump = i
+			}
+			if inst.Symbol() == label {
+				trampoline = i
+			}
+		}
+		if jump < 0 || trampoline < 0 {
+			t.Fatalf("branch of block %d has no jump to trampoline %s", branch.BlockID, label)
+		}
+
+		if got, want := atomicAdd(insns, jump+1), int16(branch.NotTakenCounter*8); got != want {
+			t.Errorf("branch of block %d: not taken increments offset %d, want %d", branch.BlockID, got, want)
+		}
+		if got, want := atomicAdd(insns, trampoline), int16(branch.TakenCounter*8); got != want {
+			t.Errorf("branch of block %d: taken increments offset %d, want %d", branch.BlockID, got, want)
+		}
+
+		for _, inst := range insns[trampoline:] {
+			if inst.OpCode.JumpOp() == asm.Ja {
+				if strings.HasPrefix(inst.Reference(), "coverbee-branch-") || inst.Reference() == "" {
+					t.Errorf("trampoline %s jumps to '%s' instead of the original target", label, inst.Reference())
+				}
+				break
+			}
+		}
+	}
+}
+
+// TestDeepestCallChain checks that the call chain with the most stack, counting callbacks and rounded frames, is found.
+func TestDeepestCallChain(t *testing.T) {
+	insns := asm.Instructions{
+		asm.Call.Label("a").WithSymbol("prog"),
+		asm.Call.Label("b"),
+		asm.Return(),
+		asm.Call.Label("c").WithSymbol("a"),
+		asm.Return(),
+		asm.LoadMapPtr(asm.R1, 0).WithSymbol("b"),
+		asm.Instruction{OpCode: asm.LoadImmOp(asm.DWord), Src: asm.PseudoFunc}.WithReference("c"),
+		asm.FnLoop.Call(),
+		asm.Call.Label("c"),
+		asm.Return(),
+		asm.Return().WithSymbol("c"),
+	}
+
+	graph := callGraph("prog", insns)
+	wantGraph := map[string][]string{"prog": {"a", "b"}, "a": {"c"}, "b": {"c"}}
+	if !reflect.DeepEqual(graph, wantGraph) {
+		t.Errorf("call graph = %v, want %v", graph, wantGraph)
+	}
+
+	// Frames are rounded up to 32 bytes, b is the deepest frame but the chain through a is deeper.
+	chain, depth := deepestCallChain("prog", map[string][]string{"prog": {"a", "b"}, "a": {"c"}, "c": {"d"}},
+		map[string]int{"prog": 8, "a": 40, "b": 96, "c": 0, "d": 32})
+	if want := []string{"prog", "a", "c", "d"}; !reflect.DeepEqual(chain, want) || depth != 160 {
+		t.Errorf("deepest call chain = %v with %d bytes, want %v with 160 bytes", chain, depth, want)
+	}
+}
+
+// TestVerifierLogOptions checks that the verifier logs are recorded with the options of the caller, except for the
+// pin path and replacements of maps which aren't part of the collection. Pinned maps are passed as replacements.
+func TestVerifierLogOptions(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpStats, coverMap := new(ebpf.Map), new(ebpf.Map)
+	pinnedTCPStats, pinnedUDPStats := new(ebpf.Map), new(ebpf.Map)
+	kernelTypes := new(btf.Spec)
+	opts := verifierLogOptions(spec, ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{PinPath: "/sys/fs/bpf/test"},
+		Programs: ebpf.ProgramOptions{
+			LogDisabled: true,
+			KernelTypes: kernelTypes,
+		},
+		MapReplacements: map[string]*ebpf.Map{
+			"tcp_stats":         tcpStats,
+			DefaultCoverMapName: coverMap,
+		},
+	}, map[string]*ebpf.Map{"tcp_stats": pinnedTCPStats, "udp_stats": pinnedUDPStats})
+
+	if opts.Programs.KernelTypes != kernelTypes {
+		t.Errorf("the options of the caller are not used: %+v", opts)
+	}
+	if opts.Maps.PinPath != "" {
+		t.Errorf("maps are pinned to '%s' by the load", opts.Maps.PinPath)
+	}
+	if opts.Programs.LogLevel != ebpf.LogLevelInstruction || opts.Programs.LogDisabled {
+		t.Errorf("the verifier log isn't recorded at instruction level: %+v", opts.Programs)
+	}
+	// The replacements of the caller take precedence over pinned maps, like they do when loading.
+	want := map[string]*ebpf.Map{"tcp_stats": tcpStats, "udp_stats": pinnedUDPStats}
+	if !reflect.DeepEqual(opts.MapReplacements, want) {
+		t.Errorf("unexpected map replacements %v", opts.MapReplacements)
+	}
+}
+
+// TestRecordVerifierLogsPins checks that recording the verifier logs reuses maps which are already pinned, but doesn't
+// leave pins of its own behind.
+func TestRecordVerifierLogsPins(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range spec.Maps {
+		m.Pinning = ebpf.PinByName
+	}
+
+	pinPath, err := os.MkdirTemp("/sys/fs/bpf", "coverbee-test")
+	if err != nil {
+		t.Skipf("can't create a pin directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(pinPath) })
+
+	udpStats, err := ebpf.NewMapWithOptions(spec.Maps["udp_stats"], ebpf.MapOptions{PinPath: pinPath})
+	if err != nil {
+		t.Skipf("can't create a pinned map: %v", err)
+	}
+	defer udpStats.Close()
+
+	if _, err = RecordVerifierLogsWithOptions(spec, ebpf.CollectionOptions{
+		Maps: ebpf.MapOptions{PinPath: pinPath},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(pinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "udp_stats" {
+		t.Errorf("pins after recording the verifier logs = %v, want only udp_stats", entries)
+	}
+}
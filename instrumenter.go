@@ -0,0 +1,44 @@
+package coverbee
+
+import (
+	"context"
+
+	"github.com/cilium/ebpf"
+)
+
+// Instrumenter instruments collections with a fixed set of options. Unlike `InstrumentCollectionWithOptions` it
+// doesn't modify the given collection but returns an instrumented copy, so the original collection can still be
+// loaded without instrumentation.
+type Instrumenter struct {
+	opts InstrumentOptions
+}
+
+// NewInstrumenter returns an instrumenter which uses the given options. An error is returned if the options are
+// invalid.
+func NewInstrumenter(opts InstrumentOptions) (*Instrumenter, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	return &Instrumenter{opts: opts}, nil
+}
+
+// Instrument returns an instrumented copy of the given collection and the instrumentation, which describes the
+// blocks and counters of the programs, how each program was instrumented and where the original instructions ended
+// up. If the context is done before the instrumentation is, the error of the context is returned.
+//
+// The verifier logs of the original programs are recorded by loading a copy of the collection with
+// `InstrumentOptions.CollectionOptions`, unless `InstrumentOptions.VerifierLogs` is set or the analysis doesn't need
+// them.
+func (in *Instrumenter) Instrument(
+	ctx context.Context,
+	coll *ebpf.CollectionSpec,
+) (*ebpf.CollectionSpec, *Instrumentation, error) {
+	instrumented := coll.Copy()
+	instrumentation, err := instrumentCollection(ctx, instrumented, in.opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return instrumented, instrumentation, nil
+}
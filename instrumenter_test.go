@@ -0,0 +1,108 @@
+package coverbee
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+// TestInstrumenter checks that the instrumenter leaves the original collection untouched, and that the instruction
+// offsets point at the original instructions in the instrumented programs.
+func TestInstrumenter(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := programsToString(spec)
+
+	instrumenter, err := NewInstrumenter(InstrumentOptions{
+		Layout:       CoverMapLayout{Strategy: CounterStrategyShared},
+		VerifierLogs: readVerifierLogs(t, filepath.Join("testdata", "bpf-to-bpf"), spec),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumented, instrumentation, err := instrumenter.Instrument(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if programsToString(spec) != original {
+		t.Error("the original programs were modified")
+	}
+	if _, found := spec.Maps[instrumentation.CoverMapName]; found {
+		t.Error("the cover-map was added to the original collection")
+	}
+	if _, found := instrumented.Maps[instrumentation.CoverMapName]; !found {
+		t.Error("the instrumented collection has no cover-map")
+	}
+
+	for name, prog := range spec.Programs {
+		originalInsns := rawInstructions(prog.Instructions)
+		instrumentedInsns := rawInstructions(instrumented.Programs[name].Instructions)
+
+		offsets := instrumentation.InstructionOffsets[name]
+		if len(offsets) != len(originalInsns) {
+			t.Fatalf("program '%s' has %d offsets for %d instructions", name, len(offsets), len(originalInsns))
+		}
+		for off, inst := range originalInsns {
+			if inst == nil {
+				continue
+			}
+
+			// The offsets of jumps are recalculated from their labels when the program is loaded.
+			got := instrumentedInsns[offsets[off]]
+			if got == nil || got.OpCode != inst.OpCode || got.Dst != inst.Dst || got.Src != inst.Src ||
+				got.Constant != inst.Constant {
+				t.Fatalf("program '%s' instruction %d is not at %d of the instrumented program", name, off, offsets[off])
+			}
+		}
+
+		report := instrumentation.Programs[name]
+		if report.Blocks != len(ProgramBlocks(prog.Instructions)) || report.Instructions != len(originalInsns) ||
+			report.InstrumentedInstructions != len(instrumentedInsns) {
+			t.Errorf("unexpected stats of program '%s': %+v", name, report)
+		}
+	}
+}
+
+// rawInstructions returns the instructions indexed by raw instruction offset, nil for the second half of wide
+// instructions.
+func rawInstructions(insns asm.Instructions) []*asm.Instruction {
+	var raw []*asm.Instruction
+	iter := insns.Iterate()
+	for iter.Next() {
+		raw = append(raw, iter.Ins)
+		for i := 1; i < int(iter.Ins.Size())/asm.InstructionSize; i++ {
+			raw = append(raw, nil)
+		}
+	}
+	return raw
+}
+
+func TestInstrumenterErrors(t *testing.T) {
+	if _, err := NewInstrumenter(InstrumentOptions{Granularity: "line"}); err == nil {
+		t.Error("invalid options should fail")
+	}
+
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumenter, err := NewInstrumenter(InstrumentOptions{Analysis: AnalysisStatic, VerifierLogs: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err = instrumenter.Instrument(ctx, spec); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the instrumentation to be canceled, got %v", err)
+	}
+}
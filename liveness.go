@@ -0,0 +1,693 @@
+package coverbee
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cilium/coverbee/pkg/verifierlog"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+)
+
+// AnalysisMode determines how the instrumentation finds out which registers and stack slots are used by a program.
+type AnalysisMode string
+
+const (
+	// AnalysisVerifier derives the used registers and stack slots from the verifier log of the original program. This
+	// requires the original program to be loaded, or recorded verifier logs. This is the default.
+	AnalysisVerifier AnalysisMode = "verifier"
+	// AnalysisStatic derives the used registers and stack depth with a dataflow analysis of the program, without
+	// verifier log.
+	AnalysisStatic AnalysisMode = "static"
+	// AnalysisCrossCheck performs both analyses, a register or stack slot is considered used if either analysis says
+	// so. Disagreements between the analyses are logged.
+	AnalysisCrossCheck AnalysisMode = "cross-check"
+)
+
+func (am AnalysisMode) validate() error {
+	switch am {
+	case AnalysisVerifier, AnalysisStatic, AnalysisCrossCheck:
+		return nil
+	default:
+		return fmt.Errorf("invalid analysis mode '%s', pick from verifier, static or cross-check", am)
+	}
+}
+
+// needsVerifierLog returns true if the analysis mode uses the verifier log.
+func (am AnalysisMode) needsVerifierLog() bool {
+	return am != AnalysisStatic
+}
+
+// registerSet is a bit set of registers.
+type registerSet uint16
+
+func (rs registerSet) has(reg asm.Register) bool {
+	return rs&(1<<reg) != 0
+}
+
+func (rs *registerSet) add(regs ...asm.Register) {
+	for _, reg := range regs {
+		*rs |= 1 << reg
+	}
+}
+
+func (rs registerSet) String() string {
+	var sb strings.Builder
+	for reg := asm.R0; reg <= asm.R10; reg++ {
+		if !rs.has(reg) {
+			continue
+		}
+
+		if sb.Len() > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(reg.String())
+	}
+
+	return sb.String()
+}
+
+// allRegisters contains R0-R10.
+const allRegisters registerSet = 1<<(asm.R10+1) - 1
+
+// callerSavedRegisters contains the registers which are clobbered by calls.
+const callerSavedRegisters registerSet = 1<<(asm.R5+1) - 1
+
+// argumentRegisters contains the registers which are used to pass arguments to helpers and functions.
+const argumentRegisters = callerSavedRegisters &^ (1 << asm.R0)
+
+// maxStackDepth is the max size in bytes of the stack frame of a single BPF function, and of all frames of a
+// bpf-to-bpf call chain combined.
+const maxStackDepth = 512
+
+// programUsage describes which registers and how much stack are used by a program.
+type programUsage struct {
+	// The registers in use before each instruction, indexed by raw instruction number.
+	registers []registerSet
+	// Whether the registers in use are known for each instruction, indexed by raw instruction number. Registers of
+	// unknown instructions should be treated as all used.
+	known []bool
+	// The stack depth in bytes used by each function, rounded up to a full stack slot, indexed by function symbol.
+	stackDepth map[string]int
+}
+
+// usedRegisters returns the registers in use before the given instruction. If unknown, all registers are returned.
+func (pu *programUsage) usedRegisters(instn int) registerSet {
+	if instn >= len(pu.known) || !pu.known[instn] {
+		return allRegisters
+	}
+
+	return pu.registers[instn]
+}
+
+// merge combines two usages, registers and stack are considered used if they are used in either.
+func (pu *programUsage) merge(other *programUsage) *programUsage {
+	merged := &programUsage{
+		stackDepth: make(map[string]int, len(pu.stackDepth)),
+	}
+
+	n := len(pu.registers)
+	if len(other.registers) > n {
+		n = len(other.registers)
+	}
+	merged.registers = make([]registerSet, n)
+	merged.known = make([]bool, n)
+	for i := 0; i < n; i++ {
+		for _, usage := range []*programUsage{pu, other} {
+			if i < len(usage.known) && usage.known[i] {
+				merged.registers[i] |= usage.registers[i]
+				merged.known[i] = true
+			}
+		}
+	}
+
+	for _, usage := range []*programUsage{pu, other} {
+		for fn, depth := range usage.stackDepth {
+			if depth > merged.stackDepth[fn] {
+				merged.stackDepth[fn] = depth
+			}
+		}
+	}
+
+	return merged
+}
+
+// functionOfInstruction returns the function symbol of every raw instruction of the program. A function starts at the
+// first instruction and at every symbol called as bpf-to-bpf function or referenced as callback.
+func functionOfInstruction(name string, insns asm.Instructions) []string {
+	subProgFuncs, _ := subProgramFuncs(insns)
+
+	var funcs []string
+	curFunc := name
+	iter := insns.Iterate()
+	for iter.Next() {
+		if sym := iter.Ins.Symbol(); subProgFuncs[sym] || sym == name {
+			curFunc = sym
+		}
+
+		for i := 0; i < int(iter.Ins.Size())/asm.InstructionSize; i++ {
+			funcs = append(funcs, curFunc)
+		}
+	}
+
+	return funcs
+}
+
+// verifierUsage derives the program usage from the merged verifier states of the program.
+func verifierUsage(name string, insns asm.Instructions, mergedStates []verifierlog.VerifierState) *programUsage {
+	funcs := functionOfInstruction(name, insns)
+	usage := &programUsage{
+		registers:  make([]registerSet, len(mergedStates)),
+		known:      make([]bool, len(mergedStates)),
+		stackDepth: make(map[string]int),
+	}
+
+	for _, fn := range funcs {
+		usage.stackDepth[fn] = 0
+	}
+
+	for i, state := range mergedStates {
+		// It is possible that the number of merged states is lower than the instruction count if the end of a
+		// program is dynamically dead code. (the verifier didn't reach it but it also doesn't error)
+		if state.Unknown {
+			continue
+		}
+
+		usage.known[i] = true
+		for _, reg := range state.Registers {
+			usage.registers[i].add(reg.Register)
+		}
+
+		if i >= len(funcs) {
+			continue
+		}
+		for _, slot := range state.Stack {
+			if slot.Offset > usage.stackDepth[funcs[i]] {
+				usage.stackDepth[funcs[i]] = slot.Offset
+			}
+		}
+	}
+
+	return usage
+}
+
+// staticUsage derives the program usage with a dataflow analysis of the CFG of the program. Registers are in use if
+// they are live, meaning their current value may be read later. The stack depth is the deepest offset from the frame
+// pointer which is accessed directly or via a pointer derived from the frame pointer.
+func staticUsage(name string, insns asm.Instructions) (*programUsage, error) {
+	blocks := ProgramBlocks(insns)
+	funcs := functionOfInstruction(name, insns)
+
+	// The raw instruction number of the first instruction of each block.
+	blockStart := make(map[*BasicBlock]int, len(blocks))
+	instn := 0
+	for _, block := range blocks {
+		blockStart[block] = instn
+		instn += int(block.Block.Size()) / asm.InstructionSize
+	}
+
+	usage := &programUsage{
+		registers:  make([]registerSet, instn),
+		known:      make([]bool, instn),
+		stackDepth: make(map[string]int),
+	}
+	for _, fn := range funcs {
+		usage.stackDepth[fn] = 0
+	}
+
+	// Use the BTF of bpf-to-bpf functions to find out which registers are used for arguments and return values.
+	funcArgs := make(map[string]int)
+	voidFuncs := make(map[string]bool)
+	for i, inst := range insns {
+		fn := btf.FuncMetadata(&insns[i])
+		if fn == nil {
+			continue
+		}
+
+		if proto, ok := fn.Type.(*btf.FuncProto); ok {
+			funcArgs[inst.Symbol()] = len(proto.Params)
+			// The main program always returns a value.
+			_, isVoid := proto.Return.(*btf.Void)
+			voidFuncs[inst.Symbol()] = (proto.Return == nil || isVoid) && inst.Symbol() != name
+		}
+	}
+
+	analyzeLiveness(blocks, blockStart, funcs, funcArgs, voidFuncs, usage)
+
+	if err := analyzeStackDepth(blocks, blockStart, funcs, usage); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// useDef returns the registers read and written by an instruction. `funcArgs` contains the number of arguments of
+// bpf-to-bpf functions, helpers and unknown functions are assumed to use all argument registers. `returnsValue`
+// indicates if the function containing the instruction returns a value in R0.
+func useDef(inst asm.Instruction, funcArgs map[string]int, returnsValue bool) (use, def registerSet) {
+	op := inst.OpCode
+	switch op.Class() {
+	case asm.ALUClass, asm.ALU64Class:
+		switch op.ALUOp() {
+		case asm.Mov:
+			if op.Source() == asm.RegSource {
+				use.add(inst.Src)
+			}
+		case asm.Neg, asm.Swap:
+			use.add(inst.Dst)
+		default:
+			use.add(inst.Dst)
+			if op.Source() == asm.RegSource {
+				use.add(inst.Src)
+			}
+		}
+		def.add(inst.Dst)
+
+	case asm.LdClass:
+		switch op.Mode() {
+		case asm.AbsMode, asm.IndMode:
+			// Legacy packet access, implicitly uses R6 as context and clobbers the caller saved registers.
+			use.add(asm.R6)
+			if op.Mode() == asm.IndMode {
+				use.add(inst.Src)
+			}
+			def |= callerSavedRegisters
+		default:
+			def.add(inst.Dst)
+		}
+
+	case asm.LdXClass:
+		use.add(inst.Src)
+		def.add(inst.Dst)
+
+	case asm.StClass:
+		use.add(inst.Dst)
+
+	case asm.StXClass:
+		use.add(inst.Dst, inst.Src)
+		if op.Mode() == asm.XAddMode {
+			// Atomic operations with fetch write to the source register and compare-exchange uses R0. We don't
+			// consider those as definitions, which is the safe assumption.
+			use.add(asm.R0)
+		}
+
+	case asm.JumpClass, asm.Jump32Class:
+		switch op.JumpOp() {
+		case asm.Exit:
+			if returnsValue {
+				use.add(asm.R0)
+			}
+		case asm.Call:
+			if args, found := funcArgs[inst.Reference()]; found && inst.IsFunctionCall() {
+				for reg := asm.R1; reg < asm.R1+asm.Register(args) && reg <= asm.R5; reg++ {
+					use.add(reg)
+				}
+			} else {
+				use |= argumentRegisters
+			}
+			def |= callerSavedRegisters
+		case asm.Ja:
+		default:
+			use.add(inst.Dst)
+			if op.Source() == asm.RegSource {
+				use.add(inst.Src)
+			}
+		}
+	}
+
+	return use, def
+}
+
+// analyzeLiveness performs a backwards liveness analysis on the blocks and records the live registers before every
+// instruction in the usage.
+func analyzeLiveness(
+	blocks []*BasicBlock,
+	blockStart map[*BasicBlock]int,
+	funcs []string,
+	funcArgs map[string]int,
+	voidFuncs map[string]bool,
+	usage *programUsage,
+) {
+	// The value of R0 is only used by the exit of functions which return a value.
+	returnsValue := func(block *BasicBlock) bool {
+		instn := blockStart[block]
+		return instn >= len(funcs) || !voidFuncs[funcs[instn]]
+	}
+
+	liveIn := make(map[*BasicBlock]registerSet, len(blocks))
+
+	// Iterate until a fixed point is reached, going backwards through the blocks converges quickly.
+	for changed := true; changed; {
+		changed = false
+		for i := len(blocks) - 1; i >= 0; i-- {
+			block := blocks[i]
+
+			var live registerSet
+			for _, succ := range block.Successors() {
+				live |= liveIn[succ]
+			}
+
+			for j := len(block.Block) - 1; j >= 0; j-- {
+				use, def := useDef(block.Block[j], funcArgs, returnsValue(block))
+				live = (live &^ def) | use
+			}
+
+			// The frame pointer is always in use
+			live.add(asm.R10)
+
+			if live != liveIn[block] {
+				liveIn[block] = live
+				changed = true
+			}
+		}
+	}
+
+	// Record the live registers before every instruction
+	for _, block := range blocks {
+		var live registerSet
+		for _, succ := range block.Successors() {
+			live |= liveIn[succ]
+		}
+
+		instLive := make([]registerSet, len(block.Block))
+		for j := len(block.Block) - 1; j >= 0; j-- {
+			use, def := useDef(block.Block[j], funcArgs, returnsValue(block))
+			live = (live &^ def) | use
+			live.add(asm.R10)
+			instLive[j] = live
+		}
+
+		instn := blockStart[block]
+		for j, inst := range block.Block {
+			for k := 0; k < int(inst.Size())/asm.InstructionSize; k++ {
+				usage.registers[instn] = instLive[j]
+				usage.known[instn] = true
+				instn++
+			}
+		}
+	}
+}
+
+// fpKind describes what a register holds in relation to the frame pointer.
+type fpKind uint8
+
+const (
+	// fpNone means the register doesn't hold a pointer to the stack.
+	fpNone fpKind = iota
+	// fpOffset means the register holds the frame pointer plus a known offset.
+	fpOffset
+	// fpUnknown means the register may hold a pointer to the stack with an unknown offset.
+	fpUnknown
+)
+
+type fpValue struct {
+	kind fpKind
+	off  int64
+}
+
+type fpState [asm.R10 + 1]fpValue
+
+func (s *fpState) merge(other *fpState) bool {
+	changed := false
+	for i := range s {
+		merged := s[i]
+		switch {
+		case s[i] == other[i]:
+		case s[i].kind == fpNone && other[i].kind == fpNone:
+		default:
+			merged = fpValue{kind: fpUnknown}
+		}
+
+		if merged != s[i] {
+			s[i] = merged
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// analyzeStackDepth performs a forward analysis which tracks pointers derived from the frame pointer to find the
+// deepest stack offset accessed by each function.
+func analyzeStackDepth(
+	blocks []*BasicBlock,
+	blockStart map[*BasicBlock]int,
+	funcs []string,
+	usage *programUsage,
+) error {
+	entryState := fpState{}
+	entryState[asm.R10] = fpValue{kind: fpOffset}
+
+	states := make(map[*BasicBlock]*fpState, len(blocks))
+	var worklist []*BasicBlock
+	for i, block := range blocks {
+		instn := blockStart[block]
+		// Each function starts with only the frame pointer pointing to the stack.
+		if i == 0 || (instn < len(funcs) && funcs[instn] != funcs[instn-1]) {
+			state := entryState
+			states[block] = &state
+			worklist = append(worklist, block)
+		}
+	}
+
+	for len(worklist) > 0 {
+		block := worklist[0]
+		worklist = worklist[1:]
+
+		instn := blockStart[block]
+		fn := funcs[instn]
+		recordDepth := func(off int64) {
+			if off >= 0 {
+				return
+			}
+
+			// Round up to a full stack slot
+			depth := int((-off + 7) / 8 * 8)
+			if depth > usage.stackDepth[fn] {
+				usage.stackDepth[fn] = depth
+			}
+		}
+
+		state := *states[block]
+		for _, inst := range block.Block {
+			if err := stepStackState(&state, inst, recordDepth); err != nil {
+				return fmt.Errorf("function '%s' instruction %d: %w", fn, instn, err)
+			}
+			instn += int(inst.Size()) / asm.InstructionSize
+		}
+
+		for _, succ := range block.Successors() {
+			succState, found := states[succ]
+			if !found {
+				newState := state
+				states[succ] = &newState
+				worklist = append(worklist, succ)
+				continue
+			}
+
+			if succState.merge(&state) {
+				worklist = append(worklist, succ)
+			}
+		}
+	}
+
+	return nil
+}
+
+// stepStackState updates the state with the effects of the instruction, calling recordDepth for every offset from the
+// frame pointer which is accessed or pointed to.
+func stepStackState(state *fpState, inst asm.Instruction, recordDepth func(off int64)) error {
+	// access records an access to memory at the offset from the pointer in `reg`.
+	access := func(reg asm.Register, off int16) error {
+		switch state[reg].kind {
+		case fpOffset:
+			recordDepth(state[reg].off + int64(off))
+		case fpUnknown:
+			return fmt.Errorf("memory access via stack pointer in r%d with unknown offset", reg)
+		}
+
+		return nil
+	}
+
+	op := inst.OpCode
+	switch op.Class() {
+	case asm.ALU64Class:
+		dst := &state[inst.Dst]
+		switch op.ALUOp() {
+		case asm.Mov:
+			if op.Source() == asm.RegSource {
+				*dst = state[inst.Src]
+			} else {
+				*dst = fpValue{}
+			}
+		case asm.Add, asm.Sub:
+			if dst.kind == fpNone {
+				if op.Source() == asm.RegSource && state[inst.Src].kind != fpNone && op.ALUOp() == asm.Add {
+					// scalar + stack pointer
+					*dst = fpValue{kind: fpUnknown}
+				}
+				break
+			}
+
+			if op.Source() == asm.RegSource {
+				if state[inst.Src].kind != fpNone && op.ALUOp() == asm.Sub {
+					// The difference between two stack pointers is a scalar
+					*dst = fpValue{}
+				} else {
+					*dst = fpValue{kind: fpUnknown}
+				}
+				break
+			}
+
+			if dst.kind == fpOffset {
+				if op.ALUOp() == asm.Add {
+					dst.off += inst.Constant
+				} else {
+					dst.off -= inst.Constant
+				}
+				recordDepth(dst.off)
+			}
+		default:
+			*dst = fpValue{}
+		}
+
+	case asm.ALUClass:
+		state[inst.Dst] = fpValue{}
+
+	case asm.LdClass:
+		switch op.Mode() {
+		case asm.AbsMode, asm.IndMode:
+			for reg := asm.R0; reg <= asm.R5; reg++ {
+				state[reg] = fpValue{}
+			}
+		default:
+			state[inst.Dst] = fpValue{}
+		}
+
+	case asm.LdXClass:
+		if err := access(inst.Src, inst.Offset); err != nil {
+			return err
+		}
+		state[inst.Dst] = fpValue{}
+
+	case asm.StClass, asm.StXClass:
+		if err := access(inst.Dst, inst.Offset); err != nil {
+			return err
+		}
+
+		if op.Class() == asm.StXClass && op.Mode() == asm.XAddMode {
+			// Atomic operations with fetch write to the source register and compare-exchange writes R0.
+			state[inst.Src] = fpValue{}
+			state[asm.R0] = fpValue{}
+		}
+
+	case asm.JumpClass, asm.Jump32Class:
+		if op.JumpOp() != asm.Call {
+			break
+		}
+
+		for reg := asm.R1; reg <= asm.R5; reg++ {
+			if state[reg].kind == fpUnknown {
+				return fmt.Errorf("stack pointer with unknown offset passed to call in r%d", reg)
+			}
+		}
+
+		for reg := asm.R0; reg <= asm.R5; reg++ {
+			state[reg] = fpValue{}
+		}
+	}
+
+	// The frame pointer is read-only
+	state[asm.R10] = fpValue{kind: fpOffset}
+
+	return nil
+}
+
+// analyzeProgram determines the usage of the program according to the analysis mode.
+func analyzeProgram(
+	name string,
+	insns asm.Instructions,
+	verifierLog string,
+	mode AnalysisMode,
+	logWriter io.Writer,
+) (*programUsage, error) {
+	var verifierUse, staticUse *programUsage
+	if mode.needsVerifierLog() {
+		mergedStates := verifierlog.MergedPerInstruction(verifierLog)
+		if logWriter != nil {
+			fmt.Fprintln(logWriter, "---", name, "--- Merged states ---")
+			for i, mergedState := range mergedStates {
+				fmt.Fprintf(logWriter, "%5d: %s\n", i, mergedState.String())
+			}
+		}
+
+		verifierUse = verifierUsage(name, insns, mergedStates)
+	}
+
+	if mode != AnalysisVerifier {
+		var err error
+		staticUse, err = staticUsage(name, insns)
+		if err != nil {
+			if mode == AnalysisStatic {
+				return nil, fmt.Errorf("static analysis: %w", err)
+			}
+
+			// When cross-checking we can still use the verifier usage.
+			if logWriter != nil {
+				fmt.Fprintln(logWriter, "---", name, "--- Static analysis failed ---")
+				fmt.Fprintln(logWriter, err)
+			}
+			return verifierUse, nil
+		}
+
+		if logWriter != nil {
+			fmt.Fprintln(logWriter, "---", name, "--- Live registers ---")
+			for i, regs := range staticUse.registers {
+				fmt.Fprintf(logWriter, "%5d: %s\n", i, regs)
+			}
+		}
+	}
+
+	switch mode {
+	case AnalysisVerifier:
+		return verifierUse, nil
+	case AnalysisStatic:
+		return staticUse, nil
+	}
+
+	if logWriter != nil {
+		logDisagreements(logWriter, name, verifierUse, staticUse)
+	}
+
+	return verifierUse.merge(staticUse), nil
+}
+
+// logDisagreements logs the instructions at which registers are live according to the static analysis but have no
+// state according to the verifier, and functions of which the stack depths differ.
+func logDisagreements(logWriter io.Writer, name string, verifierUse, staticUse *programUsage) {
+	fmt.Fprintln(logWriter, "---", name, "--- Cross-check ---")
+
+	unusedByVerifier := 0
+	for i := range staticUse.registers {
+		if i >= len(verifierUse.known) || !verifierUse.known[i] {
+			continue
+		}
+
+		// The verifier tracks registers which hold a value, which is a super set of the live registers.
+		extra := staticUse.registers[i] &^ verifierUse.registers[i]
+		if extra != 0 {
+			fmt.Fprintf(logWriter, "%5d: live but not tracked by verifier: %s\n", i, extra)
+			unusedByVerifier++
+		}
+	}
+
+	for fn, depth := range staticUse.stackDepth {
+		if depth != verifierUse.stackDepth[fn] {
+			fmt.Fprintf(logWriter, "%s: static stack depth %d, verifier stack depth %d\n",
+				fn, depth, verifierUse.stackDepth[fn])
+		}
+	}
+
+	fmt.Fprintln(logWriter, "Instructions with disagreeing registers:", unusedByVerifier)
+}
@@ -0,0 +1,53 @@
+package coverbee
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf/asm"
+)
+
+func TestStaticUsage(t *testing.T) {
+	insns := asm.Instructions{
+		asm.Mov.Imm(asm.R6, 0).WithSymbol("prog"),
+		// Pointer derived from the frame pointer
+		asm.Mov.Reg(asm.R2, asm.R10),
+		asm.Add.Imm(asm.R2, -16),
+		asm.StoreImm(asm.R2, 0, 1, asm.DWord),
+		// Direct stack access
+		asm.LoadMem(asm.R3, asm.R10, -24, asm.DWord),
+		asm.JEq.Imm(asm.R3, 0, "exit"),
+		asm.Mov.Reg(asm.R0, asm.R6),
+		asm.Return(),
+		asm.Mov.Imm(asm.R0, 1).WithSymbol("exit"),
+		asm.Return(),
+	}
+
+	usage, err := staticUsage("prog", insns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := usage.stackDepth["prog"]; got != 24 {
+		t.Errorf("stack depth = %d, want 24", got)
+	}
+
+	var r10, r6, r0 registerSet
+	r10.add(asm.R10)
+	r6.add(asm.R6, asm.R10)
+	r0.add(asm.R0, asm.R10)
+
+	want := map[int]registerSet{
+		0: r10,
+		1: r6,
+		5: r6 | (1 << asm.R3),
+		6: r6,
+		7: r0,
+		8: r10,
+		9: r0,
+	}
+	for instn, regs := range want {
+		if got := usage.usedRegisters(instn); got != regs {
+			t.Errorf("instruction %d: used registers = %s, want %s", instn, got, regs)
+		}
+	}
+}
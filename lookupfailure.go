@@ -0,0 +1,89 @@
+package coverbee
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// LookupFailureAction determines what the instrumentation code does if the lookup of the cover-map entry at the start
+// of a program or function fails. The lookup only fails if the cover-map was replaced by one with fewer entries, but
+// the verifier requires the instrumentation to handle it.
+type LookupFailureAction string
+
+const (
+	// LookupFailureDefault exits the function with the return value which lets the program type continue as if the
+	// program wasn't attached, see `DefaultLookupFailureReturn`. This is the default.
+	LookupFailureDefault LookupFailureAction = "default"
+	// LookupFailureReturn exits the function with `LookupFailure.ReturnValue`.
+	LookupFailureReturn LookupFailureAction = "return"
+	// LookupFailureSkip continues without counting. Every counter increment checks if the lookup succeeded, which
+	// costs an extra instruction per block.
+	LookupFailureSkip LookupFailureAction = "skip"
+)
+
+func (a LookupFailureAction) validate() error {
+	switch a {
+	case LookupFailureDefault, LookupFailureReturn, LookupFailureSkip:
+		return nil
+	default:
+		return fmt.Errorf("invalid lookup failure action '%s', pick from default, return or skip", a)
+	}
+}
+
+// LookupFailure is the policy for failed lookups of the cover-map entry. It only applies to `CounterStorageLookup`,
+// global counters are never looked up. Callbacks of helpers like bpf_loop always return 0 when exiting.
+type LookupFailure struct {
+	// Defaults to `LookupFailureDefault`.
+	Action LookupFailureAction
+	// The value returned with `LookupFailureReturn`.
+	ReturnValue int32
+}
+
+func (lf LookupFailure) withDefaults() LookupFailure {
+	if lf.Action == "" {
+		lf.Action = LookupFailureDefault
+	}
+
+	return lf
+}
+
+// resolve replaces `LookupFailureDefault` with the default return value of the program type.
+func (lf LookupFailure) resolve(progType ebpf.ProgramType) LookupFailure {
+	if lf.Action != LookupFailureDefault {
+		return lf
+	}
+
+	return LookupFailure{
+		Action:      LookupFailureReturn,
+		ReturnValue: DefaultLookupFailureReturn(progType),
+	}
+}
+
+// DefaultLookupFailureReturn returns the value an instrumented program of the given type returns by default if the
+// cover-map lookup fails. It is the value which passes the packet or allows the operation, so a failed lookup
+// doesn't change the outcome for the program type. Sub-programs return the same value to their caller.
+func DefaultLookupFailureReturn(progType ebpf.ProgramType) int32 {
+	switch progType {
+	case ebpf.XDP:
+		// XDP_PASS
+		return 2
+	case ebpf.SocketFilter:
+		// The number of bytes to keep, -1 keeps the whole packet.
+		return -1
+	case ebpf.CGroupSKB, ebpf.CGroupSock, ebpf.CGroupDevice, ebpf.CGroupSockAddr, ebpf.CGroupSysctl,
+		ebpf.CGroupSockopt, ebpf.SockOps:
+		// Allow
+		return 1
+	case ebpf.SkSKB, ebpf.SkMsg, ebpf.SkReuseport, ebpf.SkLookup:
+		// SK_PASS
+		return 1
+	case ebpf.Netfilter:
+		// NF_ACCEPT
+		return 1
+	default:
+		// TC_ACT_OK for tc programs, BPF_OK for LWT and flow dissector programs, allow for LSM programs. Tracing
+		// programs ignore the return value or require it to be 0.
+		return 0
+	}
+}
@@ -0,0 +1,55 @@
+package coverbee
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestLookupFailureResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   LookupFailure
+		progType ebpf.ProgramType
+		want     LookupFailure
+	}{
+		{
+			name:     "Default XDP",
+			progType: ebpf.XDP,
+			want:     LookupFailure{Action: LookupFailureReturn, ReturnValue: 2},
+		},
+		{
+			name:     "Default cgroup",
+			progType: ebpf.CGroupSKB,
+			want:     LookupFailure{Action: LookupFailureReturn, ReturnValue: 1},
+		},
+		{
+			name:     "Default tc",
+			progType: ebpf.SchedCLS,
+			want:     LookupFailure{Action: LookupFailureReturn, ReturnValue: 0},
+		},
+		{
+			name:     "Override",
+			policy:   LookupFailure{Action: LookupFailureReturn, ReturnValue: 1},
+			progType: ebpf.XDP,
+			want:     LookupFailure{Action: LookupFailureReturn, ReturnValue: 1},
+		},
+		{
+			name:     "Skip",
+			policy:   LookupFailure{Action: LookupFailureSkip},
+			progType: ebpf.XDP,
+			want:     LookupFailure{Action: LookupFailureSkip},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.withDefaults().resolve(tt.progType); got != tt.want {
+				t.Errorf("resolve() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if err := (LookupFailure{Action: "exit"}).Action.validate(); err == nil {
+		t.Error("expected an error for an invalid action")
+	}
+}
@@ -0,0 +1,177 @@
+// Package cfg builds the control flow graph of eBPF programs. Besides the basic blocks it offers predecessors, the
+// partitioning of a program into bpf-to-bpf functions, dominator and post-dominator trees, natural loops and the
+// reverse post-order of the blocks of every function. The graph can be exported as JSON or Graphviz DOT.
+package cfg
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/exp/slices"
+)
+
+// ProgramBlocks takes a list of instructions and converts it into a a CFG(Control Flow Graph).
+// Which works as follows:
+//  1. Construct a translation map from RawOffsets to the instructions(since index within the slice doesn't account for
+//     LDIMM64 instructions which use two instructions).
+//  2. Apply a label to every jump target and set that label as a reference in the branching instruction. This does two
+//     things. First, it makes it easy to find all block boundaries since each block has a function name or jump label.
+//     The second is that cilium/ebpf will recalculate the offsets of the jumps based on the symbols when loading, so
+//     we can easily add instructions to blocks without fear of breaking offsets.
+//  3. Loop over all instructions, creating a block at each branching instruction or symbol/jump label.
+//  4. Build a translation map from symbol/jump label to block.
+//  5. Loop over all blocks, using the map from step 4 to link blocks together on the branching and non-branching edges.
+func ProgramBlocks(prog asm.Instructions) []*BasicBlock {
+	prog = slices.Clone(prog)
+
+	// Make a RawInstOffset -> instruction lookup which improves performance during jump labeling
+	iter := prog.Iterate()
+	offToInst := map[asm.RawInstructionOffset]*asm.Instruction{}
+	for iter.Next() {
+		offToInst[iter.Offset] = iter.Ins
+	}
+
+	iter = prog.Iterate()
+	for iter.Next() {
+		inst := iter.Ins
+
+		// Ignore non-jump ops, or "special" jump instructions
+		op := inst.OpCode.JumpOp()
+		switch op {
+		case asm.InvalidJumpOp, asm.Call, asm.Exit:
+			continue
+		}
+
+		targetOff := iter.Offset + asm.RawInstructionOffset(inst.Offset+1)
+		label := fmt.Sprintf("j-%d", targetOff)
+
+		target := offToInst[targetOff]
+		*target = target.WithSymbol(label)
+
+		inst.Offset = -1
+		*inst = inst.WithReference(label)
+	}
+
+	blocks := make([]*BasicBlock, 0)
+	curBlock := &BasicBlock{}
+	for _, inst := range prog {
+		if inst.Symbol() != "" {
+			if len(curBlock.Block) > 0 {
+				newBlock := &BasicBlock{
+					Index: curBlock.Index + 1,
+				}
+				curBlock.NoBranch = newBlock
+				blocks = append(blocks, curBlock)
+				curBlock = newBlock
+			}
+		}
+
+		curBlock.Block = append(curBlock.Block, inst)
+
+		// Continue on non-jump ops
+		op := inst.OpCode.JumpOp()
+		if op == asm.InvalidJumpOp {
+			continue
+		}
+
+		newBlock := &BasicBlock{
+			Index: curBlock.Index + 1,
+		}
+
+		if op != asm.Exit {
+			// If the current op is exit, then the current block will not continue into the block after it.
+			curBlock.NoBranch = newBlock
+		}
+
+		blocks = append(blocks, curBlock)
+		curBlock = newBlock
+	}
+
+	symToBlock := make(map[string]*BasicBlock)
+	for _, block := range blocks {
+		sym := block.Block[0].Symbol()
+		if sym != "" {
+			symToBlock[sym] = block
+		}
+	}
+
+	for _, block := range blocks {
+		lastInst := block.Block[len(block.Block)-1]
+
+		// Ignore non-jump ops and exit's
+		op := lastInst.OpCode.JumpOp()
+		switch op {
+		case asm.InvalidJumpOp, asm.Exit:
+			continue
+		}
+
+		block.Branch = symToBlock[lastInst.Reference()]
+	}
+
+	return blocks
+}
+
+// BasicBlock is a block of non-branching code, which makes up a node within the CFG.
+type BasicBlock struct {
+	Index int
+	// The current block of code
+	Block asm.Instructions
+
+	// The next block of we don't branch
+	NoBranch *BasicBlock
+	// The next block if we do branch
+	Branch *BasicBlock
+}
+
+// Successors returns the blocks which can be executed after the block within the same function. Calls are considered
+// to return to the next block, the entry of a bpf-to-bpf function called by the block is not a successor.
+func (b *BasicBlock) Successors() []*BasicBlock {
+	if len(b.Block) == 0 {
+		return nil
+	}
+
+	var succ []*BasicBlock
+	add := func(block *BasicBlock) {
+		// The block after the last instruction is empty and not part of the program.
+		if block != nil && len(block.Block) > 0 && !slices.Contains(succ, block) {
+			succ = append(succ, block)
+		}
+	}
+
+	last := b.Block[len(b.Block)-1]
+	switch last.OpCode.JumpOp() {
+	case asm.Exit:
+	case asm.Call, asm.InvalidJumpOp:
+		add(b.NoBranch)
+	case asm.Ja:
+		if last.OpCode.Class() == asm.JumpClass && b.Branch != nil {
+			add(b.Branch)
+			break
+		}
+		add(b.NoBranch)
+		add(b.Branch)
+	default:
+		add(b.NoBranch)
+		add(b.Branch)
+	}
+
+	return succ
+}
+
+// LeavesFunction returns true if the block can leave the function it is part of, because it ends with an exit or a
+// tail call. A tail call which fails continues with the next block.
+func (b *BasicBlock) LeavesFunction() bool {
+	if len(b.Block) == 0 {
+		return false
+	}
+
+	last := b.Block[len(b.Block)-1]
+	switch {
+	case last.OpCode.JumpOp() == asm.Exit:
+		return true
+	case last.IsBuiltinCall() && asm.BuiltinFunc(last.Constant) == asm.FnTailCall:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,174 @@
+package cfg
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf/asm"
+)
+
+func jump(op asm.JumpOp, dst asm.Register, imm int64, off int16) asm.Instruction {
+	return asm.Instruction{
+		OpCode:   asm.OpCode(asm.JumpClass).SetJumpOp(op).SetSource(asm.ImmSource),
+		Dst:      dst,
+		Offset:   off,
+		Constant: imm,
+	}
+}
+
+// testGraph returns the graph of a program with a diamond followed by a loop and a call, a function which passes a
+// callback to bpf_loop, and the callback.
+func testGraph() *Graph {
+	return New(asm.Instructions{
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("main"),
+		jump(asm.JEq, asm.R1, 0, 2),
+		asm.Mov.Imm(asm.R0, 1),
+		jump(asm.Ja, asm.R0, 0, 1),
+		asm.Mov.Imm(asm.R0, 2),
+		asm.Add.Imm(asm.R0, 1),
+		jump(asm.JGT, asm.R0, 5, 1),
+		asm.Add.Imm(asm.R0, 2),
+		jump(asm.JLT, asm.R0, 10, -4),
+		asm.Call.Label("sub"),
+		asm.Return(),
+		asm.Instruction{
+			OpCode: asm.LoadImmOp(asm.DWord),
+			Dst:    asm.R2,
+			Src:    asm.PseudoFunc,
+		}.WithReference("cb").WithSymbol("sub"),
+		asm.FnLoop.Call(),
+		asm.Return(),
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("cb"),
+		asm.Return(),
+	})
+}
+
+func TestGraph(t *testing.T) {
+	g := testGraph()
+	if len(g.Blocks) != 11 {
+		t.Fatalf("expected 11 blocks, got %d", len(g.Blocks))
+	}
+
+	tests := []struct {
+		block    int
+		function string
+		succ     []int
+		pred     []int
+		dom      int
+		postDom  int
+	}{
+		{block: 0, function: "main", succ: []int{1, 2}, pred: []int{}, dom: -1, postDom: 3},
+		{block: 1, function: "main", succ: []int{3}, pred: []int{0}, dom: 0, postDom: 3},
+		{block: 2, function: "main", succ: []int{3}, pred: []int{0}, dom: 0, postDom: 3},
+		{block: 3, function: "main", succ: []int{4, 5}, pred: []int{1, 2, 5}, dom: 0, postDom: 5},
+		{block: 4, function: "main", succ: []int{5}, pred: []int{3}, dom: 3, postDom: 5},
+		{block: 5, function: "main", succ: []int{6, 3}, pred: []int{3, 4}, dom: 3, postDom: 6},
+		{block: 6, function: "main", succ: []int{7}, pred: []int{5}, dom: 5, postDom: 7},
+		{block: 7, function: "main", succ: []int{}, pred: []int{6}, dom: 6, postDom: -1},
+		{block: 8, function: "sub", succ: []int{9}, pred: []int{}, dom: -1, postDom: 9},
+		{block: 9, function: "sub", succ: []int{}, pred: []int{8}, dom: 8, postDom: -1},
+		{block: 10, function: "cb", succ: []int{}, pred: []int{}, dom: -1, postDom: -1},
+	}
+	for _, tt := range tests {
+		block := g.Blocks[tt.block]
+		fn := g.Function(block)
+		if fn.Name != tt.function {
+			t.Errorf("block %d: expected function '%s', got '%s'", tt.block, tt.function, fn.Name)
+		}
+		if succ := indices(g.Successors(block)); !reflect.DeepEqual(succ, tt.succ) {
+			t.Errorf("block %d: expected successors %v, got %v", tt.block, tt.succ, succ)
+		}
+		if pred := indices(g.Predecessors(block)); !reflect.DeepEqual(pred, tt.pred) {
+			t.Errorf("block %d: expected predecessors %v, got %v", tt.block, tt.pred, pred)
+		}
+		if dom := index(fn.Dominators().Immediate(block)); dom != tt.dom {
+			t.Errorf("block %d: expected dominator %d, got %d", tt.block, tt.dom, dom)
+		}
+		if postDom := index(fn.PostDominators().Immediate(block)); postDom != tt.postDom {
+			t.Errorf("block %d: expected post-dominator %d, got %d", tt.block, tt.postDom, postDom)
+		}
+	}
+
+	main, sub, cb := g.Functions[0], g.Functions[1], g.Functions[2]
+	if len(g.Functions) != 3 || main.Callback || sub.Callback || !cb.Callback {
+		t.Errorf("expected functions main, sub and callback cb, got %v", g.Functions)
+	}
+	if callee := g.Callee(g.Blocks[6]); callee != sub {
+		t.Errorf("expected block 6 to call sub, got %v", callee)
+	}
+	if rpo := indices(main.ReversePostOrder()); !reflect.DeepEqual(rpo, []int{0, 2, 1, 3, 4, 5, 6, 7}) {
+		t.Errorf("unexpected reverse post-order %v", rpo)
+	}
+	if !main.Dominators().Dominates(g.Blocks[3], g.Blocks[7]) || main.Dominators().Dominates(g.Blocks[4], g.Blocks[5]) {
+		t.Error("unexpected dominance")
+	}
+	if roots := indices(main.PostDominators().Roots()); !reflect.DeepEqual(roots, []int{7}) {
+		t.Errorf("expected post-dominator root 7, got %v", roots)
+	}
+}
+
+func TestLoops(t *testing.T) {
+	// Nested loops, the inner loop consists of a single block.
+	g := New(asm.Instructions{
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("prog"),
+		asm.Add.Imm(asm.R1, 1).WithSymbol("outer"),
+		asm.Add.Imm(asm.R2, 1).WithSymbol("inner"),
+		jump(asm.JLT, asm.R2, 5, -2),
+		jump(asm.JLT, asm.R1, 5, -4),
+		asm.Return(),
+	})
+
+	loops := g.Functions[0].Loops()
+	if len(loops) != 2 {
+		t.Fatalf("expected 2 loops, got %d", len(loops))
+	}
+
+	outer, inner := loops[0], loops[1]
+	if outer.Header.Index != 1 || !reflect.DeepEqual(indices(outer.Latches), []int{3}) ||
+		!reflect.DeepEqual(indices(outer.Blocks), []int{1, 2, 3}) || outer.Parent != nil {
+		t.Errorf("unexpected outer loop %+v", outer)
+	}
+	if inner.Header.Index != 2 || !reflect.DeepEqual(indices(inner.Latches), []int{2}) ||
+		!reflect.DeepEqual(indices(inner.Blocks), []int{2}) || inner.Parent != outer {
+		t.Errorf("unexpected inner loop %+v", inner)
+	}
+}
+
+func TestExport(t *testing.T) {
+	g := testGraph()
+
+	data, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graph jsonGraph
+	if err = json.Unmarshal(data, &graph); err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Functions) != 3 || len(graph.Functions[0].Blocks) != 8 || len(graph.Functions[0].Loops) != 1 {
+		t.Fatalf("unexpected JSON %s", data)
+	}
+	if loop := graph.Functions[0].Loops[0]; loop.Header != 3 || loop.Parent != -1 {
+		t.Errorf("unexpected loop %+v", loop)
+	}
+
+	var buf bytes.Buffer
+	if err = g.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	for _, line := range []string{
+		"digraph cfg {",
+		"\tsubgraph cluster_1 {\n\t\tlabel=\"sub\";",
+		"\tb0 -> b1;",
+		"\tb5 -> b3 [style=bold];",
+		"\tb6 -> b8 [style=dashed];",
+	} {
+		if !strings.Contains(dot, line) {
+			t.Errorf("expected DOT to contain %q, got:\n%s", line, dot)
+		}
+	}
+}
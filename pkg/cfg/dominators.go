@@ -0,0 +1,299 @@
+package cfg
+
+import (
+	"golang.org/x/exp/slices"
+)
+
+// ReversePostOrder returns the blocks of the function which are reachable from its entry in reverse post-order, in
+// which every block comes before its successors, except along back edges.
+func (f *Function) ReversePostOrder() []*BasicBlock {
+	order := postOrder(0, f.localSuccessors())
+
+	blocks := make([]*BasicBlock, 0, len(order))
+	for i := len(order) - 1; i >= 0; i-- {
+		blocks = append(blocks, f.Blocks[order[i]])
+	}
+	return blocks
+}
+
+// postOrder returns the nodes reachable from the root in depth-first post-order.
+func postOrder(root int, succs [][]int) []int {
+	visited := make([]bool, len(succs))
+	order := make([]int, 0, len(succs))
+
+	var visit func(node int)
+	visit = func(node int) {
+		visited[node] = true
+		for _, succ := range succs[node] {
+			if !visited[succ] {
+				visit(succ)
+			}
+		}
+		order = append(order, node)
+	}
+	visit(root)
+
+	return order
+}
+
+// DominatorTree is the dominator or post-dominator tree of a function. A block dominates another block if every path
+// from the entry of the function to the other block goes through it. A block post-dominates another block if every
+// path from the other block to an exit of the function goes through it.
+type DominatorTree struct {
+	fn *Function
+	// The immediate dominator of every block by position within the function, -1 for roots and unreachable blocks.
+	idom  []int
+	roots []int
+}
+
+// Dominators returns the dominator tree of the function, of which the entry is the root. Blocks which are not
+// reachable from the entry are not part of the tree.
+func (f *Function) Dominators() *DominatorTree {
+	succs := f.localSuccessors()
+	return &DominatorTree{
+		fn:    f,
+		idom:  immediateDominators(0, succs, predecessorsOf(succs)),
+		roots: []int{0},
+	}
+}
+
+// PostDominators returns the post-dominator tree of the function. The exits of the function lead to a virtual exit
+// node, which is left out of the tree. So blocks which are only post-dominated by the virtual exit, like the exits of
+// a function with more than one exit, are the roots of the tree. Blocks which can't reach an exit are not part of the
+// tree.
+func (f *Function) PostDominators() *DominatorTree {
+	n := len(f.Blocks)
+
+	// The reversed graph, with the virtual exit at position n.
+	preds := f.localSuccessors()
+	preds = append(preds, nil)
+	for i, block := range f.Blocks {
+		if block.LeavesFunction() {
+			preds[i] = append(preds[i], n)
+		}
+	}
+	succs := predecessorsOf(preds)
+
+	idom := immediateDominators(n, succs, preds)
+	tree := &DominatorTree{fn: f, idom: idom[:n]}
+	for i := range tree.idom {
+		if tree.idom[i] == n {
+			tree.idom[i] = -1
+			tree.roots = append(tree.roots, i)
+		}
+	}
+
+	return tree
+}
+
+// immediateDominators returns the immediate dominator of every node of the graph with the given root, -1 for the root
+// and nodes which are not reachable from it. It uses the iterative algorithm of Cooper, Harvey and Kennedy.
+func immediateDominators(root int, succs, preds [][]int) []int {
+	order := postOrder(root, succs)
+	orderOf := make([]int, len(succs))
+	for i, node := range order {
+		orderOf[node] = i
+	}
+
+	idom := make([]int, len(succs))
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[root] = root
+
+	intersect := func(a, b int) int {
+		for a != b {
+			for orderOf[a] < orderOf[b] {
+				a = idom[a]
+			}
+			for orderOf[b] < orderOf[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := len(order) - 1; i >= 0; i-- {
+			node := order[i]
+			if node == root {
+				continue
+			}
+
+			newIdom := -1
+			for _, pred := range preds[node] {
+				if idom[pred] == -1 {
+					continue
+				}
+				if newIdom == -1 {
+					newIdom = pred
+					continue
+				}
+				newIdom = intersect(pred, newIdom)
+			}
+
+			if idom[node] != newIdom {
+				idom[node] = newIdom
+				changed = true
+			}
+		}
+	}
+
+	idom[root] = -1
+	return idom
+}
+
+// Roots returns the roots of the tree.
+func (t *DominatorTree) Roots() []*BasicBlock {
+	return t.blocks(t.roots)
+}
+
+// Immediate returns the immediate dominator of the given block, or nil if the block is a root of the tree or not part
+// of it.
+func (t *DominatorTree) Immediate(block *BasicBlock) *BasicBlock {
+	i, found := t.fn.local(block)
+	if !found || t.idom[i] == -1 {
+		return nil
+	}
+	return t.fn.Blocks[t.idom[i]]
+}
+
+// Children returns the blocks of which the given block is the immediate dominator.
+func (t *DominatorTree) Children(block *BasicBlock) []*BasicBlock {
+	i, found := t.fn.local(block)
+	if !found {
+		return nil
+	}
+
+	var children []int
+	for j, idom := range t.idom {
+		if idom == i {
+			children = append(children, j)
+		}
+	}
+	return t.blocks(children)
+}
+
+// Dominates returns true if block `a` dominates block `b`. Every block dominates itself.
+func (t *DominatorTree) Dominates(a, b *BasicBlock) bool {
+	i, found := t.fn.local(a)
+	if !found {
+		return false
+	}
+	j, found := t.fn.local(b)
+	if !found {
+		return false
+	}
+	return t.dominates(i, j)
+}
+
+func (t *DominatorTree) dominates(a, b int) bool {
+	for node := b; node != -1; node = t.idom[node] {
+		if node == a {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if the block at the given position within the function is part of the tree.
+func (t *DominatorTree) contains(node int) bool {
+	return t.idom[node] != -1 || slices.Contains(t.roots, node)
+}
+
+func (t *DominatorTree) blocks(nodes []int) []*BasicBlock {
+	blocks := make([]*BasicBlock, 0, len(nodes))
+	for _, node := range nodes {
+		blocks = append(blocks, t.fn.Blocks[node])
+	}
+	return blocks
+}
+
+// Loop is a natural loop, which consists of a header that dominates all blocks of the loop and the blocks from which
+// the header can be reached again without leaving the loop.
+type Loop struct {
+	// The only block through which the loop can be entered.
+	Header *BasicBlock
+	// The blocks with a back edge to the header.
+	Latches []*BasicBlock
+	// The blocks of the loop including the header, in program order.
+	Blocks []*BasicBlock
+	// The innermost loop which contains this loop, nil if the loop isn't nested.
+	Parent *Loop
+}
+
+// Loops returns the natural loops of the function, ordered by the position of their header. Back edges to the same
+// header form a single loop. Cycles which can be entered through more than one block are irreducible and not
+// returned, the eBPF verifier rejects them unless they are bounded.
+func (f *Function) Loops() []*Loop {
+	dom := f.Dominators()
+	succs := f.localSuccessors()
+	preds := predecessorsOf(succs)
+
+	// An edge is a back edge if its target dominates its source.
+	latches := make(map[int][]int)
+	var headers []int
+	for node, succ := range succs {
+		if !dom.contains(node) {
+			continue
+		}
+		for _, header := range succ {
+			if !dom.dominates(header, node) {
+				continue
+			}
+			if _, found := latches[header]; !found {
+				headers = append(headers, header)
+			}
+			latches[header] = append(latches[header], node)
+		}
+	}
+	slices.Sort(headers)
+
+	loops := make([]*Loop, 0, len(headers))
+	bodies := make([][]bool, 0, len(headers))
+	sizes := make([]int, 0, len(headers))
+	for _, header := range headers {
+		// The body consists of all blocks from which a latch can be reached without going through the header.
+		body := make([]bool, len(f.Blocks))
+		body[header] = true
+		worklist := append([]int(nil), latches[header]...)
+		for len(worklist) > 0 {
+			node := worklist[len(worklist)-1]
+			worklist = worklist[:len(worklist)-1]
+			if body[node] || !dom.contains(node) {
+				continue
+			}
+			body[node] = true
+			worklist = append(worklist, preds[node]...)
+		}
+
+		loop := &Loop{
+			Header:  f.Blocks[header],
+			Latches: dom.blocks(latches[header]),
+		}
+		for i, inLoop := range body {
+			if inLoop {
+				loop.Blocks = append(loop.Blocks, f.Blocks[i])
+			}
+		}
+
+		loops = append(loops, loop)
+		bodies = append(bodies, body)
+		sizes = append(sizes, len(loop.Blocks))
+	}
+
+	// The parent of a loop is the smallest other loop which contains its header.
+	for i, loop := range loops {
+		for j, other := range loops {
+			if i == j || !bodies[j][headers[i]] || sizes[j] <= sizes[i] {
+				continue
+			}
+			if loop.Parent == nil || sizes[j] < len(loop.Parent.Blocks) {
+				loop.Parent = other
+			}
+		}
+	}
+
+	return loops
+}
@@ -0,0 +1,166 @@
+package cfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type jsonGraph struct {
+	Functions []jsonFunction
+}
+
+type jsonFunction struct {
+	Name     string
+	Callback bool
+	Blocks   []jsonBlock
+	// Block indices in reverse post-order.
+	ReversePostOrder []int
+	Loops            []jsonLoop
+}
+
+type jsonBlock struct {
+	Index        int
+	Symbol       string
+	Instructions []string
+	Successors   []int
+	Predecessors []int
+	// The name of the called bpf-to-bpf function, empty if the block doesn't call one.
+	Callee string
+	// The block index of the immediate dominator and post-dominator, -1 if there is none.
+	Dominator     int
+	PostDominator int
+}
+
+type jsonLoop struct {
+	Header  int
+	Latches []int
+	Blocks  []int
+	// The block index of the header of the parent loop, -1 if there is none.
+	Parent int
+}
+
+// MarshalJSON encodes the graph as JSON. Every function contains its blocks, with their instructions, edges and
+// immediate dominators, its reverse post-order and its loops. Blocks are referred to by `BasicBlock.Index`.
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	graph := jsonGraph{Functions: make([]jsonFunction, 0, len(g.Functions))}
+	for _, fn := range g.Functions {
+		dom := fn.Dominators()
+		postDom := fn.PostDominators()
+
+		fnJSON := jsonFunction{
+			Name:             fn.Name,
+			Callback:         fn.Callback,
+			Blocks:           make([]jsonBlock, 0, len(fn.Blocks)),
+			ReversePostOrder: indices(fn.ReversePostOrder()),
+			Loops:            make([]jsonLoop, 0),
+		}
+
+		for _, block := range fn.Blocks {
+			blockJSON := jsonBlock{
+				Index:         block.Index,
+				Symbol:        block.Block[0].Symbol(),
+				Instructions:  make([]string, 0, len(block.Block)),
+				Successors:    indices(g.Successors(block)),
+				Predecessors:  indices(g.Predecessors(block)),
+				Dominator:     index(dom.Immediate(block)),
+				PostDominator: index(postDom.Immediate(block)),
+			}
+			for _, inst := range block.Block {
+				blockJSON.Instructions = append(blockJSON.Instructions, fmt.Sprint(inst))
+			}
+			if callee := g.Callee(block); callee != nil {
+				blockJSON.Callee = callee.Name
+			}
+			fnJSON.Blocks = append(fnJSON.Blocks, blockJSON)
+		}
+
+		for _, loop := range fn.Loops() {
+			loopJSON := jsonLoop{
+				Header:  loop.Header.Index,
+				Latches: indices(loop.Latches),
+				Blocks:  indices(loop.Blocks),
+				Parent:  -1,
+			}
+			if loop.Parent != nil {
+				loopJSON.Parent = loop.Parent.Header.Index
+			}
+			fnJSON.Loops = append(fnJSON.Loops, loopJSON)
+		}
+
+		graph.Functions = append(graph.Functions, fnJSON)
+	}
+
+	return json.Marshal(graph)
+}
+
+func indices(blocks []*BasicBlock) []int {
+	idx := make([]int, 0, len(blocks))
+	for _, block := range blocks {
+		idx = append(idx, block.Index)
+	}
+	return idx
+}
+
+func index(block *BasicBlock) int {
+	if block == nil {
+		return -1
+	}
+	return block.Index
+}
+
+// WriteDOT writes the graph in the Graphviz DOT format. Every function is a cluster and every block a node labeled
+// with its instructions. Back edges of loops are drawn bold, calls of bpf-to-bpf functions are dashed edges to the
+// entry of the callee.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("digraph cfg {\n")
+	sb.WriteString("\tnode [shape=box, fontname=monospace];\n")
+
+	backEdges := make(map[[2]*BasicBlock]bool)
+	for i, fn := range g.Functions {
+		for _, loop := range fn.Loops() {
+			for _, latch := range loop.Latches {
+				backEdges[[2]*BasicBlock{latch, loop.Header}] = true
+			}
+		}
+
+		fmt.Fprintf(&sb, "\tsubgraph cluster_%d {\n", i)
+		fmt.Fprintf(&sb, "\t\tlabel=\"%s\";\n", dotEscape(fn.Name))
+		for _, block := range fn.Blocks {
+			fmt.Fprintf(&sb, "\t\tb%d [label=\"", block.Index)
+			if sym := block.Block[0].Symbol(); sym != "" {
+				fmt.Fprintf(&sb, "%s:\\l", dotEscape(sym))
+			}
+			for _, inst := range block.Block {
+				fmt.Fprintf(&sb, "%s\\l", dotEscape(fmt.Sprint(inst)))
+			}
+			sb.WriteString("\"];\n")
+		}
+		sb.WriteString("\t}\n")
+	}
+
+	for _, block := range g.Blocks {
+		for _, succ := range g.Successors(block) {
+			fmt.Fprintf(&sb, "\tb%d -> b%d", block.Index, succ.Index)
+			if backEdges[[2]*BasicBlock{block, succ}] {
+				sb.WriteString(" [style=bold]")
+			}
+			sb.WriteString(";\n")
+		}
+		if callee := g.Callee(block); callee != nil {
+			fmt.Fprintf(&sb, "\tb%d -> b%d [style=dashed];\n", block.Index, callee.Entry().Index)
+		}
+	}
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func dotEscape(s string) string {
+	return dotEscaper.Replace(s)
+}
@@ -0,0 +1,203 @@
+package cfg
+
+import (
+	"github.com/cilium/ebpf/asm"
+)
+
+// Graph is the control flow graph of a program, with the predecessors of every block and the partitioning of the
+// program into functions.
+type Graph struct {
+	// The blocks of the program, in program order.
+	Blocks []*BasicBlock
+	// The functions of the program, in program order. The first function is the program itself.
+	Functions []*Function
+
+	// Position of every block in `Blocks`.
+	index map[*BasicBlock]int
+	// Successors and predecessors of every block, by position.
+	successors   [][]int
+	predecessors [][]int
+	// Position of the function of every block in `Functions`.
+	function []int
+}
+
+// Function is a bpf-to-bpf function, or the main function of the program. The blocks of a function are contiguous.
+type Function struct {
+	// The symbol of the first instruction of the function, which is the name of the function.
+	Name string
+	// True if the function is passed to a helper like bpf_loop via a function pointer.
+	Callback bool
+	// The blocks of the function, in program order. The first block is the entry of the function.
+	Blocks []*BasicBlock
+
+	graph *Graph
+	// Position of the first block of the function in the blocks of the graph.
+	start int
+}
+
+// New builds the control flow graph of the given instructions.
+func New(prog asm.Instructions) *Graph {
+	return FromBlocks(ProgramBlocks(prog))
+}
+
+// FromBlocks builds the control flow graph of the blocks returned by `ProgramBlocks`. A function starts at the first
+// block and at every block of which the symbol is called as bpf-to-bpf function or referenced as callback.
+func FromBlocks(blocks []*BasicBlock) *Graph {
+	g := &Graph{
+		Blocks:       blocks,
+		index:        make(map[*BasicBlock]int, len(blocks)),
+		successors:   make([][]int, len(blocks)),
+		predecessors: make([][]int, len(blocks)),
+		function:     make([]int, len(blocks)),
+	}
+
+	funcs := make(map[string]bool)
+	callbacks := make(map[string]bool)
+	for i, block := range blocks {
+		g.index[block] = i
+		for _, inst := range block.Block {
+			if inst.IsFunctionReference() {
+				funcs[inst.Reference()] = true
+			}
+			if inst.IsLoadOfFunctionPointer() {
+				callbacks[inst.Reference()] = true
+			}
+		}
+	}
+
+	for i, block := range blocks {
+		if sym := block.Block[0].Symbol(); i == 0 || funcs[sym] {
+			g.Functions = append(g.Functions, &Function{
+				Name:     sym,
+				Callback: callbacks[sym],
+				graph:    g,
+				start:    i,
+			})
+		}
+		g.function[i] = len(g.Functions) - 1
+
+		for _, succ := range block.Successors() {
+			j, found := g.index[succ]
+			if !found {
+				continue
+			}
+			g.successors[i] = append(g.successors[i], j)
+			g.predecessors[j] = append(g.predecessors[j], i)
+		}
+	}
+
+	for i, fn := range g.Functions {
+		end := len(blocks)
+		if i+1 < len(g.Functions) {
+			end = g.Functions[i+1].start
+		}
+		fn.Blocks = blocks[fn.start:end]
+	}
+
+	return g
+}
+
+// Successors returns the blocks which can be executed after the given block within the same function, see
+// `BasicBlock.Successors`.
+func (g *Graph) Successors(block *BasicBlock) []*BasicBlock {
+	i, found := g.index[block]
+	if !found {
+		return nil
+	}
+	return g.blocks(g.successors[i])
+}
+
+// Predecessors returns the blocks within the same function which can be executed before the given block.
+func (g *Graph) Predecessors(block *BasicBlock) []*BasicBlock {
+	i, found := g.index[block]
+	if !found {
+		return nil
+	}
+	return g.blocks(g.predecessors[i])
+}
+
+// Function returns the function which contains the given block, or nil if the block is not part of the graph.
+func (g *Graph) Function(block *BasicBlock) *Function {
+	i, found := g.index[block]
+	if !found {
+		return nil
+	}
+	return g.Functions[g.function[i]]
+}
+
+// Callee returns the bpf-to-bpf function called by the given block, or nil if the block doesn't end with a call of a
+// function of the program.
+func (g *Graph) Callee(block *BasicBlock) *Function {
+	if len(block.Block) == 0 {
+		return nil
+	}
+
+	last := block.Block[len(block.Block)-1]
+	if !last.IsFunctionCall() {
+		return nil
+	}
+	for _, fn := range g.Functions {
+		if fn.Name == last.Reference() {
+			return fn
+		}
+	}
+	return nil
+}
+
+func (g *Graph) blocks(positions []int) []*BasicBlock {
+	blocks := make([]*BasicBlock, 0, len(positions))
+	for _, i := range positions {
+		blocks = append(blocks, g.Blocks[i])
+	}
+	return blocks
+}
+
+// Entry returns the first block of the function.
+func (f *Function) Entry() *BasicBlock {
+	return f.Blocks[0]
+}
+
+// Exits returns the blocks which can leave the function, see `BasicBlock.LeavesFunction`.
+func (f *Function) Exits() []*BasicBlock {
+	var exits []*BasicBlock
+	for _, block := range f.Blocks {
+		if block.LeavesFunction() {
+			exits = append(exits, block)
+		}
+	}
+	return exits
+}
+
+// local returns the position of the block within the function.
+func (f *Function) local(block *BasicBlock) (int, bool) {
+	i, found := f.graph.index[block]
+	if !found || i < f.start || i >= f.start+len(f.Blocks) {
+		return 0, false
+	}
+	return i - f.start, true
+}
+
+// localSuccessors returns the successors of every block of the function within the function, by position within the
+// function.
+func (f *Function) localSuccessors() [][]int {
+	succs := make([][]int, len(f.Blocks))
+	for i := range f.Blocks {
+		for _, j := range f.graph.successors[f.start+i] {
+			if j >= f.start && j < f.start+len(f.Blocks) {
+				succs[i] = append(succs[i], j-f.start)
+			}
+		}
+	}
+	return succs
+}
+
+// predecessorsOf inverts the given successor lists.
+func predecessorsOf(succs [][]int) [][]int {
+	preds := make([][]int, len(succs))
+	for i, succ := range succs {
+		for _, j := range succ {
+			preds[j] = append(preds[j], i)
+		}
+	}
+	return preds
+}
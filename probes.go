@@ -0,0 +1,282 @@
+package coverbee
+
+import (
+	"sort"
+
+	"golang.org/x/exp/slices"
+)
+
+// DerivedCount is the count of a block without counter, see `InstrumentOptions.MinimalProbes`. The count is derived
+// from the counters of other blocks of the same function.
+type DerivedCount struct {
+	BlockID int
+	// The count of the block is the sum of the values of these counters times their factors.
+	Terms []CounterTerm
+}
+
+// CounterTerm is a counter with a factor, which is part of a `DerivedCount`.
+type CounterTerm struct {
+	Counter int
+	Factor  int
+}
+
+// derivedBlock is the count of a block without counter, in terms of the blocks of the same program which have one.
+type derivedBlock struct {
+	// The index of the block in the program.
+	block int
+	// Factors indexed by the index of the counted block in the program.
+	terms map[int]int
+}
+
+// outsideNode is the node of the flow graph of a function which represents everything outside the function. It has
+// an edge to the entry block and every exit leads to it, so the flow into the function equals the flow out of it.
+const outsideNode = -1
+
+// flowEdge is an edge of the flow graph of a function, between two blocks or a block and the `outsideNode`.
+type flowEdge struct {
+	from, to int
+}
+
+// minimalProbes places the probes of every function of the program with the given name in which all blocks are
+// instrumented, see `placeProbes`. It returns if each block needs a counter, and the derivation of the instrumented
+// blocks which don't. All instrumented blocks of other functions need a counter.
+func minimalProbes(
+	name string,
+	blocks []*BasicBlock,
+	subProgFuncs map[string]bool,
+	instrumented []bool,
+) ([]bool, []derivedBlock) {
+	var starts []int
+	for i, block := range blocks {
+		if sym := block.Block[0].Symbol(); i == 0 || subProgFuncs[sym] || sym == name {
+			starts = append(starts, i)
+		}
+	}
+	starts = append(starts, len(blocks))
+
+	counted := slices.Clone(instrumented)
+	var derived []derivedBlock
+	for i := 0; i+1 < len(starts); i++ {
+		start, end := starts[i], starts[i+1]
+		if slices.Contains(instrumented[start:end], false) {
+			continue
+		}
+
+		funcCounted, funcDerived, ok := placeProbes(blocks, start, end)
+		if !ok {
+			continue
+		}
+
+		copy(counted[start:end], funcCounted[start:end])
+		derived = append(derived, funcDerived...)
+	}
+
+	return counted, derived
+}
+
+// placeProbes picks the blocks of the function which consists of the blocks from `start` up to `end` which need a
+// counter, so the counts of the other blocks can be derived from them. It returns if each block needs a counter and
+// the derivation of the blocks which don't, indexed by block. False is returned if the counts can't be derived, in
+// which case all blocks need a counter.
+//
+// The execution count of every block is equal to the sum of the counts of the edges leading to it, and to the sum of
+// the counts of the edges leaving it. Given a spanning tree of the flow graph, the counts of the edges in the tree
+// follow from the counts of the edges which are not, so only those have to be counted. An edge is counted by the
+// block it leads to if the block has no other incoming edges, or by the block it leaves if the block has no other
+// outgoing edges. Edges which can't be counted this way are added to the spanning tree first.
+func placeProbes(blocks []*BasicBlock, start, end int) (counted []bool, derived []derivedBlock, ok bool) {
+	edges, ok := functionFlowEdges(blocks, start, end)
+	if !ok {
+		return nil, nil, false
+	}
+
+	inDegree := make(map[int]int)
+	outDegree := make(map[int]int)
+	for _, edge := range edges {
+		inDegree[edge.to]++
+		outDegree[edge.from]++
+	}
+
+	// Every block must be reachable, otherwise the CFG is incomplete.
+	for i := start; i < end; i++ {
+		if inDegree[i] == 0 {
+			return nil, nil, false
+		}
+	}
+
+	// probeBlock returns the block which counts the edge.
+	probeBlock := func(edge flowEdge) (int, bool) {
+		if edge.to != outsideNode && inDegree[edge.to] == 1 {
+			return edge.to, true
+		}
+		if edge.from != outsideNode && outDegree[edge.from] == 1 {
+			return edge.from, true
+		}
+		return 0, false
+	}
+
+	sort.SliceStable(edges, func(i, j int) bool {
+		_, iCountable := probeBlock(edges[i])
+		_, jCountable := probeBlock(edges[j])
+		return !iCountable && jCountable
+	})
+
+	// Kruskal's algorithm, with the outside node at index 0 and the blocks after it.
+	parent := make([]int, end-start+1)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(node int) int
+	find = func(node int) int {
+		if parent[node] != node {
+			parent[node] = find(parent[node])
+		}
+		return parent[node]
+	}
+	root := func(node int) int {
+		if node == outsideNode {
+			return find(0)
+		}
+		return find(node - start + 1)
+	}
+
+	counted = make([]bool, len(blocks))
+	counts := make(map[flowEdge]map[int]int, len(edges))
+	var tree []flowEdge
+	for _, edge := range edges {
+		from, to := root(edge.from), root(edge.to)
+		if from != to {
+			parent[from] = to
+			tree = append(tree, edge)
+			continue
+		}
+
+		block, countable := probeBlock(edge)
+		if !countable {
+			return nil, nil, false
+		}
+		counted[block] = true
+		counts[edge] = map[int]int{block: 1}
+	}
+
+	// Solve the edges of the tree from the leaves inwards. A node of which all but one edge have a known count gives
+	// the count of the remaining edge.
+	for len(tree) > 0 {
+		progress := false
+		for i, edge := range tree {
+			for _, node := range []int{edge.from, edge.to} {
+				count, solved := solveEdge(edges, counts, node, edge)
+				if !solved {
+					continue
+				}
+
+				counts[edge] = count
+				tree = append(tree[:i], tree[i+1:]...)
+				progress = true
+				break
+			}
+			if progress {
+				break
+			}
+		}
+		if !progress {
+			return nil, nil, false
+		}
+	}
+
+	for i := start; i < end; i++ {
+		if counted[i] {
+			continue
+		}
+
+		terms := make(map[int]int)
+		for _, edge := range edges {
+			if edge.to == i {
+				addTerms(terms, counts[edge], 1)
+			}
+		}
+		derived = append(derived, derivedBlock{block: i, terms: terms})
+	}
+
+	return counted, derived, true
+}
+
+// solveEdge returns the count of the edge from the flow through the given node, if the counts of all other edges of
+// the node are known.
+func solveEdge(edges []flowEdge, counts map[flowEdge]map[int]int, node int, unknown flowEdge) (map[int]int, bool) {
+	// The flow into the node minus the flow out of it is 0, so the unknown edge is the sum of the other edges with
+	// the sign of the side opposite of it.
+	sign := 1
+	if unknown.to == node {
+		sign = -1
+	}
+
+	count := make(map[int]int)
+	for _, edge := range edges {
+		if edge == unknown || (edge.from != node && edge.to != node) {
+			continue
+		}
+
+		known, found := counts[edge]
+		if !found {
+			return nil, false
+		}
+
+		// A loop from the node to itself is both flow into and out of the node, so it doesn't matter.
+		if edge.to == node {
+			addTerms(count, known, sign)
+		}
+		if edge.from == node {
+			addTerms(count, known, -sign)
+		}
+	}
+
+	return count, true
+}
+
+// addTerms adds the terms of `b` times the factor to `a`, dropping terms which cancel out.
+func addTerms(a, b map[int]int, factor int) {
+	for block, f := range b {
+		a[block] += f * factor
+		if a[block] == 0 {
+			delete(a, block)
+		}
+	}
+}
+
+// functionFlowEdges returns the edges of the flow graph of the function which consists of the blocks from `start` up
+// to `end`. False is returned if a block leads to a block outside the function.
+func functionFlowEdges(blocks []*BasicBlock, start, end int) ([]flowEdge, bool) {
+	index := make(map[*BasicBlock]int, end-start)
+	for i := start; i < end; i++ {
+		index[blocks[i]] = i
+	}
+
+	var edges []flowEdge
+	seen := make(map[flowEdge]bool)
+	addEdge := func(from, to int) {
+		edge := flowEdge{from: from, to: to}
+		if !seen[edge] {
+			seen[edge] = true
+			edges = append(edges, edge)
+		}
+	}
+
+	addEdge(outsideNode, start)
+	for i := start; i < end; i++ {
+		// Exits and tail calls which succeed lead outside of the function.
+		if blocks[i].LeavesFunction() {
+			addEdge(i, outsideNode)
+		}
+
+		for _, successor := range blocks[i].Successors() {
+			j, found := index[successor]
+			if !found {
+				return nil, false
+			}
+			addEdge(i, j)
+		}
+	}
+
+	return edges, true
+}
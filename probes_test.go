@@ -0,0 +1,87 @@
+package coverbee
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/cilium/ebpf/asm"
+)
+
+func TestPlaceProbes(t *testing.T) {
+	jump := func(op asm.JumpOp, dst asm.Register, imm int64, off int16) asm.Instruction {
+		return asm.Instruction{
+			OpCode:   asm.OpCode(asm.JumpClass).SetJumpOp(op).SetSource(asm.ImmSource),
+			Dst:      dst,
+			Offset:   off,
+			Constant: imm,
+		}
+	}
+
+	// A diamond, of which one side does a tail call, followed by a loop.
+	insns := asm.Instructions{
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("prog"),
+		jump(asm.JEq, asm.R1, 0, 2),
+		asm.FnTailCall.Call(),
+		jump(asm.Ja, asm.R0, 0, 1),
+		asm.Mov.Imm(asm.R0, 2),
+		asm.Add.Imm(asm.R2, 1),
+		jump(asm.JGT, asm.R2, 5, 2),
+		asm.Add.Imm(asm.R1, 1),
+		jump(asm.Ja, asm.R0, 0, -4),
+		asm.Return(),
+	}
+	blocks := ProgramBlocks(insns)
+	if len(blocks) != 7 {
+		t.Fatalf("expected 7 blocks, got %d", len(blocks))
+	}
+
+	counted, derived, ok := placeProbes(blocks, 0, len(blocks))
+	if !ok {
+		t.Fatal("counts can't be derived")
+	}
+	numCounted := 0
+	for _, c := range counted {
+		if c {
+			numCounted++
+		}
+	}
+	if len(derived) == 0 || numCounted+len(derived) != len(blocks) {
+		t.Fatalf("%d blocks are counted and %d derived, of %d blocks", numCounted, len(derived), len(blocks))
+	}
+
+	// Execute random paths through the CFG and count the executions of every block.
+	edges, _ := functionFlowEdges(blocks, 0, len(blocks))
+	rng := rand.New(rand.NewSource(1))
+	executions := make([]int, len(blocks))
+	for run := 0; run < 100; run++ {
+		node := 0
+		for node != outsideNode {
+			executions[node]++
+
+			var successors []int
+			for _, edge := range edges {
+				if edge.from == node {
+					successors = append(successors, edge.to)
+				}
+			}
+			node = successors[rng.Intn(len(successors))]
+		}
+	}
+
+	for _, d := range derived {
+		if counted[d.block] {
+			t.Errorf("block %d is counted and derived", d.block)
+		}
+
+		count := 0
+		for block, factor := range d.terms {
+			if !counted[block] {
+				t.Errorf("derived count of block %d uses block %d which isn't counted", d.block, block)
+			}
+			count += factor * executions[block]
+		}
+		if count != executions[d.block] {
+			t.Errorf("derived count of block %d is %d, but it ran %d times", d.block, count, executions[d.block])
+		}
+	}
+}
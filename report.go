@@ -0,0 +1,566 @@
+package coverbee
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/tools/cover"
+)
+
+// ReportFormat is the format of a coverage report written by `Report.Write`.
+type ReportFormat string
+
+const (
+	// ReportHTML is a HTML page which shows the coverage of the source code, see `Report.WriteHTML`.
+	ReportHTML ReportFormat = "html"
+	// ReportGoCover is a go-cover profile which can be interpreted by `go tool cover`, see `Report.WriteGoCover`.
+	ReportGoCover ReportFormat = "go-cover"
+	// ReportBranches lists how often each branch was taken and not taken, see `Report.WriteBranches`.
+	ReportBranches ReportFormat = "branches"
+	// ReportFunctions lists how often each function was called, see `Report.WriteFunctions`.
+	ReportFunctions ReportFormat = "functions"
+	// ReportSummary lists the covered statements of each file and the totals, see `Report.WriteSummary`.
+	ReportSummary ReportFormat = "summary"
+)
+
+func (f ReportFormat) validate() error {
+	switch f {
+	case ReportHTML, ReportGoCover, ReportBranches, ReportFunctions, ReportSummary:
+		return nil
+	default:
+		return fmt.Errorf("invalid report format '%s', pick from html, go-cover, branches, functions or summary", f)
+	}
+}
+
+// WriteReport writes the coverage of the block-list in the given format, see `Report.Write`. The counts have to be
+// applied before, for example with `BlockList.ApplyCoverMap`. The blocks are reported as they are, use
+// `SourceCodeInterpolation` on the blocks first to report the coverage of the source lines in between.
+func (bl *BlockList) WriteReport(format ReportFormat, w io.Writer) error {
+	return NewReport(bl).Write(format, w)
+}
+
+// Report is the coverage of a block-list by source file, function and line. All output formats are rendered from it.
+type Report struct {
+	// The files of the blocks, sorted by name.
+	Files []FileReport
+	// The functions of the block-list, sorted by program and name.
+	Functions []FunctionReport
+	// The branches of the block-list, sorted by source location.
+	Branches []BranchCoverage
+
+	// The blocks of all files in the order of the block-list.
+	blocks []CoverBlock
+	// The functions of each file with line info by start line, sorted by line.
+	functionStarts map[string][]functionStart
+}
+
+// functionStart is the line at which one or more functions of a file start.
+type functionStart struct {
+	line int
+	// Indices into `Report.Functions`, more than one if programs share a function.
+	functions []int
+}
+
+// FileReport is the coverage of a single source file.
+type FileReport struct {
+	Name string
+	// The blocks of the file in the order of the block-list. Blocks made from the instructions of a program can share
+	// a position, if multiple instructions have the same line info.
+	Blocks []CoverBlock
+	// The lines of the file which are part of a block, in order.
+	Lines []LineCoverage
+	// The statements, functions and branches of the file.
+	Summary Summary
+}
+
+// LineCoverage is the coverage of a single source line.
+type LineCoverage struct {
+	Line int
+	// The highest count of the blocks which include the line.
+	Count int
+}
+
+// FunctionReport is the coverage of a program or bpf-to-bpf function. The lines of a function are the lines from its
+// BTF func info up to the first line of the next function in the same file, so the lines of inlined functions without
+// func info count towards the function before them.
+type FunctionReport struct {
+	FunctionCoverage
+	// The statements and branches of the lines of the function.
+	Summary Summary
+}
+
+// Summary counts the covered and total statements, functions and branches of a report or a part of it. Blocks at the
+// same position are counted once, like `go tool cover` does.
+type Summary struct {
+	Statements        int
+	CoveredStatements int
+	Functions         int
+	CalledFunctions   int
+	// A branch is covered if the jump was both taken and not taken.
+	Branches        int
+	CoveredBranches int
+}
+
+// Percent returns the percentage of covered statements, or 0 if there are no statements.
+func (s Summary) Percent() float64 {
+	if s.Statements == 0 {
+		return 0
+	}
+
+	return float64(s.CoveredStatements) / float64(s.Statements) * 100
+}
+
+// NewReport builds a report of the blocks, functions and branches of the block-list. The blocks may have been
+// replaced by those returned by `SourceCodeInterpolation`.
+func NewReport(bl *BlockList) *Report {
+	var blocks []CoverBlock
+	for _, lines := range bl.Blocks {
+		blocks = append(blocks, lines...)
+	}
+
+	return newReport(blocks, bl.Functions, bl.Branches)
+}
+
+func newReport(blocks []CoverBlock, functions []FunctionCoverage, branches []BranchCoverage) *Report {
+	r := Report{blocks: blocks}
+
+	fileIndex := make(map[string]int)
+	for _, block := range blocks {
+		i, found := fileIndex[block.Filename]
+		if !found {
+			i = len(r.Files)
+			fileIndex[block.Filename] = i
+			r.Files = append(r.Files, FileReport{Name: block.Filename})
+		}
+		r.Files[i].Blocks = append(r.Files[i].Blocks, block)
+	}
+	sort.SliceStable(r.Files, func(i, j int) bool {
+		return r.Files[i].Name < r.Files[j].Name
+	})
+
+	for _, fn := range functions {
+		r.Functions = append(r.Functions, FunctionReport{FunctionCoverage: fn})
+	}
+	sort.SliceStable(r.Functions, func(i, j int) bool {
+		if r.Functions[i].Program != r.Functions[j].Program {
+			return r.Functions[i].Program < r.Functions[j].Program
+		}
+		return r.Functions[i].Name < r.Functions[j].Name
+	})
+
+	r.Branches = slices.Clone(branches)
+	sort.SliceStable(r.Branches, func(i, j int) bool {
+		if r.Branches[i].Filename != r.Branches[j].Filename {
+			return r.Branches[i].Filename < r.Branches[j].Filename
+		}
+		return r.Branches[i].Line < r.Branches[j].Line
+	})
+
+	startLines := make(map[string]map[int][]int)
+	for i, fn := range r.Functions {
+		if fn.Filename == "" {
+			continue
+		}
+		if startLines[fn.Filename] == nil {
+			startLines[fn.Filename] = make(map[int][]int)
+		}
+		startLines[fn.Filename][fn.Line] = append(startLines[fn.Filename][fn.Line], i)
+	}
+	r.functionStarts = make(map[string][]functionStart, len(startLines))
+	for fileName, lines := range startLines {
+		starts := make([]functionStart, 0, len(lines))
+		for line, functions := range lines {
+			starts = append(starts, functionStart{line: line, functions: functions})
+		}
+		sort.Slice(starts, func(i, j int) bool {
+			return starts[i].line < starts[j].line
+		})
+		r.functionStarts[fileName] = starts
+	}
+
+	for i := range r.Files {
+		r.Files[i].Lines = lineCoverage(r.Files[i].Blocks)
+	}
+	r.summarize()
+
+	return &r
+}
+
+// blockPosition is the position of a block in its file.
+type blockPosition struct {
+	fileName            string
+	startLine, startCol int
+	endLine, endCol     int
+}
+
+func positionOf(block CoverBlock) blockPosition {
+	return blockPosition{
+		fileName:  block.Filename,
+		startLine: block.ProfileBlock.StartLine,
+		startCol:  block.ProfileBlock.StartCol,
+		endLine:   block.ProfileBlock.EndLine,
+		endCol:    block.ProfileBlock.EndCol,
+	}
+}
+
+// lineCoverage returns the coverage of every line which is part of a block.
+func lineCoverage(blocks []CoverBlock) []LineCoverage {
+	counts := make(map[int]int)
+	for _, block := range blocks {
+		for line := block.ProfileBlock.StartLine; line <= block.ProfileBlock.EndLine; line++ {
+			if count, found := counts[line]; !found || block.ProfileBlock.Count > count {
+				counts[line] = block.ProfileBlock.Count
+			}
+		}
+	}
+
+	lines := make([]LineCoverage, 0, len(counts))
+	for line, count := range counts {
+		lines = append(lines, LineCoverage{Line: line, Count: count})
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].Line < lines[j].Line
+	})
+
+	return lines
+}
+
+// functionStartAt returns the index into the function starts of the file of the last start at or before the given
+// line, which is the start of the functions containing the line, or -1 if the line is before the first function.
+func (r *Report) functionStartAt(fileName string, line int) int {
+	starts := r.functionStarts[fileName]
+	return sort.Search(len(starts), func(i int) bool {
+		return starts[i].line > line
+	}) - 1
+}
+
+// functionsAt returns the functions which contain the given line, more than one if programs share a function.
+func (r *Report) functionsAt(fileName string, line int) []FunctionCoverage {
+	i := r.functionStartAt(fileName, line)
+	if i < 0 {
+		return nil
+	}
+
+	var functions []FunctionCoverage
+	for _, fn := range r.functionStarts[fileName][i].functions {
+		functions = append(functions, r.Functions[fn].FunctionCoverage)
+	}
+
+	return functions
+}
+
+// summarize sets the summaries of the files and functions. Every statement and branch is added to the summary of its
+// file and to the summary of the functions which contain it.
+func (r *Report) summarize() {
+	fileSummaries := make(map[string]*Summary, len(r.Files))
+	for i := range r.Files {
+		fileSummaries[r.Files[i].Name] = &r.Files[i].Summary
+	}
+	// The summaries of the functions which start at the same line are the same, indexed like the function starts.
+	startSummaries := make(map[string][]Summary, len(r.functionStarts))
+	for fileName, starts := range r.functionStarts {
+		startSummaries[fileName] = make([]Summary, len(starts))
+	}
+
+	add := func(fileName string, line int, update func(s *Summary)) {
+		if s := fileSummaries[fileName]; s != nil {
+			update(s)
+		}
+		if i := r.functionStartAt(fileName, line); i >= 0 {
+			update(&startSummaries[fileName][i])
+		}
+	}
+
+	for _, file := range r.Files {
+		covered := make(map[blockPosition]bool)
+		numStmt := make(map[blockPosition]int)
+		for _, block := range file.Blocks {
+			pos := positionOf(block)
+			if _, found := numStmt[pos]; !found {
+				numStmt[pos] = block.ProfileBlock.NumStmt
+			}
+			covered[pos] = covered[pos] || block.ProfileBlock.Count > 0
+		}
+
+		for pos, n := range numStmt {
+			add(file.Name, pos.startLine, func(s *Summary) {
+				s.Statements += n
+				if covered[pos] {
+					s.CoveredStatements += n
+				}
+			})
+		}
+	}
+
+	for _, branch := range r.Branches {
+		add(branch.Filename, branch.Line, func(s *Summary) {
+			s.Branches++
+			if branch.Taken > 0 && branch.NotTaken > 0 {
+				s.CoveredBranches++
+			}
+		})
+	}
+
+	for fileName, starts := range r.functionStarts {
+		for j, start := range starts {
+			for _, i := range start.functions {
+				r.Functions[i].Summary = startSummaries[fileName][j]
+			}
+		}
+	}
+
+	for i := range r.Functions {
+		fn := &r.Functions[i]
+		if s := fileSummaries[fn.Filename]; s != nil {
+			s.Functions++
+			if fn.Calls > 0 {
+				s.CalledFunctions++
+			}
+		}
+
+		// Programs which share a function have their own copy of it, which starts at the same line.
+		fn.Summary.Functions = 1
+		if fn.Calls > 0 {
+			fn.Summary.CalledFunctions = 1
+		}
+	}
+}
+
+// Summary returns the totals of the whole report.
+func (r *Report) Summary() Summary {
+	var s Summary
+	for _, file := range r.Files {
+		s.Statements += file.Summary.Statements
+		s.CoveredStatements += file.Summary.CoveredStatements
+	}
+
+	s.Functions = len(r.Functions)
+	for _, fn := range r.Functions {
+		if fn.Calls > 0 {
+			s.CalledFunctions++
+		}
+	}
+
+	s.Branches = len(r.Branches)
+	for _, branch := range r.Branches {
+		if branch.Taken > 0 && branch.NotTaken > 0 {
+			s.CoveredBranches++
+		}
+	}
+
+	return s
+}
+
+// Filter returns a report of the parts selected by the filter. Functions are selected by program, name and file.
+// Blocks and branches are selected by file and by the functions which contain their line, blocks outside of all
+// functions only match if no programs or functions are included.
+func (r *Report) Filter(f Filter) (*Report, error) {
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+
+	selected := func(fn FunctionCoverage) bool {
+		return f.program(fn.Program) && f.function(fn.Name) && f.file(fn.Filename)
+	}
+	selectedLine := func(fileName string, line int) bool {
+		if !f.file(fileName) {
+			return false
+		}
+
+		functions := r.functionsAt(fileName, line)
+		if len(functions) == 0 {
+			return len(f.IncludePrograms) == 0 && len(f.IncludeFunctions) == 0
+		}
+		return slices.ContainsFunc(functions, selected)
+	}
+
+	var blocks []CoverBlock
+	for _, block := range r.blocks {
+		if selectedLine(block.Filename, block.ProfileBlock.StartLine) {
+			blocks = append(blocks, block)
+		}
+	}
+
+	var functions []FunctionCoverage
+	for _, fn := range r.Functions {
+		if selected(fn.FunctionCoverage) {
+			functions = append(functions, fn.FunctionCoverage)
+		}
+	}
+
+	var branches []BranchCoverage
+	for _, branch := range r.Branches {
+		if selectedLine(branch.Filename, branch.Line) {
+			branches = append(branches, branch)
+		}
+	}
+
+	return newReport(blocks, functions, branches), nil
+}
+
+// Merge adds the counts of `other` to this report. Blocks at the same position, functions with the same program and
+// name and branches at the same line are matched in order, so the reports of different loads of the same programs
+// add up. Everything else of `other` is added to the report.
+func (r *Report) Merge(other *Report) {
+	blocks := slices.Clone(r.blocks)
+	blockIndex := make(map[blockPosition][]int)
+	for i, block := range blocks {
+		pos := positionOf(block)
+		blockIndex[pos] = append(blockIndex[pos], i)
+	}
+	matchedBlocks := make(map[blockPosition]int)
+	for _, block := range other.blocks {
+		pos := positionOf(block)
+		if n := matchedBlocks[pos]; n < len(blockIndex[pos]) {
+			count := &blocks[blockIndex[pos][n]].ProfileBlock.Count
+			*count = addCounts(*count, block.ProfileBlock.Count)
+			matchedBlocks[pos]++
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+
+	type functionKey struct{ program, name string }
+	var functions []FunctionCoverage
+	functionIndex := make(map[functionKey]int)
+	for _, fn := range r.Functions {
+		functionIndex[functionKey{fn.Program, fn.Name}] = len(functions)
+		functions = append(functions, fn.FunctionCoverage)
+	}
+	for _, fn := range other.Functions {
+		if i, found := functionIndex[functionKey{fn.Program, fn.Name}]; found {
+			functions[i].Calls = addCounts(functions[i].Calls, fn.Calls)
+			continue
+		}
+		functions = append(functions, fn.FunctionCoverage)
+	}
+
+	type branchKey struct {
+		fileName string
+		line     int
+	}
+	branches := slices.Clone(r.Branches)
+	branchIndex := make(map[branchKey][]int)
+	for i, branch := range branches {
+		key := branchKey{branch.Filename, branch.Line}
+		branchIndex[key] = append(branchIndex[key], i)
+	}
+	matched := make(map[branchKey]int)
+	for _, branch := range other.Branches {
+		key := branchKey{branch.Filename, branch.Line}
+		if n := matched[key]; n < len(branchIndex[key]) {
+			merged := &branches[branchIndex[key][n]]
+			merged.Taken = addCounts(merged.Taken, branch.Taken)
+			merged.NotTaken = addCounts(merged.NotTaken, branch.NotTaken)
+			matched[key]++
+			continue
+		}
+		branches = append(branches, branch)
+	}
+
+	*r = *newReport(blocks, functions, branches)
+}
+
+// Write writes the report in the given format. The branches and functions formats need a block-list with branches or
+// functions.
+func (r *Report) Write(format ReportFormat, w io.Writer) error {
+	if err := format.validate(); err != nil {
+		return err
+	}
+
+	switch format {
+	case ReportHTML:
+		if err := r.WriteHTML(w, "count"); err != nil {
+			return fmt.Errorf("block list to HTML: %w", err)
+		}
+	case ReportGoCover:
+		r.WriteGoCover(w, "count")
+	case ReportBranches:
+		if len(r.Branches) == 0 {
+			return fmt.Errorf("block-list contains no branches, instrument with branch coverage")
+		}
+		r.WriteBranches(w)
+	case ReportFunctions:
+		if len(r.Functions) == 0 {
+			return fmt.Errorf("block-list contains no functions, instrument the entry blocks of functions")
+		}
+		r.WriteFunctions(w)
+	case ReportSummary:
+		r.WriteSummary(w)
+	}
+
+	return nil
+}
+
+// WriteGoCover writes the blocks in the order of the block-list as a go-cover file which can be interpreted by
+// `go tool cover`. `mode` value can be `set` or `count`, see `go tool cover -h` for details.
+func (r *Report) WriteGoCover(out io.Writer, mode string) {
+	fmt.Fprintln(out, "mode:", mode)
+	for _, block := range r.blocks {
+		fmt.Fprintln(out, block)
+	}
+}
+
+// WriteHTML writes a HTML coverage report, lines containing a conditional jump are annotated with the number of times
+// the jump was taken and not taken as `[taken/not taken]`.
+func (r *Report) WriteHTML(out io.Writer, mode string) error {
+	var buf bytes.Buffer
+	r.WriteGoCover(&buf, mode)
+	profiles, err := cover.ParseProfilesFromReader(&buf)
+	if err != nil {
+		return err
+	}
+
+	if err = htmlOutput(profiles, r.Branches, out); err != nil {
+		return fmt.Errorf("write html: %w", err)
+	}
+
+	return nil
+}
+
+// WriteBranches writes a line for every branch, sorted by source location, containing the number of times the branch
+// was taken and not taken.
+func (r *Report) WriteBranches(out io.Writer) {
+	for _, branch := range r.Branches {
+		fmt.Fprintf(out, "%s:%d taken %d not-taken %d\n", branch.Filename, branch.Line, branch.Taken, branch.NotTaken)
+	}
+}
+
+// WriteFunctions writes a line for every function, sorted by program and function name, telling if the function was
+// called and how often.
+func (r *Report) WriteFunctions(out io.Writer) {
+	for _, fn := range r.Functions {
+		location := ""
+		if fn.Filename != "" {
+			location = fmt.Sprintf(" (%s:%d)", fn.Filename, fn.Line)
+		}
+
+		if fn.Calls == 0 {
+			fmt.Fprintf(out, "%s %s%s not called\n", fn.Program, fn.Name, location)
+			continue
+		}
+		fmt.Fprintf(out, "%s %s%s called %d\n", fn.Program, fn.Name, location, fn.Calls)
+	}
+}
+
+// WriteSummary writes a line with the covered statements of every file, followed by the totals of the report.
+func (r *Report) WriteSummary(out io.Writer) {
+	for _, file := range r.Files {
+		fmt.Fprintf(out, "%s %d/%d statements (%.1f%%)\n",
+			file.Name, file.Summary.CoveredStatements, file.Summary.Statements, file.Summary.Percent(),
+		)
+	}
+
+	total := r.Summary()
+	fmt.Fprintf(out, "total %d/%d statements (%.1f%%)", total.CoveredStatements, total.Statements, total.Percent())
+	if total.Functions > 0 {
+		fmt.Fprintf(out, ", %d/%d functions called", total.CalledFunctions, total.Functions)
+	}
+	if total.Branches > 0 {
+		fmt.Fprintf(out, ", %d/%d branches covered", total.CoveredBranches, total.Branches)
+	}
+	fmt.Fprintln(out)
+}
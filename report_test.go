@@ -0,0 +1,248 @@
+package coverbee
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"golang.org/x/tools/cover"
+)
+
+// testBlock returns a block of a single statement on the given line.
+func testBlock(fileName string, line, count int) CoverBlock {
+	return CoverBlock{
+		Filename: fileName,
+		ProfileBlock: cover.ProfileBlock{
+			StartLine: line,
+			StartCol:  2,
+			EndLine:   line,
+			EndCol:    2000,
+			NumStmt:   1,
+			Count:     count,
+		},
+	}
+}
+
+// testBlockList returns a block-list of two programs which share the function `helper`.
+func testBlockList() *BlockList {
+	return &BlockList{
+		Blocks: [][]CoverBlock{
+			{testBlock("/src/prog.c", 10, 2), testBlock("/src/prog.c", 11, 2)},
+			{testBlock("/src/prog.c", 12, 0)},
+			{testBlock("/src/helper.h", 3, 2), testBlock("/src/helper.h", 3, 2)},
+			{testBlock("/src/prog.c", 20, 0)},
+			{testBlock("/src/helper.h", 3, 0)},
+			{testBlock("/src/helper.h", 4, 0)},
+		},
+		Functions: []FunctionCoverage{
+			{Program: "xdp_prog", Name: "xdp_prog", BlockID: 0, Filename: "/src/prog.c", Line: 10, Calls: 2},
+			{Program: "xdp_prog", Name: "helper", BlockID: 2, Filename: "/src/helper.h", Line: 2, Calls: 2},
+			{Program: "tc_prog", Name: "tc_prog", BlockID: 3, Filename: "/src/prog.c", Line: 20},
+			{Program: "tc_prog", Name: "helper", BlockID: 4, Filename: "/src/helper.h", Line: 2},
+		},
+		Branches: []BranchCoverage{
+			{BlockID: 0, Filename: "/src/prog.c", Line: 11, Taken: 2},
+			{BlockID: 4, Filename: "/src/helper.h", Line: 3, Taken: 1, NotTaken: 1},
+		},
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	report := NewReport(testBlockList())
+
+	var files []string
+	for _, file := range report.Files {
+		files = append(files, file.Name)
+	}
+	if want := []string{"/src/helper.h", "/src/prog.c"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("files %v, want %v", files, want)
+	}
+
+	wantLines := []LineCoverage{{Line: 3, Count: 2}, {Line: 4, Count: 0}}
+	if got := report.Files[0].Lines; !reflect.DeepEqual(got, wantLines) {
+		t.Errorf("lines %v, want %v", got, wantLines)
+	}
+
+	wantFile := Summary{
+		Statements: 2, CoveredStatements: 1, Functions: 2, CalledFunctions: 1, Branches: 1, CoveredBranches: 1,
+	}
+	if got := report.Files[0].Summary; got != wantFile {
+		t.Errorf("helper.h summary %+v, want %+v", got, wantFile)
+	}
+
+	wantFunctions := map[string]Summary{
+		"tc_prog tc_prog":   {Statements: 1, Functions: 1},
+		"tc_prog helper":    {Statements: 2, CoveredStatements: 1, Functions: 1, Branches: 1, CoveredBranches: 1},
+		"xdp_prog xdp_prog": {Statements: 3, CoveredStatements: 2, Functions: 1, CalledFunctions: 1, Branches: 1},
+		"xdp_prog helper": {
+			Statements: 2, CoveredStatements: 1, Functions: 1, CalledFunctions: 1, Branches: 1, CoveredBranches: 1,
+		},
+	}
+	for _, fn := range report.Functions {
+		if got, want := fn.Summary, wantFunctions[fn.Program+" "+fn.Name]; got != want {
+			t.Errorf("%s %s summary %+v, want %+v", fn.Program, fn.Name, got, want)
+		}
+	}
+
+	wantTotal := Summary{
+		Statements: 6, CoveredStatements: 3, Functions: 4, CalledFunctions: 2, Branches: 2, CoveredBranches: 1,
+	}
+	if got := report.Summary(); got != wantTotal {
+		t.Errorf("total summary %+v, want %+v", got, wantTotal)
+	}
+}
+
+func TestReportFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		filter     Filter
+		statements int
+		functions  int
+		branches   int
+	}{
+		{
+			name:       "Everything",
+			statements: 6,
+			functions:  4,
+			branches:   2,
+		},
+		{
+			name:       "Program",
+			filter:     Filter{IncludePrograms: []string{"tc_prog"}},
+			statements: 3,
+			functions:  2,
+			branches:   1,
+		},
+		{
+			name:       "Exclude function",
+			filter:     Filter{ExcludeFunctions: []string{"helper"}},
+			statements: 4,
+			functions:  2,
+			branches:   1,
+		},
+		{
+			name:       "Headers",
+			filter:     Filter{IncludeFiles: []string{"*.h"}},
+			statements: 2,
+			functions:  2,
+			branches:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, err := NewReport(testBlockList()).Filter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			summary := filtered.Summary()
+			if summary.Statements != tt.statements || summary.Functions != tt.functions ||
+				summary.Branches != tt.branches {
+				t.Fatalf("%d statements, %d functions and %d branches, want %d, %d and %d",
+					summary.Statements, summary.Functions, summary.Branches, tt.statements, tt.functions, tt.branches,
+				)
+			}
+		})
+	}
+
+	if _, err := NewReport(testBlockList()).Filter(Filter{IncludeFiles: []string{"["}}); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestReportMerge(t *testing.T) {
+	other := testBlockList()
+	other.Blocks = append(other.Blocks, []CoverBlock{testBlock("/src/other.c", 1, 1)})
+	other.Blocks[1][0].ProfileBlock.Count = 1
+	other.Functions[2].Calls = 1
+	other.Branches[0].NotTaken = 3
+
+	report := NewReport(testBlockList())
+	report.Merge(NewReport(other))
+
+	if len(report.Files) != 3 || report.Files[1].Name != "/src/other.c" {
+		t.Fatalf("files %+v, want other.c to be added", report.Files)
+	}
+
+	wantLines := []LineCoverage{{Line: 10, Count: 4}, {Line: 11, Count: 4}, {Line: 12, Count: 1}, {Line: 20, Count: 0}}
+	if got := report.Files[2].Lines; !reflect.DeepEqual(got, wantLines) {
+		t.Errorf("lines of prog.c %v, want %v", got, wantLines)
+	}
+
+	var calls []int
+	for _, fn := range report.Functions {
+		calls = append(calls, fn.Calls)
+	}
+	if want := []int{0, 1, 4, 4}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %v, want %v", calls, want)
+	}
+
+	if got := report.Branches[1]; got.Taken != 4 || got.NotTaken != 3 {
+		t.Errorf("branch of prog.c taken %d and not taken %d times, want 4 and 3", got.Taken, got.NotTaken)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    ReportFormat
+		blockList *BlockList
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "Go cover",
+			format:    ReportGoCover,
+			blockList: &BlockList{},
+			want:      "mode: count\n",
+		},
+		{
+			name:   "Go cover in block-list order",
+			format: ReportGoCover,
+			blockList: &BlockList{
+				Blocks: [][]CoverBlock{{testBlock("/src/prog.c", 10, 2)}, {testBlock("/src/helper.h", 3, 1)}},
+			},
+			want: "mode: count\n/src/prog.c:10.2,10.2000 1 2\n/src/helper.h:3.2,3.2000 1 1\n",
+		},
+		{
+			name:   "Functions",
+			format: ReportFunctions,
+			blockList: &BlockList{
+				Functions: []FunctionCoverage{{Program: "prog", Name: "prog", Calls: 2}},
+			},
+			want: "prog prog called 2\n",
+		},
+		{
+			name:      "Summary",
+			format:    ReportSummary,
+			blockList: testBlockList(),
+			want: "/src/helper.h 1/2 statements (50.0%)\n" +
+				"/src/prog.c 2/4 statements (50.0%)\n" +
+				"total 3/6 statements (50.0%), 2/4 functions called, 1/2 branches covered\n",
+		},
+		{
+			name:      "No branches",
+			format:    ReportBranches,
+			blockList: &BlockList{},
+			wantErr:   true,
+		},
+		{
+			name:      "Invalid format",
+			format:    "pdf",
+			blockList: &BlockList{},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := tt.blockList.WriteReport(tt.format, &buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WriteReport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Fatalf("WriteReport() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package coverbee
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cilium/ebpf"
+)
+
+// Session is an instrumented and loaded collection together with the block-list of its cover-map. It takes care of
+// reading and resetting the cover-map, so the coverage of parts of a test, like the cases of a table-driven test, can
+// be collected separately:
+//
+//	before, err := session.Snapshot()
+//	// Run the programs of the test case.
+//	covered, err := session.Delta(before)
+type Session struct {
+	// The instrumented collection, closed by `Session.Close`.
+	Collection *ebpf.Collection
+	// The instrumentation of the collection.
+	Instrumentation *Instrumentation
+
+	coverMap *ebpf.Map
+}
+
+// NewSession instruments and loads a copy of the collection as `InstrumentAndLoadCollectionWithOptions` does, and
+// returns a session which owns the loaded collection. The spec itself is left as it is.
+func NewSession(spec *ebpf.CollectionSpec, opts ebpf.CollectionOptions, instOpts InstrumentOptions) (*Session, error) {
+	coll, instrumentation, err := InstrumentAndLoadCollectionWithOptions(spec.Copy(), opts, instOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	coverMap := coll.Maps[instrumentation.CoverMapName]
+	if coverMap == nil {
+		coll.Close()
+		return nil, fmt.Errorf("collection has no cover-map '%s'", instrumentation.CoverMapName)
+	}
+
+	return &Session{
+		Collection:      coll,
+		Instrumentation: instrumentation,
+		coverMap:        coverMap,
+	}, nil
+}
+
+// Close closes the collection of the session, including the cover-map.
+func (s *Session) Close() {
+	s.Collection.Close()
+}
+
+// Snapshot is the coverage of a session at a point in time, or the difference between two points in time as returned
+// by `Session.Delta`.
+type Snapshot struct {
+	// The block-list of the session, with the counts of the blocks, functions and branches applied.
+	BlockList *BlockList
+
+	// The counters of every CPU, see `readCounters`.
+	cpuCounters [][]uint64
+}
+
+// Report returns the coverage of the snapshot by file, function and line.
+func (s *Snapshot) Report() *Report {
+	return NewReport(s.BlockList)
+}
+
+// WriteReport writes the coverage of the snapshot in the given format, see `BlockList.WriteReport`.
+func (s *Snapshot) WriteReport(format ReportFormat, w io.Writer) error {
+	return s.BlockList.WriteReport(format, w)
+}
+
+// Snapshot reads the counters from the cover-map and returns the coverage up to now.
+func (s *Session) Snapshot() (*Snapshot, error) {
+	blockList := s.Instrumentation.BlockList()
+	cpuCounters, err := readCounters(s.coverMap, blockList.Layout.withDefaults(), blockList.numCounters())
+	if err != nil {
+		return nil, err
+	}
+
+	return s.snapshot(cpuCounters)
+}
+
+// Reset sets all counters of the cover-map to 0. With `InstrumentOptions.SharedCoverMap` this also resets the
+// counters of the other collections which share the cover-map.
+func (s *Session) Reset() error {
+	return zeroCounters(s.coverMap)
+}
+
+// Delta returns the coverage since the given snapshot was taken, which must have been taken after the last reset of
+// the session. Counters which wrapped around once since the snapshot are accounted for.
+func (s *Session) Delta(since *Snapshot) (*Snapshot, error) {
+	now, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(since.cpuCounters) != len(now.cpuCounters) || len(since.cpuCounters[0]) != len(now.cpuCounters[0]) {
+		return nil, fmt.Errorf(
+			"snapshot has %d counters for %d CPUs but the session has %d for %d CPUs",
+			len(since.cpuCounters[0]), len(since.cpuCounters), len(now.cpuCounters[0]), len(now.cpuCounters),
+		)
+	}
+
+	layout := now.BlockList.Layout.withDefaults()
+	cpuCounters := make([][]uint64, len(now.cpuCounters))
+	for cpu := range cpuCounters {
+		cpuCounters[cpu] = make([]uint64, len(now.cpuCounters[cpu]))
+		for i := range cpuCounters[cpu] {
+			cpuCounters[cpu][i] = counterDelta(layout, since.cpuCounters[cpu][i], now.cpuCounters[cpu][i])
+		}
+	}
+
+	return s.snapshot(cpuCounters)
+}
+
+// WriteReport writes the coverage up to now in the given format, see `BlockList.WriteReport`.
+func (s *Session) WriteReport(format ReportFormat, w io.Writer) error {
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	return snapshot.WriteReport(format, w)
+}
+
+// snapshot returns a snapshot with the counts of the given counters of every CPU applied to the block-list of the
+// session.
+func (s *Session) snapshot(cpuCounters [][]uint64) (*Snapshot, error) {
+	blockList := s.Instrumentation.BlockList()
+	if err := blockList.applyCounters(cpuCounters); err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{BlockList: blockList, cpuCounters: cpuCounters}, nil
+}
+
+// counterDelta returns how much a counter of a single CPU increased from `before` to `after`. A counter which is
+// lower than before wrapped around. Saturating counters don't wrap around, so 0 is returned for those.
+func counterDelta(layout CoverMapLayout, before, after uint64) uint64 {
+	if after >= before {
+		return after - before
+	}
+
+	if layout.Saturating {
+		return 0
+	}
+
+	return after + (layout.CounterWidth.Max() - before) + 1
+}
@@ -0,0 +1,194 @@
+package coverbee
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout CoverMapLayout
+		before uint64
+		after  uint64
+		want   uint64
+	}{
+		{
+			name:   "Increased",
+			layout: CoverMapLayout{CounterWidth: Counter16Bit, Strategy: CounterStrategyShared},
+			before: 3,
+			after:  10,
+			want:   7,
+		},
+		{
+			name:   "Unchanged",
+			layout: CoverMapLayout{CounterWidth: Counter16Bit, Strategy: CounterStrategyShared},
+			before: 3,
+			after:  3,
+			want:   0,
+		},
+		{
+			name:   "Wrapped 8 bit",
+			layout: CoverMapLayout{CounterWidth: Counter8Bit, Strategy: CounterStrategyShared},
+			before: 250,
+			after:  4,
+			want:   10,
+		},
+		{
+			name:   "Wrapped 64 bit",
+			layout: CoverMapLayout{CounterWidth: Counter64Bit, Strategy: CounterStrategyAtomic},
+			before: 1<<64 - 2,
+			after:  1,
+			want:   3,
+		},
+		{
+			name:   "Saturating",
+			layout: CoverMapLayout{CounterWidth: Counter8Bit, Saturating: true, Strategy: CounterStrategyShared},
+			before: 250,
+			after:  4,
+			want:   0,
+		},
+		{
+			// The counters of each CPU are unwrapped separately.
+			name:   "Per-CPU",
+			layout: CoverMapLayout{CounterWidth: Counter8Bit, Strategy: CounterStrategyPerCPU},
+			before: 250,
+			after:  4,
+			want:   10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := counterDelta(tt.layout, tt.before, tt.after); got != tt.want {
+				t.Fatalf("counterDelta() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyCounters(t *testing.T) {
+	blockList := &BlockList{
+		Blocks:        make([][]CoverBlock, 3),
+		BlockCounters: []int{0, -1, 1},
+		DerivedCounts: []DerivedCount{
+			{BlockID: 1, Terms: []CounterTerm{{Counter: 0, Factor: 1}, {Counter: 1, Factor: -1}}},
+		},
+		Functions: []FunctionCoverage{{Program: "prog", Name: "prog", BlockID: 0}},
+		Branches:  []BranchCoverage{{BlockID: 0, TakenCounter: 2, NotTakenCounter: 3}},
+	}
+	for i := range blockList.Blocks {
+		blockList.Blocks[i] = make([]CoverBlock, 1)
+	}
+
+	if err := blockList.applyCounters([][]uint64{{5, 2, 3, 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for blockID, want := range []int{5, 3, 2} {
+		if got := blockList.Blocks[blockID][0].ProfileBlock.Count; got != want {
+			t.Errorf("block %d: count %d, want %d", blockID, got, want)
+		}
+	}
+	if got := blockList.Functions[0].Calls; got != 5 {
+		t.Errorf("function called %d times, want 5", got)
+	}
+	if got := blockList.Branches[0]; got.Taken != 3 || got.NotTaken != 2 {
+		t.Errorf("branch taken %d and not taken %d times, want 3 and 2", got.Taken, got.NotTaken)
+	}
+}
+
+// TestSession runs the example program between snapshots and resets of a session, the test is skipped without the
+// privileges to load it.
+func TestSession(t *testing.T) {
+	spec, err := ebpf.LoadCollectionSpec(filepath.Join("examples", "bpf-to-bpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	numInstructions := len(spec.Programs["firewall_prog"].Instructions)
+
+	data, err := os.ReadFile(filepath.Join("examples", "datain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := NewSession(spec, ebpf.CollectionOptions{}, InstrumentOptions{})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skipf("can't load the collection: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if _, found := spec.Maps[DefaultCoverMapName]; found ||
+		len(spec.Programs["firewall_prog"].Instructions) != numInstructions {
+		t.Error("the spec of the caller was instrumented")
+	}
+
+	run := func(times int) {
+		t.Helper()
+		for i := 0; i < times; i++ {
+			if _, err := session.Collection.Programs["firewall_prog"].Run(&ebpf.RunOptions{Data: data}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	calls := func(snapshot *Snapshot) int {
+		t.Helper()
+		for _, fn := range snapshot.BlockList.Functions {
+			if fn.Name == "firewall_prog" {
+				return fn.Calls
+			}
+		}
+		t.Fatal("snapshot has no function 'firewall_prog'")
+		return 0
+	}
+
+	run(2)
+	before, err := session.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := calls(before); got != 2 {
+		t.Errorf("snapshot has %d calls, want 2", got)
+	}
+
+	run(3)
+	delta, err := session.Delta(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := calls(delta); got != 3 {
+		t.Errorf("delta has %d calls, want 3", got)
+	}
+
+	if err = session.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	reset, err := session.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := calls(reset); got != 0 {
+		t.Errorf("snapshot after reset has %d calls, want 0", got)
+	}
+	for blockID, block := range reset.BlockList.Blocks {
+		if len(block) > 0 && block[0].ProfileBlock.Count != 0 {
+			t.Errorf("block %d has count %d after reset", blockID, block[0].ProfileBlock.Count)
+		}
+	}
+
+	run(1)
+	delta, err = session.Delta(reset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := calls(delta); got != 1 {
+		t.Errorf("delta after reset has %d calls, want 1", got)
+	}
+}